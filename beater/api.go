@@ -0,0 +1,173 @@
+package beater
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+// API serves an HTTP API for listing, adding and removing targets while
+// pingbeat is running:
+//
+//	GET /targets          lists the current targets
+//	POST /targets         adds a target, given as a JSON target config
+//	DELETE /targets/{ip}  removes the targets with the address
+type API struct {
+	bt       *Pingbeat
+	state    *PingState
+	server   *http.Server
+	listener net.Listener
+}
+
+// NewAPI creates the API changing the targets of bt, with requests to
+// removed targets cleaned from state
+func NewAPI(bt *Pingbeat, state *PingState) *API {
+	a := &API{bt: bt, state: state}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/targets", a.targets)
+	mux.HandleFunc("/targets/", a.target)
+	a.server = &http.Server{Handler: mux}
+	return a
+}
+
+// Start listens on the given address and serves the API in the background
+func (a *API) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	a.listener = listener
+	go func() {
+		if err := a.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logp.Err("Error serving API: %v", err)
+		}
+	}()
+	logp.Info("Serving API on %v", listener.Addr())
+	return nil
+}
+
+// Stop shuts down the API server
+func (a *API) Stop() {
+	if err := a.server.Close(); err != nil {
+		logp.Err("Error stopping API server: %v", err)
+	}
+}
+
+// targets lists or adds targets
+func (a *API) targets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, targetList(a.bt.getTargets()))
+	case http.MethodPost:
+		added, err := a.add(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.bt.addTargets(added)
+		targets := make(map[string]Target, len(added))
+		for _, target := range added {
+			targets[addrKey(target.Addr)] = *target
+		}
+		writeJSON(w, http.StatusCreated, targetList(targets))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// target removes the targets with the address in the path
+func (a *API) target(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	addr, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/targets/"))
+	if err != nil || addr == "" {
+		http.Error(w, "invalid target address", http.StatusBadRequest)
+		return
+	}
+	if a.bt.removeTargets(addr, a.state) == 0 {
+		http.Error(w, fmt.Sprintf("no target %s", addr), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// add reads a target config from the request and returns the targets for it,
+// validated and resolved in the same way as configured targets
+func (a *API) add(r *http.Request) ([]*Target, error) {
+	var settings map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		return nil, fmt.Errorf("invalid target: %v", err)
+	}
+	cfg, err := common.NewConfigFrom(settings)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %v", err)
+	}
+	target := &targetConfig{}
+	if err := cfg.Unpack(target); err != nil {
+		return nil, fmt.Errorf("invalid target: %v", err)
+	}
+	if target.Name == "" {
+		return nil, fmt.Errorf("target needs a name")
+	}
+	// The API is unauthenticated, so it mustn't be able to make pingbeat
+	// send its secrets, or read files, for a target of the caller's choosing
+	if len(target.Headers) > 0 || target.Username != "" || target.Password != "" || target.PasswordFile != "" ||
+		target.BearerToken != "" || target.BearerTokenFile != "" {
+		return nil, fmt.Errorf("targets added through the API can't have headers or credentials")
+	}
+	c := a.bt.config
+	p := pool.New()
+	defer p.Close()
+	work := p.Queue(AddTarget(target, a.bt.privileges(), c.UseIPv4, c.UseIPv6, c.MaxCIDRHosts))
+	work.Wait()
+	if err := work.Error(); err != nil {
+		return nil, err
+	}
+	added := work.Value().([]*Target)
+	if len(added) == 0 {
+		return nil, fmt.Errorf("target %s has no addresses to ping", target.Name)
+	}
+	for _, target := range added {
+		target.Dynamic = true
+	}
+	return added, nil
+}
+
+// targetList returns the details of targets as published in events, with
+// their protocol, ordered by address
+func targetList(targets map[string]Target) []common.MapStr {
+	addrs := make([]string, 0, len(targets))
+	for addr := range targets {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	list := make([]common.MapStr, 0, len(addrs))
+	for _, addr := range addrs {
+		target := targets[addr]
+		details := target.fields(addr)
+		details["protocol"] = target.Protocol
+		list = append(list, details)
+	}
+	return list
+}
+
+// writeJSON writes v as the JSON body of a response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logp.Err("Error writing API response: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+// +build !integration
+
+package beater
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPITargets(t *testing.T) {
+	bt, _ := newTestBeat("192.0.2.1")
+	state := NewPingState()
+	server := httptest.NewServer(NewAPI(bt, state).server.Handler)
+	defer server.Close()
+
+	do := func(method string, path string, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	list := func() []map[string]interface{} {
+		resp := do("GET", "/targets", "")
+		defer resp.Body.Close()
+		var targets []map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&targets); err != nil {
+			t.Fatal(err)
+		}
+		return targets
+	}
+
+	resp := do("POST", "/targets", `{"name": "192.0.2.2", "tags": ["added"]}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected target created, got %v", resp.Status)
+	}
+	targets := list()
+	if len(targets) != 2 || targets[1]["addr"] != "192.0.2.2" || targets[1]["protocol"] != "icmp" {
+		t.Errorf("expected the added target listed, got %v", targets)
+	}
+
+	// Removing a target drops its outstanding requests too
+	state.AddPing("192.0.2.1", 1, time.Now().UTC(), 0)
+	resp = do("DELETE", "/targets/192.0.2.1", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected target removed, got %v", resp.Status)
+	}
+	if targets := list(); len(targets) != 1 || targets[0]["addr"] != "192.0.2.2" {
+		t.Errorf("expected only the added target left, got %v", targets)
+	}
+	if pings := state.CleanPings(0); len(pings) != 0 {
+		t.Errorf("expected requests to the removed target dropped, got %d", len(pings))
+	}
+
+	resp = do("DELETE", "/targets/192.0.2.1", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected removing a missing target not found, got %v", resp.Status)
+	}
+}
+
+func TestAPIInvalid(t *testing.T) {
+	bt, _ := newTestBeat("192.0.2.1")
+	server := httptest.NewServer(NewAPI(bt, NewPingState()).server.Handler)
+	defer server.Close()
+	secret, err := ioutil.TempFile("", "pingbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secret.Name())
+	secret.WriteString("secret")
+	secret.Close()
+
+	for _, body := range []string{
+		`not json`,
+		`{"tags": ["no name"]}`,
+		`{"name": "192.0.2.2", "interval": "1ms"}`,
+		// Headers and credentials can only be configured
+		`{"name": "192.0.2.2", "protocol": "http", "url": "http://192.0.2.2/", "username": "user", "passwordfile": "` + secret.Name() + `"}`,
+		`{"name": "192.0.2.2", "protocol": "http", "url": "http://192.0.2.2/", "bearertokenfile": "` + secret.Name() + `"}`,
+		`{"name": "192.0.2.2", "protocol": "http", "url": "http://192.0.2.2/", "username": "user", "password": "secret"}`,
+		`{"name": "192.0.2.2", "protocol": "http", "url": "http://192.0.2.2/", "bearertoken": "secret"}`,
+		`{"name": "192.0.2.2", "protocol": "grpc", "port": 50051, "headers": {"authorization": "secret"}}`,
+	} {
+		resp, err := http.Post(server.URL+"/targets", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request, got %v", body, resp.Status)
+		}
+	}
+	if targets := bt.getTargets(); len(targets) != 1 {
+		t.Errorf("expected invalid targets not added, got %v", targets)
+	}
+}
+
+func TestAPITargetsReload(t *testing.T) {
+	bt, _ := newTestBeat()
+	c := newTestConfig(t, map[string]interface{}{
+		"targets": []interface{}{
+			map[string]interface{}{"name": "198.51.100.1"},
+		},
+	})
+	if err := c.Unpack(&bt.config); err != nil {
+		t.Fatal(err)
+	}
+	bt.config.Privileged = true
+	state := NewPingState()
+	if err := bt.ReloadTargets(state); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewAPI(bt, state).server.Handler)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/targets", "application/json", strings.NewReader(`{"name": "192.0.2.2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected target created, got %v", resp.Status)
+	}
+
+	// Reloading the configured targets, e.g. on SIGHUP, keeps those added
+	// through the API
+	bt.config.Targets = nil
+	if err := bt.ReloadTargets(state); err != nil {
+		t.Fatal(err)
+	}
+	bt.ResolveTargets()
+	targets := bt.getTargets()
+	if _, found := targets["192.0.2.2"]; !found {
+		t.Errorf("target added through the API lost on reload, got %v", targets)
+	}
+	if _, found := targets["198.51.100.1"]; found {
+		t.Errorf("target no longer configured kept on reload, got %v", targets)
+	}
+}
@@ -0,0 +1,69 @@
+package beater
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"strings"
+)
+
+// probeHeaders returns the headers HTTP and gRPC probes of a target send,
+// with any credentials added as an Authorization header. Secrets can be read
+// from files, which are read again whenever the targets are reloaded
+func probeHeaders(target *targetConfig) (map[string]string, error) {
+	password, err := secret("password", target.Password, target.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	token, err := secret("bearertoken", target.BearerToken, target.BearerTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	var auth string
+	switch {
+	case target.Username != "" && token != "":
+		return nil, fmt.Errorf("username and bearertoken can't both be set")
+	case target.Username != "":
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(target.Username+":"+password))
+	case password != "":
+		return nil, fmt.Errorf("password needs a username")
+	case token != "":
+		auth = "Bearer " + token
+	}
+	if len(target.Headers) == 0 && auth == "" {
+		return nil, nil
+	}
+	switch target.Protocol {
+	case "http", "grpc":
+	default:
+		return nil, fmt.Errorf("headers and credentials are only sent by http and grpc targets")
+	}
+	headers := make(map[string]string, len(target.Headers)+1)
+	for key, value := range target.Headers {
+		headers[textproto.CanonicalMIMEHeaderKey(key)] = value
+	}
+	if auth != "" {
+		if _, found := headers["Authorization"]; found {
+			return nil, fmt.Errorf("authorization header can't be set along with credentials")
+		}
+		headers["Authorization"] = auth
+	}
+	return headers, nil
+}
+
+// secret returns a secret set either in the config or in a file, with
+// surrounding whitespace trimmed from the file
+func secret(name string, value string, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("%s and %sfile can't both be set", name, name)
+	}
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("reading %sfile: %v", name, err)
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
@@ -0,0 +1,90 @@
+package beater
+
+import (
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/publisher"
+)
+
+// eventBatcher collects events and publishes them together. A batch is
+// published as soon as it is full, by the caller adding the last event, so
+// publishing backpressure holds up processing instead of growing the batch
+type eventBatcher struct {
+	client publisher.Client
+	size   int
+	mu     sync.Mutex
+	events []common.MapStr
+	done   chan struct{}
+	// stopped is closed once the flush loop has returned
+	stopped chan struct{}
+}
+
+// newEventBatcher creates a batcher publishing batches of up to size events
+// to client
+func newEventBatcher(client publisher.Client, size int) *eventBatcher {
+	return &eventBatcher{
+		client:  client,
+		size:    size,
+		events:  make([]common.MapStr, 0, size),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Start publishes any batched events every interval until stopped, so events
+// aren't held back when few pings are processed
+func (b *eventBatcher) Start(interval time.Duration) {
+	go func() {
+		defer close(b.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-ticker.C:
+				b.Flush()
+			}
+		}
+	}()
+}
+
+// Stop publishes any batched events
+func (b *eventBatcher) Stop() {
+	close(b.done)
+	<-b.stopped
+	b.Flush()
+}
+
+// Add batches an event, publishing the batch if it is full
+func (b *eventBatcher) Add(event common.MapStr) {
+	b.mu.Lock()
+	b.events = append(b.events, event)
+	if len(b.events) < b.size {
+		b.mu.Unlock()
+		return
+	}
+	events := b.take()
+	b.mu.Unlock()
+	b.client.PublishEvents(events)
+}
+
+// Flush publishes the batched events
+func (b *eventBatcher) Flush() {
+	b.mu.Lock()
+	events := b.take()
+	b.mu.Unlock()
+	if len(events) > 0 {
+		b.client.PublishEvents(events)
+	}
+}
+
+// take returns the batched events and starts a new batch. It must be called
+// with mu held
+func (b *eventBatcher) take() []common.MapStr {
+	events := b.events
+	b.events = make([]common.MapStr, 0, b.size)
+	return events
+}
@@ -0,0 +1,84 @@
+// +build !integration
+
+package beater
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/publisher"
+)
+
+// batchClient is a publisher.Client recording each batch published
+type batchClient struct {
+	testClient
+	mu      sync.Mutex
+	batches [][]common.MapStr
+}
+
+func (c *batchClient) PublishEvents(events []common.MapStr, opts ...publisher.ClientOption) bool {
+	c.mu.Lock()
+	c.batches = append(c.batches, events)
+	c.mu.Unlock()
+	return true
+}
+
+func (c *batchClient) published() [][]common.MapStr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.batches
+}
+
+func TestBatchPublish(t *testing.T) {
+	bt, _ := newTestBeat("192.0.2.1")
+	client := &batchClient{testClient: *newTestClient()}
+	bt.batcher = newEventBatcher(client, 10)
+	bt.batcher.Start(time.Hour)
+
+	for seq := 0; seq < 10; seq++ {
+		bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: seq, RTT: time.Millisecond})
+	}
+	batches := client.published()
+	if len(batches) != 1 || len(batches[0]) != 10 {
+		t.Fatalf("expected a single batch of 10 events, got %v", batches)
+	}
+	for seq, event := range batches[0] {
+		if event["seq"] != seq {
+			t.Errorf("expected seq %d, got %v", seq, event["seq"])
+		}
+	}
+	select {
+	case event := <-client.events:
+		t.Errorf("event %v published on its own", event)
+	default:
+	}
+
+	// A partial batch is held until stopped
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 10, RTT: time.Millisecond})
+	if n := len(client.published()); n != 1 {
+		t.Fatalf("expected partial batch to be held, got %d batches", n)
+	}
+	bt.batcher.Stop()
+	batches = client.published()
+	if len(batches) != 2 || len(batches[1]) != 1 || batches[1][0]["seq"] != 10 {
+		t.Errorf("expected partial batch to be published when stopped, got %v", batches)
+	}
+}
+
+func TestBatchFlushInterval(t *testing.T) {
+	client := &batchClient{testClient: *newTestClient()}
+	batcher := newEventBatcher(client, 10)
+	batcher.Start(10 * time.Millisecond)
+	defer batcher.Stop()
+
+	batcher.Add(common.MapStr{"seq": 1})
+	deadline := time.Now().Add(time.Second)
+	for len(client.published()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if batches := client.published(); len(batches) != 1 || len(batches[0]) != 1 {
+		t.Errorf("expected partial batch to be flushed, got %v", batches)
+	}
+}
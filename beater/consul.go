@@ -0,0 +1,84 @@
+package beater
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/joshuar/pingbeat/config"
+)
+
+// consulTimeout bounds how long a Consul catalog query can take
+const consulTimeout = 10 * time.Second
+
+// consulClient is used to query the Consul HTTP API
+var consulClient = &http.Client{Timeout: consulTimeout}
+
+// consulEntry is the part of a Consul health API entry describing where a
+// service instance runs
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		ID      string
+		Address string
+		Tags    []string
+	}
+}
+
+// consulTargets queries Consul for the healthy instances of the configured
+// service and returns a target config for each. Instances are named after the
+// service and tagged with their service tags
+func consulTargets(cfg config.ConsulConfig) ([]*targetConfig, error) {
+	u, err := url.Parse(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid consul addr %s", cfg.Addr)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/health/service/" + url.PathEscape(cfg.Service)
+	query := url.Values{"passing": {"1"}}
+	if cfg.Tag != "" {
+		query.Set("tag", cfg.Tag)
+	}
+	u.RawQuery = query.Encode()
+
+	resp, err := consulClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("consul returned %s for service %s", resp.Status, cfg.Service)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("error decoding consul response: %v", err)
+	}
+
+	var configs []*targetConfig
+	for _, entry := range entries {
+		// Instances without their own address run on the node address
+		addr := entry.Service.Address
+		if addr == "" {
+			addr = entry.Node.Address
+		}
+		if addr == "" {
+			logp.Warn("Consul instance %v of %v has no address, not adding it", entry.Service.ID, cfg.Service)
+			continue
+		}
+		configs = append(configs, &targetConfig{
+			Addr: addr,
+			Name: cfg.Service,
+			Tags: entry.Service.Tags,
+		})
+	}
+	logp.Debug("targets", "Found %d instances of %v in consul", len(configs), cfg.Service)
+	return configs, nil
+}
@@ -0,0 +1,73 @@
+// +build !integration
+
+package beater
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/joshuar/pingbeat/config"
+)
+
+func TestConsulTargets(t *testing.T) {
+	var mu sync.Mutex
+	instances := `[
+		{"Node": {"Address": "192.0.2.1"}, "Service": {"ID": "web1", "Address": "", "Tags": ["prod"]}},
+		{"Node": {"Address": "192.0.2.9"}, "Service": {"ID": "web2", "Address": "192.0.2.2", "Tags": ["prod"]}}
+	]`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/web" || r.URL.Query().Get("passing") != "1" || r.URL.Query().Get("tag") != "prod" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(w, instances)
+	}))
+	defer ts.Close()
+
+	bt, _ := newTestBeat()
+	bt.config.Consul = config.ConsulConfig{Addr: ts.URL, Service: "web", Tag: "prod"}
+	targets, err := bt.loadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets, got %v", targets)
+	}
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2"} {
+		target, found := targets[addr]
+		if !found {
+			t.Errorf("missing target for %v", addr)
+			continue
+		}
+		if target.Name != "web" || len(target.Tags) != 1 || target.Tags[0] != "prod" {
+			t.Errorf("unexpected target %+v", target)
+		}
+	}
+
+	// Instances leaving and joining are reconciled
+	bt.setTargets(targets)
+	mu.Lock()
+	instances = `[{"Node": {"Address": "192.0.2.3"}, "Service": {"ID": "web3", "Tags": ["prod"]}}]`
+	mu.Unlock()
+	if err := bt.ReloadTargets(NewPingState()); err != nil {
+		t.Fatal(err)
+	}
+	targets = bt.getTargets()
+	if _, found := targets["192.0.2.3"]; !found || len(targets) != 1 {
+		t.Errorf("expected only the new instance as a target, got %v", targets)
+	}
+
+	// Targets are kept if Consul can't be queried
+	bt.config.Consul.Service = "db"
+	if err := bt.ReloadTargets(NewPingState()); err == nil {
+		t.Error("expected an error for an unknown service")
+	}
+	if len(bt.getTargets()) != 1 {
+		t.Errorf("expected targets to be kept, got %v", bt.getTargets())
+	}
+}
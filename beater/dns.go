@@ -0,0 +1,189 @@
+package beater
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+// defaultDNSPort is the port DNS targets are queried on if unset
+const defaultDNSPort = 53
+
+// dnsMaxUDPSize is the largest DNS response expected over UDP without EDNS
+const dnsMaxUDPSize = 512
+
+// DNSInfo contains the result of a DNS query
+type DNSInfo struct {
+	// RCode is the response code, e.g. NOERROR or NXDOMAIN
+	RCode   string
+	Answers int
+}
+
+// dnsTypes are the query types DNS targets can use
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+// dnsRCodes are the names response codes are published under
+var dnsRCodes = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+// dnsRCodeName returns the name of a response code
+func dnsRCodeName(rcode dnsmessage.RCode) string {
+	if name, found := dnsRCodes[rcode]; found {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// parseDNSQuery checks the query name and type of a DNS target, the type
+// defaulting to A
+func parseDNSQuery(query string, queryType string) (dnsmessage.Name, dnsmessage.Type, error) {
+	if query == "" {
+		return dnsmessage.Name{}, 0, fmt.Errorf("dns targets need a query")
+	}
+	if !strings.HasSuffix(query, ".") {
+		query += "."
+	}
+	name, err := dnsmessage.NewName(query)
+	if err != nil {
+		return dnsmessage.Name{}, 0, fmt.Errorf("invalid query %s: %v", query, err)
+	}
+	if queryType == "" {
+		queryType = "A"
+	}
+	qtype, found := dnsTypes[strings.ToUpper(queryType)]
+	if !found {
+		return dnsmessage.Name{}, 0, fmt.Errorf("unknown query type %s", queryType)
+	}
+	return name, qtype, nil
+}
+
+// SendDNSPing queries the resolver at the provided address and records the
+// time until it responds as the RTT. Truncated responses are queried again
+// over TCP. Queries that time out or fail with SERVFAIL are recorded as lost
+// pings, other response codes are answers like any other
+func SendDNSPing(timeout time.Duration, seq int, addr net.Addr, name dnsmessage.Name, qtype dnsmessage.Type) pool.WorkFunc {
+	return func(wu pool.WorkUnit) (interface{}, error) {
+		if wu.IsCancelled() {
+			logp.Debug("SendPings", "SendDNSPing: workunit cancelled")
+			return nil, nil
+		}
+		ping := &PingInfo{
+			Seq:      seq,
+			Target:   addr.String(),
+			Protocol: "dns",
+		}
+		query := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: uint16(seq), RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+		}
+		request, err := query.Pack()
+		if err != nil {
+			return nil, err
+		}
+
+		ping.Sent = time.Now().UTC()
+		deadline := ping.Sent.Add(timeout)
+		response, err := dnsExchange("udp", addr.String(), request, deadline)
+		if err == nil && response.Truncated {
+			logp.Debug("SendPings", "Truncated response from %v, retrying over TCP", addr)
+			response, err = dnsExchange("tcp", addr.String(), request, deadline)
+		}
+		if err != nil {
+			ping.Loss = true
+			ping.LossReason = udpLossReason(err)
+			return ping, nil
+		}
+		ping.Received = time.Now().UTC()
+		ping.RTT = ping.Received.Sub(ping.Sent)
+		ping.DNS = &DNSInfo{
+			RCode:   dnsRCodeName(response.RCode),
+			Answers: len(response.Answers),
+		}
+		if response.RCode == dnsmessage.RCodeServerFailure {
+			ping.Loss = true
+			ping.LossReason = ping.DNS.RCode
+		}
+		return ping, nil
+	}
+}
+
+// dnsExchange sends a packed query to the resolver over the given network and
+// returns its response. Over TCP, messages are prefixed with their length
+func dnsExchange(network string, addr string, request []byte, deadline time.Time) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout(network, addr, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	id := binary.BigEndian.Uint16(request)
+	if network == "tcp" {
+		b := make([]byte, 2+len(request))
+		binary.BigEndian.PutUint16(b, uint16(len(request)))
+		copy(b[2:], request)
+		if _, err := conn.Write(b); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, b[:2]); err != nil {
+			return nil, err
+		}
+		b = make([]byte, binary.BigEndian.Uint16(b))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		return parseDNSResponse(b, id)
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	// Skip anything that isn't the response to this query, e.g. a late
+	// response to an earlier one
+	b := make([]byte, dnsMaxUDPSize)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		if response, err := parseDNSResponse(b[:n], id); err == nil {
+			return response, nil
+		}
+	}
+}
+
+// parseDNSResponse decodes a response, which must answer the query with the
+// given ID
+func parseDNSResponse(b []byte, id uint16) (*dnsmessage.Message, error) {
+	var response dnsmessage.Message
+	if err := response.Unpack(b); err != nil {
+		return nil, err
+	}
+	if !response.Response || response.ID != id {
+		return nil, fmt.Errorf("unexpected response %d to query %d", response.ID, id)
+	}
+	return &response, nil
+}
@@ -0,0 +1,188 @@
+// +build !integration
+
+package beater
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+// stubResolver answers DNS queries for A records with 192.0.2.10, or with
+// rcode. With truncate set, responses over UDP are truncated so the query is
+// retried over TCP on the same port
+type stubResolver struct {
+	udp      net.PacketConn
+	tcp      net.Listener
+	mu       sync.Mutex
+	rcode    dnsmessage.RCode
+	truncate bool
+}
+
+func newStubResolver(t *testing.T) *stubResolver {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		t.Skipf("cannot listen on TCP port of stub resolver: %v", err)
+	}
+	s := &stubResolver{udp: udp, tcp: tcp}
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *stubResolver) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+func (s *stubResolver) set(rcode dnsmessage.RCode, truncate bool) {
+	s.mu.Lock()
+	s.rcode, s.truncate = rcode, truncate
+	s.mu.Unlock()
+}
+
+func (s *stubResolver) answer(b []byte, udp bool) []byte {
+	s.mu.Lock()
+	rcode, truncate := s.rcode, udp && s.truncate
+	s.mu.Unlock()
+	var query dnsmessage.Message
+	if err := query.Unpack(b); err != nil {
+		return nil
+	}
+	response := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true, RCode: rcode, Truncated: truncate},
+		Questions: query.Questions,
+	}
+	if rcode == dnsmessage.RCodeSuccess && !truncate {
+		response.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 10}},
+		}}
+	}
+	packed, _ := response.Pack()
+	return packed
+}
+
+func (s *stubResolver) serveUDP() {
+	b := make([]byte, dnsMaxUDPSize)
+	for {
+		n, peer, err := s.udp.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		s.udp.WriteTo(s.answer(b[:n], true), peer)
+	}
+}
+
+func (s *stubResolver) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(conn, b); err == nil {
+			b = make([]byte, binary.BigEndian.Uint16(b))
+			if _, err := io.ReadFull(conn, b); err == nil {
+				response := s.answer(b, false)
+				length := make([]byte, 2)
+				binary.BigEndian.PutUint16(length, uint16(len(response)))
+				conn.Write(append(length, response...))
+			}
+		}
+		conn.Close()
+	}
+}
+
+func runDNSPing(t *testing.T, timeout time.Duration, addr net.Addr) *PingInfo {
+	name, qtype, err := parseDNSQuery("example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wu := pool.New().Queue(SendDNSPing(timeout, 7, addr, name, qtype))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return wu.Value().(*PingInfo)
+}
+
+func TestSendDNSPing(t *testing.T) {
+	resolver := newStubResolver(t)
+	defer resolver.Close()
+	addr := resolver.udp.LocalAddr()
+
+	ping := runDNSPing(t, time.Second, addr)
+	if ping.Loss {
+		t.Fatalf("unexpected loss: %v", ping.LossReason)
+	}
+	if ping.Protocol != "dns" || ping.RTT <= 0 || ping.DNS.RCode != "NOERROR" || ping.DNS.Answers != 1 {
+		t.Errorf("unexpected ping %+v (%+v)", ping, ping.DNS)
+	}
+
+	resolver.set(dnsmessage.RCodeSuccess, true)
+	if ping = runDNSPing(t, time.Second, addr); ping.Loss || ping.DNS.Answers != 1 {
+		t.Errorf("expected answer over TCP after truncation, got %+v (%+v)", ping, ping.DNS)
+	}
+
+	resolver.set(dnsmessage.RCodeNameError, false)
+	if ping = runDNSPing(t, time.Second, addr); ping.Loss || ping.DNS.RCode != "NXDOMAIN" {
+		t.Errorf("expected NXDOMAIN answer, got %+v (%+v)", ping, ping.DNS)
+	}
+
+	resolver.set(dnsmessage.RCodeServerFailure, false)
+	if ping = runDNSPing(t, time.Second, addr); !ping.Loss || ping.LossReason != "SERVFAIL" {
+		t.Errorf("expected SERVFAIL loss, got %+v", ping)
+	}
+
+	// Nothing answers on the port once closed
+	resolver.Close()
+	if ping = runDNSPing(t, 100*time.Millisecond, addr); !ping.Loss || ping.DNS != nil {
+		t.Errorf("expected unanswered query to be lost, got %+v", ping)
+	}
+}
+
+func TestDNSTarget(t *testing.T) {
+	bt, client := newTestBeat()
+	target := &targetConfig{Name: "127.0.0.1", Protocol: "dns", Query: "example.com", QueryType: "aaaa"}
+	targets := addTarget(t, target)
+	if len(targets) != 1 || targets[0].Addr.String() != "127.0.0.1:53" || targets[0].QueryType != dnsmessage.TypeAAAA {
+		t.Fatalf("unexpected dns targets %+v", targets)
+	}
+	bt.targets[addrKey(targets[0].Addr)] = *targets[0]
+
+	bt.ProcessPing(&PingInfo{
+		Target:   "127.0.0.1:53",
+		Protocol: "dns",
+		RTT:      time.Millisecond,
+		DNS:      &DNSInfo{RCode: "NOERROR", Answers: 2},
+	})
+	event := client.next(t)
+	if event["protocol"] != "dns" || event["target"].(common.MapStr)["port"] != 53 {
+		t.Errorf("unexpected dns target in %v", event)
+	}
+	if dns := event["dns"].(common.MapStr); dns["rcode"] != "NOERROR" || dns["answers"] != 2 {
+		t.Errorf("unexpected dns result in %v", event)
+	}
+
+	for _, target := range []*targetConfig{
+		{Name: "127.0.0.1", Protocol: "dns"},
+		{Name: "127.0.0.1", Protocol: "dns", Query: "example.com", QueryType: "BOGUS"},
+	} {
+		if _, err := addTargetErr(target); err == nil {
+			t.Errorf("expected %+v to be rejected", target)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package beater
+
+import (
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// EchoPacket is a marshaled ICMP EchoRequest that is reused for every ping
+// sent over a connection, only the sequence number and checksum differ
+// between pings
+type EchoPacket struct {
+	ID       int
+	template []byte
+	// checksum is set for ICMPv4, the kernel calculates ICMPv6 checksums
+	checksum bool
+}
+
+// NewEchoPacket marshals an EchoRequest of the given type with the ID and
+// payload used for every ping
+func NewEchoPacket(pingType icmp.Type, id int, data []byte) (*EchoPacket, error) {
+	message := &icmp.Message{
+		Type: pingType, Code: 0,
+		Body: &icmp.Echo{
+			ID:   id,
+			Data: data,
+		},
+	}
+	template, err := message.Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+	_, checksum := pingType.(ipv4.ICMPType)
+	return &EchoPacket{
+		ID:       id,
+		template: template,
+		checksum: checksum,
+	}, nil
+}
+
+// Packet returns the EchoRequest with the given sequence number
+func (e *EchoPacket) Packet(seq int) []byte {
+	b := make([]byte, len(e.template))
+	copy(b, e.template)
+	b[6], b[7] = byte(seq>>8), byte(seq)
+	if e.checksum {
+		b[2], b[3] = 0, 0
+		s := icmpChecksum(b)
+		b[2], b[3] = byte(s>>8), byte(s)
+	}
+	return b
+}
+
+// icmpChecksum calculates the Internet checksum (RFC 1071) of an ICMP
+// message
+func icmpChecksum(b []byte) uint16 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	s = s>>16 + s&0xffff
+	s += s >> 16
+	return ^uint16(s)
+}
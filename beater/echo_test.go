@@ -0,0 +1,70 @@
+// +build !integration
+
+package beater
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// marshalEcho builds an EchoRequest from scratch, as every ping used to
+func marshalEcho(pingType icmp.Type, id int, seq int, data []byte) ([]byte, error) {
+	message := &icmp.Message{
+		Type: pingType, Code: 0,
+		Body: &icmp.Echo{
+			ID:   id,
+			Seq:  seq,
+			Data: data,
+		},
+	}
+	return message.Marshal(nil)
+}
+
+func TestEchoPacket(t *testing.T) {
+	for _, pingType := range []icmp.Type{ipv4.ICMPTypeEcho, ipv6.ICMPTypeEchoRequest} {
+		// Odd and even lengths exercise the checksum padding
+		for _, data := range [][]byte{defaultPayload, []byte("odd")} {
+			echo, err := NewEchoPacket(pingType, 0xbeef, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, seq := range []int{0, 1, 255, 256, 0x7fff, 65535} {
+				expected, err := marshalEcho(pingType, 0xbeef, seq, data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if packet := echo.Packet(seq); !bytes.Equal(packet, expected) {
+					t.Errorf("%v seq %v: expected %x, got %x", pingType, seq, expected, packet)
+				}
+			}
+		}
+	}
+}
+
+const benchmarkTargets = 5000
+
+func BenchmarkMarshalEcho(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for seq := 0; seq < benchmarkTargets; seq++ {
+			marshalEcho(ipv4.ICMPTypeEcho, 0xbeef, seq, defaultPayload)
+		}
+	}
+}
+
+func BenchmarkEchoPacket(b *testing.B) {
+	echo, err := NewEchoPacket(ipv4.ICMPTypeEcho, 0xbeef, defaultPayload)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for seq := 0; seq < benchmarkTargets; seq++ {
+			echo.Packet(seq)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package beater
+
+import (
+	"net"
+	"net/url"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// ecsEvent rewrites a ping event to use Elastic Common Schema fields in place
+// of the target details, RTT and loss reason. Fields without an ECS
+// equivalent are left as they are
+func ecsEvent(event common.MapStr, ping *PingInfo, target Target) common.MapStr {
+	destination := common.MapStr{}
+	switch addr := target.Addr.(type) {
+	case *net.IPAddr:
+		destination["ip"] = addr.IP.String()
+	case *net.UDPAddr:
+		destination["ip"] = addr.IP.String()
+		if target.Protocol == "udp" {
+			destination["port"] = addr.Port
+		}
+	case *net.TCPAddr:
+		destination["ip"] = addr.IP.String()
+		destination["port"] = addr.Port
+	case urlAddr:
+		if u, err := url.Parse(target.URL); err == nil {
+			destination["domain"] = u.Hostname()
+		}
+	}
+	if target.Host != "" && !isLiteral(target.Host) {
+		destination["domain"] = target.Host
+	}
+	if geo, found := event["geo"].(common.MapStr); found {
+		destination["geo"] = common.MapStr{"country_iso_code": geo["country_iso"]}
+		delete(event, "geo")
+	}
+	if as, found := event["as"].(common.MapStr); found {
+		destination["as"] = common.MapStr{
+			"number":       as["number"],
+			"organization": common.MapStr{"name": as["organization"]},
+		}
+		delete(event, "as")
+	}
+	event["destination"] = destination
+	event["network"] = common.MapStr{"protocol": target.Protocol}
+	event["labels"] = common.MapStr{"target": target.Name}
+	if len(target.Tags) > 0 {
+		event["tags"] = target.Tags
+	}
+	delete(event, "target")
+	delete(event, "protocol")
+
+	if ping.Loss {
+		event["event"] = common.MapStr{"outcome": "failure"}
+		event["error"] = common.MapStr{"message": ping.LossReason}
+		delete(event, "reason")
+	} else {
+		event["event"] = common.MapStr{"outcome": "success"}
+		if !ping.RTTInvalid {
+			event["event"].(common.MapStr)["duration"] = ping.RTT.Nanoseconds()
+		}
+		delete(event, "rtt")
+		delete(event, "rtt_ns")
+	}
+	return event
+}
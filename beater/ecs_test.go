@@ -0,0 +1,85 @@
+// +build !integration
+
+package beater
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// field returns the value of a nested event field given as a dotted key
+func field(event common.MapStr, key string) interface{} {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		nested, ok := event[part].(common.MapStr)
+		if !ok {
+			return nil
+		}
+		event = nested
+	}
+	return event[parts[len(parts)-1]]
+}
+
+func TestECSEvent(t *testing.T) {
+	bt, client := newTestBeat()
+	bt.targets["192.0.2.1"] = Target{
+		Addr:     &net.IPAddr{IP: net.ParseIP("192.0.2.1")},
+		Host:     "router1.example.com",
+		Name:     "router1",
+		Tags:     []string{"core"},
+		Protocol: "icmp",
+	}
+	reply := &PingInfo{Seq: 1, Target: "192.0.2.1", RTT: 1500 * time.Microsecond}
+	lost := &PingInfo{Seq: 2, Target: "192.0.2.1", Loss: true, LossReason: "Timeout"}
+
+	// Legacy layout
+	bt.ProcessPing(reply)
+	event := client.next(t)
+	if event["rtt"] != 1.5 {
+		t.Errorf("expected rtt of 1.5ms, got %v", event["rtt"])
+	}
+	if v := field(event, "target.addr"); v != "192.0.2.1" {
+		t.Errorf("expected target.addr 192.0.2.1, got %v", v)
+	}
+	if _, found := event["event"]; found {
+		t.Error("legacy event has ECS fields")
+	}
+	bt.ProcessPing(lost)
+	if event := client.next(t); event["reason"] != "Timeout" {
+		t.Errorf("expected Timeout reason, got %v", event["reason"])
+	}
+
+	// ECS layout
+	bt.config.ECS = true
+	bt.ProcessPing(reply)
+	event = client.next(t)
+	expected := map[string]interface{}{
+		"event.duration":     int64(1500000),
+		"destination.ip":     "192.0.2.1",
+		"destination.domain": "router1.example.com",
+		"network.protocol":   "icmp",
+		"labels.target":      "router1",
+	}
+	for key, value := range expected {
+		if v := field(event, key); v != value {
+			t.Errorf("expected %v of %v, got %v", key, value, v)
+		}
+	}
+	for _, key := range []string{"rtt", "target", "protocol"} {
+		if _, found := event[key]; found {
+			t.Errorf("ECS event still has legacy field %v", key)
+		}
+	}
+	bt.ProcessPing(lost)
+	event = client.next(t)
+	if v := field(event, "error.message"); v != "Timeout" {
+		t.Errorf("expected error.message Timeout, got %v", v)
+	}
+	if _, found := event["reason"]; found {
+		t.Error("ECS event still has legacy field reason")
+	}
+}
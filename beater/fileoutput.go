@@ -0,0 +1,119 @@
+package beater
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/joshuar/pingbeat/config"
+)
+
+// FileOutput appends events to a local file as newline-delimited JSON. Once
+// the file reaches the rotation size it is renamed to path.1, older files
+// moving along to path.2 and so on, and a new file is started
+type FileOutput struct {
+	path        string
+	rotateBytes int64
+	keep        int
+	mu          sync.Mutex
+	file        *os.File
+	size        int64
+}
+
+// NewFileOutput opens the configured file for appending events
+func NewFileOutput(cfg config.FileOutputConfig) (*FileOutput, error) {
+	if cfg.RotateBytes < 0 {
+		return nil, fmt.Errorf("rotatebytes must not be negative")
+	}
+	if cfg.Keep < 1 {
+		return nil, fmt.Errorf("keep must be at least 1")
+	}
+	f := &FileOutput{
+		path:        cfg.Path,
+		rotateBytes: cfg.RotateBytes,
+		keep:        cfg.Keep,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file for appending, carrying on from its current size
+func (f *FileOutput) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write appends an event to the file as a line of JSON, rotating the file
+// first if the event would take it over the rotation size
+func (f *FileOutput) Write(event common.MapStr) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return fmt.Errorf("%s is closed", f.path)
+	}
+	if f.rotateBytes > 0 && f.size > 0 && f.size+int64(len(b)) > f.rotateBytes {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return err
+}
+
+// rotate moves the current file to path.1 and any older files along, dropping
+// the oldest beyond keep, then starts a new file. The caller must hold the
+// lock
+func (f *FileOutput) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	for i := f.keep - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", f.path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", f.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Close syncs and closes the file, events written afterwards are refused
+func (f *FileOutput) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Sync()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	f.file = nil
+	return err
+}
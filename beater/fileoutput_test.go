@@ -0,0 +1,129 @@
+// +build !integration
+
+package beater
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/joshuar/pingbeat/config"
+)
+
+// readNDJSON returns the seq of each event in an NDJSON file, failing on any
+// line that isn't a JSON object
+func readNDJSON(t *testing.T, path string) []int {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var seqs []int
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event struct {
+			Seq int `json:"seq"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid line %q in %v: %v", scanner.Text(), path, err)
+		}
+		seqs = append(seqs, event.Seq)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return seqs
+}
+
+func TestFileOutputRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pingbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pingbeat.ndjson")
+
+	event := func(seq int) common.MapStr {
+		return common.MapStr{
+			"@timestamp": common.Time(time.Now().UTC()),
+			"type":       "pingbeat",
+			"seq":        seq,
+		}
+	}
+	b, err := json.Marshal(event(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Room for two events per file
+	f, err := NewFileOutput(config.FileOutputConfig{Path: path, RotateBytes: int64(2*len(b) + 4), Keep: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := 1; seq <= 7; seq++ {
+		if err := f.Write(event(seq)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Write(event(8)); err == nil {
+		t.Error("expected write after close to fail")
+	}
+
+	// The oldest events are dropped beyond keep rotated files
+	expected := map[string][]int{
+		path:        {7},
+		path + ".1": {5, 6},
+		path + ".2": {3, 4},
+	}
+	for file, want := range expected {
+		if seqs := readNDJSON(t, file); fmt.Sprint(seqs) != fmt.Sprint(want) {
+			t.Errorf("expected events %v in %v, got %v", want, file, seqs)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected no more than 2 rotated files, got %v", err)
+	}
+}
+
+func TestFileOutputPublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pingbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pingbeat.ndjson")
+
+	for _, publish := range []bool{true, false} {
+		os.Remove(path)
+		bt, client := newTestBeat("192.0.2.1")
+		bt.config.FileOutput = config.FileOutputConfig{Path: path, RotateBytes: 1024, Keep: 1, Publish: publish}
+		if bt.file, err = NewFileOutput(bt.config.FileOutput); err != nil {
+			t.Fatal(err)
+		}
+		bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 1, RTT: time.Millisecond})
+		bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 2, Loss: true, LossReason: "Timeout"})
+		bt.file.Close()
+
+		if seqs := readNDJSON(t, path); fmt.Sprint(seqs) != "[1 2]" {
+			t.Errorf("expected both events in the file, got %v", seqs)
+		}
+		select {
+		case event := <-client.events:
+			if !publish {
+				t.Errorf("expected events only in the file, got %v", event)
+			}
+		default:
+			if publish {
+				t.Error("expected events to also be published")
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package beater
+
+import (
+	"net"
+	"sync"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/joshuar/pingbeat/config"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP looks up the country and autonomous system of target addresses in
+// MaxMind databases, e.g. GeoLite2 Country and ASN. Lookups are cached, as
+// targets are pinged over and over
+type GeoIP struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+	mu      sync.Mutex
+	cache   map[string]common.MapStr
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// NewGeoIP opens the databases configured, either of which may be unset
+func NewGeoIP(cfg config.GeoIPConfig) (*GeoIP, error) {
+	g := &GeoIP{cache: make(map[string]common.MapStr)}
+	var err error
+	if cfg.CountryDB != "" {
+		if g.country, err = maxminddb.Open(cfg.CountryDB); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ASNDB != "" {
+		if g.asn, err = maxminddb.Open(cfg.ASNDB); err != nil {
+			g.Close()
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Close closes the databases
+func (g *GeoIP) Close() {
+	if g.country != nil {
+		g.country.Close()
+	}
+	if g.asn != nil {
+		g.asn.Close()
+	}
+}
+
+// Lookup returns the geo and as fields of an address, which are empty if it
+// isn't in the databases
+func (g *GeoIP) Lookup(ip net.IP) common.MapStr {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if fields, found := g.cache[ip.String()]; found {
+		return fields
+	}
+	fields := common.MapStr{}
+	if g.country != nil {
+		var record countryRecord
+		if _, ok, err := g.country.LookupNetwork(ip, &record); err != nil {
+			return fields
+		} else if ok && record.Country.ISOCode != "" {
+			fields["geo"] = common.MapStr{"country_iso": record.Country.ISOCode}
+		}
+	}
+	if g.asn != nil {
+		var record asnRecord
+		if _, ok, err := g.asn.LookupNetwork(ip, &record); err != nil {
+			return fields
+		} else if ok && record.Number != 0 {
+			fields["as"] = common.MapStr{
+				"number":       record.Number,
+				"organization": record.Organization,
+			}
+		}
+	}
+	g.cache[ip.String()] = fields
+	return fields
+}
+
+// enrich adds the geo and as fields of the address of a target to an event.
+// Targets without an IP address, e.g. HTTP URLs, aren't enriched
+func (g *GeoIP) enrich(event common.MapStr, addr net.Addr) {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.IPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+	if ip == nil {
+		return
+	}
+	for key, value := range g.Lookup(ip) {
+		event[key] = value
+	}
+}
@@ -0,0 +1,60 @@
+// +build !integration
+
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/joshuar/pingbeat/config"
+)
+
+// The test databases map 192.0.2.0/24 and 2001:db8::/32 to NL and AS64496
+func newTestGeoIP(t *testing.T) *GeoIP {
+	geoip, err := NewGeoIP(config.GeoIPConfig{
+		CountryDB: "testdata/GeoLite2-Country-Test.mmdb",
+		ASNDB:     "testdata/GeoLite2-ASN-Test.mmdb",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return geoip
+}
+
+func TestGeoIPEnrichment(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1", "2001:db8::1", "198.51.100.1")
+	bt.geoip = newTestGeoIP(t)
+	defer bt.geoip.Close()
+
+	for _, addr := range []string{"192.0.2.1", "2001:db8::1"} {
+		bt.ProcessPing(&PingInfo{Target: addr, RTT: time.Millisecond})
+		event := client.next(t)
+		if geo, _ := event["geo"].(common.MapStr); geo["country_iso"] != "NL" {
+			t.Errorf("%s: expected country NL, got %v", addr, event["geo"])
+		}
+		as, _ := event["as"].(common.MapStr)
+		if as["number"] != uint(64496) || as["organization"] != "Example Networks" {
+			t.Errorf("%s: expected AS64496, got %v", addr, event["as"])
+		}
+	}
+
+	// Addresses not in the databases aren't enriched
+	bt.ProcessPing(&PingInfo{Target: "198.51.100.1", Loss: true, LossReason: "Timeout"})
+	if event := client.next(t); event["geo"] != nil || event["as"] != nil {
+		t.Errorf("expected no enrichment, got %v", event)
+	}
+
+	bt.config.ECS = true
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: time.Millisecond})
+	destination := client.next(t)["destination"].(common.MapStr)
+	if destination["geo"].(common.MapStr)["country_iso_code"] != "NL" || destination["as"].(common.MapStr)["number"] != uint(64496) {
+		t.Errorf("expected ECS geo and as under destination, got %v", destination)
+	}
+}
+
+func TestGeoIPInvalid(t *testing.T) {
+	if _, err := NewGeoIP(config.GeoIPConfig{CountryDB: "testdata/targets.txt"}); err == nil {
+		t.Error("expected a file that isn't a database to be rejected")
+	}
+}
@@ -0,0 +1,76 @@
+package beater
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+// GRPCInfo contains the result of a gRPC health check
+type GRPCInfo struct {
+	// Status is the serving status reported by the health service
+	Status string
+}
+
+// SendGRPCPing connects to the gRPC server at the provided address and times a
+// grpc.health.v1.Health/Check call as the RTT. With useTLS set the connection
+// is secured, verifying the certificate of serverName. The headers are sent as
+// metadata of the call. Unreachable servers and servers that aren't serving
+// are recorded as lost pings
+func SendGRPCPing(timeout time.Duration, seq int, addr net.Addr, serverName string, useTLS bool, headers map[string]string) pool.WorkFunc {
+	return func(wu pool.WorkUnit) (interface{}, error) {
+		if wu.IsCancelled() {
+			logp.Debug("SendPings", "SendGRPCPing: workunit cancelled")
+			return nil, nil
+		}
+		ping := &PingInfo{
+			Seq:      seq,
+			Target:   addr.String(),
+			Protocol: "grpc",
+		}
+		creds := insecure.NewCredentials()
+		if useTLS {
+			creds = credentials.NewTLS(&tls.Config{ServerName: serverName})
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		ping.Sent = time.Now().UTC()
+		conn, err := grpc.DialContext(ctx, addr.String(), grpc.WithTransportCredentials(creds), grpc.WithBlock())
+		if err != nil {
+			ping.Loss = true
+			ping.LossReason = err.Error()
+			return ping, nil
+		}
+		defer conn.Close()
+
+		// Only the health check is timed, not the connection setup
+		if len(headers) > 0 {
+			ctx = metadata.NewOutgoingContext(ctx, metadata.New(headers))
+		}
+		start := time.Now()
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			ping.Loss = true
+			ping.LossReason = err.Error()
+			return ping, nil
+		}
+		received := time.Now()
+		ping.RTT = received.Sub(start)
+		ping.Received = received.UTC()
+		ping.GRPC = &GRPCInfo{Status: resp.Status.String()}
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			ping.Loss = true
+			ping.LossReason = resp.Status.String()
+		}
+		return ping, nil
+	}
+}
@@ -0,0 +1,82 @@
+// +build !integration
+
+package beater
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+func runGRPCPing(t *testing.T, addr net.Addr) *PingInfo {
+	wu := pool.New().Queue(SendGRPCPing(time.Second, 1, addr, "", false, nil))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return wu.Value().(*PingInfo)
+}
+
+func TestSendGRPCPing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(l)
+	addr := l.Addr()
+
+	ping := runGRPCPing(t, addr)
+	if ping.Loss {
+		t.Fatalf("unexpected loss: %v", ping.LossReason)
+	}
+	if ping.Protocol != "grpc" || ping.RTT <= 0 || ping.GRPC.Status != "SERVING" {
+		t.Errorf("unexpected ping %+v", ping)
+	}
+
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	ping = runGRPCPing(t, addr)
+	if !ping.Loss || ping.GRPC.Status != "NOT_SERVING" {
+		t.Errorf("expected not serving loss, got %+v", ping)
+	}
+
+	server.Stop()
+	ping = runGRPCPing(t, addr)
+	if !ping.Loss || ping.GRPC != nil {
+		t.Errorf("expected unreachable loss, got %+v", ping)
+	}
+}
+
+func TestGRPCTargetEvent(t *testing.T) {
+	bt, client := newTestBeat()
+	target := &targetConfig{Name: "127.0.0.1", Protocol: "grpc", Port: 50051}
+	for _, thisTarget := range addTarget(t, target) {
+		bt.targets[addrKey(thisTarget.Addr)] = *thisTarget
+	}
+
+	bt.ProcessPing(&PingInfo{
+		Target:   "127.0.0.1:50051",
+		Protocol: "grpc",
+		RTT:      time.Millisecond,
+		GRPC:     &GRPCInfo{Status: "SERVING"},
+	})
+	event := client.next(t)
+	if event["protocol"] != "grpc" || event["target"].(common.MapStr)["port"] != 50051 {
+		t.Errorf("unexpected grpc target in %v", event)
+	}
+	if event["grpc"].(common.MapStr)["status"] != "SERVING" {
+		t.Errorf("expected grpc status in %v", event)
+	}
+
+	if _, err := addTargetErr(&targetConfig{Name: "127.0.0.1", Protocol: "grpc"}); err == nil {
+		t.Error("expected grpc target without a port to be rejected")
+	}
+}
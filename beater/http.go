@@ -0,0 +1,88 @@
+package beater
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+// HTTPInfo contains the timings and result of an HTTP probe
+type HTTPInfo struct {
+	DNS     time.Duration
+	Connect time.Duration
+	TTFB    time.Duration
+	Status  int
+}
+
+// SendHTTPPing issues a GET request for the provided URL and records the time
+// to first byte as the RTT, along with the DNS and connect timings. Failed
+// requests and non-2xx responses are recorded as lost pings. The headers are
+// sent with every request
+func SendHTTPPing(timeout time.Duration, seq int, url string, headers map[string]string) pool.WorkFunc {
+	return func(wu pool.WorkUnit) (interface{}, error) {
+		if wu.IsCancelled() {
+			logp.Debug("SendPings", "SendHTTPPing: workunit cancelled")
+			return nil, nil
+		}
+		ping := &PingInfo{
+			Seq:      seq,
+			Target:   url,
+			Protocol: "http",
+			HTTP:     &HTTPInfo{},
+		}
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		// Host can't be set as a header field
+		if host, found := headers["Host"]; found {
+			req.Host = host
+		}
+
+		var dnsStart, connectStart, firstByte time.Time
+		trace := &httptrace.ClientTrace{
+			DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+			DNSDone: func(httptrace.DNSDoneInfo) {
+				ping.HTTP.DNS = time.Since(dnsStart)
+			},
+			ConnectStart: func(string, string) { connectStart = time.Now() },
+			ConnectDone: func(string, string, error) {
+				ping.HTTP.Connect = time.Since(connectStart)
+			},
+			GotFirstResponseByte: func() { firstByte = time.Now() },
+		}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+		// Don't reuse connections so that every probe measures a full
+		// connection setup
+		client := &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{DisableKeepAlives: true},
+		}
+		start := time.Now()
+		ping.Sent = start.UTC()
+		resp, err := client.Do(req)
+		if err != nil {
+			ping.Loss = true
+			ping.LossReason = err.Error()
+			return ping, nil
+		}
+		resp.Body.Close()
+
+		ping.HTTP.Status = resp.StatusCode
+		ping.HTTP.TTFB = firstByte.Sub(start)
+		ping.RTT = ping.HTTP.TTFB
+		ping.Received = firstByte.UTC()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			ping.Loss = true
+			ping.LossReason = resp.Status
+		}
+		return ping, nil
+	}
+}
@@ -0,0 +1,124 @@
+// +build !integration
+
+package beater
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+func runHTTPPing(t *testing.T, url string) *PingInfo {
+	wu := pool.New().Queue(SendHTTPPing(time.Second, 1, url, nil))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return wu.Value().(*PingInfo)
+}
+
+func TestSendHTTPPing(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	ping := runHTTPPing(t, server.URL)
+	if ping.Loss {
+		t.Fatalf("unexpected loss: %v", ping.LossReason)
+	}
+	if ping.HTTP.Status != http.StatusOK || ping.HTTP.TTFB <= 0 || ping.RTT != ping.HTTP.TTFB {
+		t.Errorf("unexpected HTTP timings %+v", ping.HTTP)
+	}
+
+	status = http.StatusServiceUnavailable
+	ping = runHTTPPing(t, server.URL)
+	if !ping.Loss || ping.LossReason != "503 Service Unavailable" {
+		t.Errorf("expected 503 loss, got %+v", ping)
+	}
+}
+
+func TestHTTPTargetEvent(t *testing.T) {
+	bt, client := newTestBeat()
+	target := &targetConfig{Protocol: "http", URL: "http://example.com/health"}
+	for _, thisTarget := range addTarget(t, target) {
+		bt.targets[thisTarget.Addr.String()] = *thisTarget
+	}
+
+	bt.ProcessPing(&PingInfo{
+		Target:   "http://example.com/health",
+		Protocol: "http",
+		RTT:      2 * time.Millisecond,
+		HTTP:     &HTTPInfo{TTFB: 2 * time.Millisecond, Status: 200},
+	})
+	event := client.next(t)
+	if event["target"].(common.MapStr)["url"] != "http://example.com/health" {
+		t.Errorf("expected url in %v", event["target"])
+	}
+	if event["target"].(common.MapStr)["name"] != "example.com" {
+		t.Errorf("expected name to default to the URL host, got %v", event["target"])
+	}
+	httpFields := event["http"].(common.MapStr)
+	if httpFields["status"] != 200 || httpFields["ttfb_ms"] != 2.0 {
+		t.Errorf("unexpected http fields %v", httpFields)
+	}
+}
+
+func TestHTTPPingHeaders(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "pingbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	targets := addTarget(t, &targetConfig{
+		Protocol:        "http",
+		URL:             server.URL,
+		Headers:         map[string]string{"x-api-key": "abc"},
+		BearerTokenFile: tokenFile,
+	})
+	wu := pool.New().Queue(SendHTTPPing(time.Second, 1, server.URL, targets[0].Headers))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if ping := wu.Value().(*PingInfo); ping.Loss {
+		t.Fatalf("unexpected loss: %v", ping.LossReason)
+	}
+	sent := <-headers
+	if sent.Get("X-Api-Key") != "abc" || sent.Get("Authorization") != "Bearer s3cret" {
+		t.Errorf("expected configured headers sent, got %v", sent)
+	}
+}
+
+func TestHTTPTargetCredentialsInvalid(t *testing.T) {
+	for _, target := range []*targetConfig{
+		{Protocol: "http", URL: "http://example.com", Password: "secret"},
+		{Protocol: "http", URL: "http://example.com", Username: "user", BearerToken: "token"},
+		{Protocol: "http", URL: "http://example.com", BearerToken: "token", BearerTokenFile: "/dev/null"},
+		{Protocol: "http", URL: "http://example.com", Username: "user", Headers: map[string]string{"authorization": "x"}},
+		{Protocol: "http", URL: "http://example.com", PasswordFile: "/nonexistent"},
+		{Name: "192.0.2.1", Headers: map[string]string{"X-Api-Key": "abc"}},
+	} {
+		if _, err := addTargetErr(target); err == nil {
+			t.Errorf("expected %+v to be rejected", target)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package beater
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"golang.org/x/net/ipv4"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+// icmpTimestampLen is the length of an ICMP Timestamp or Timestamp Reply
+// message (RFC 792)
+const icmpTimestampLen = 20
+
+// nonStandardTime is set in timestamps that aren't milliseconds since
+// midnight UT
+const nonStandardTime = 1 << 31
+
+// TimestampInfo contains the remote clock values of an ICMP Timestamp Reply
+type TimestampInfo struct {
+	// RemoteTransmit is when the target sent the reply, in milliseconds since
+	// midnight UT by its clock
+	RemoteTransmit uint32
+	// ClockSkew is the estimated offset of the target clock from ours,
+	// only set if the target reports standard timestamps
+	ClockSkew time.Duration
+	HasSkew   bool
+}
+
+// msSinceMidnight returns the time in milliseconds since midnight UT, as
+// carried in ICMP timestamps
+func msSinceMidnight(t time.Time) uint32 {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return uint32(t.Sub(midnight) / time.Millisecond)
+}
+
+// marshalTimestamp creates an ICMP Timestamp request with the originate
+// timestamp set to sent
+func marshalTimestamp(id int, seq int, sent time.Time) []byte {
+	b := make([]byte, icmpTimestampLen)
+	b[0] = byte(ipv4.ICMPTypeTimestamp)
+	binary.BigEndian.PutUint16(b[4:], uint16(id))
+	binary.BigEndian.PutUint16(b[6:], uint16(seq))
+	binary.BigEndian.PutUint32(b[8:], msSinceMidnight(sent))
+	binary.BigEndian.PutUint16(b[2:], icmpChecksum(b))
+	return b
+}
+
+// parseTimestampReply reads an ICMP Timestamp Reply received at the given
+// time into a ping, estimating the clock skew of the target as NTP does from
+// the originate, receive and transmit timestamps
+func parseTimestampReply(b []byte, received time.Time) (*PingInfo, error) {
+	if len(b) < icmpTimestampLen {
+		return nil, fmt.Errorf("short timestamp reply: %d bytes", len(b))
+	}
+	originate := binary.BigEndian.Uint32(b[8:])
+	remoteReceive := binary.BigEndian.Uint32(b[12:])
+	remoteTransmit := binary.BigEndian.Uint32(b[16:])
+	ping := &PingInfo{
+		ID:        int(binary.BigEndian.Uint16(b[4:])),
+		Seq:       int(binary.BigEndian.Uint16(b[6:])),
+		Received:  received,
+		Timestamp: &TimestampInfo{RemoteTransmit: remoteTransmit},
+	}
+	if remoteReceive&nonStandardTime == 0 && remoteTransmit&nonStandardTime == 0 {
+		skew := (int64(remoteReceive) - int64(originate) + int64(remoteTransmit) - int64(msSinceMidnight(received))) / 2
+		ping.Timestamp.ClockSkew = time.Duration(skew) * time.Millisecond
+		ping.Timestamp.HasSkew = true
+	}
+	return ping, nil
+}
+
+// SendTimestamp sends an ICMP Timestamp request to the provided address and
+// tracks it in state until timeout. Replies are matched to it in the same way
+// as echo replies
+func SendTimestamp(conn net.PacketConn, timeout time.Duration, id int, seq int, addr net.Addr, state *PingState) pool.WorkFunc {
+	return func(wu pool.WorkUnit) (interface{}, error) {
+		if wu.IsCancelled() {
+			logp.Debug("SendPings", "SendTimestamp: workunit cancelled")
+			return nil, nil
+		}
+		ipAddr, ok := addr.(*net.IPAddr)
+		if !ok {
+			return nil, fmt.Errorf("timestamp pings need a raw socket, got address %v", addr)
+		}
+		ping := &PingInfo{
+			ID:       id,
+			Seq:      seq,
+			Target:   ipAddr.String(),
+			Protocol: "timestamp",
+		}
+		ping.Sent = time.Now().UTC()
+		state.AddPing(ping.Target, seq, ping.Sent, timeout)
+		if _, err := conn.WriteTo(marshalTimestamp(id, seq, ping.Sent), addr); err != nil {
+			return ping, err
+		}
+		return ping, nil
+	}
+}
@@ -0,0 +1,111 @@
+// +build !integration
+
+package beater
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+// timestampResponder is a mock target answering ICMP Timestamp requests with
+// a clock that is skew ahead of ours
+type timestampResponder struct {
+	net.PacketConn
+	skew    time.Duration
+	replies chan []byte
+}
+
+func (r *timestampResponder) WriteTo(b []byte, addr net.Addr) (int, error) {
+	reply := make([]byte, len(b))
+	copy(reply, b)
+	reply[0] = byte(ipv4.ICMPTypeTimestampReply)
+	remote := msSinceMidnight(time.Now().Add(r.skew))
+	binary.BigEndian.PutUint32(reply[12:], remote)
+	binary.BigEndian.PutUint32(reply[16:], remote)
+	reply[2], reply[3] = 0, 0
+	binary.BigEndian.PutUint16(reply[2:], icmpChecksum(reply))
+	r.replies <- reply
+	return len(b), nil
+}
+
+func TestMarshalTimestamp(t *testing.T) {
+	b := marshalTimestamp(0xbeef, 1234, time.Now())
+	if len(b) != icmpTimestampLen || b[0] != byte(ipv4.ICMPTypeTimestamp) {
+		t.Fatalf("expected a %d byte timestamp request, got %v", icmpTimestampLen, b)
+	}
+	if icmpChecksum(b) != 0 {
+		t.Error("timestamp request has a bad checksum")
+	}
+	if id, seq := binary.BigEndian.Uint16(b[4:]), binary.BigEndian.Uint16(b[6:]); id != 0xbeef || seq != 1234 {
+		t.Errorf("expected ID 0xbeef and seq 1234, got %#x and %v", id, seq)
+	}
+}
+
+func TestTimestampPing(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	target := bt.targets["192.0.2.1"]
+	target.Protocol = "timestamp"
+	bt.targets["192.0.2.1"] = target
+
+	responder := &timestampResponder{skew: 2 * time.Second, replies: make(chan []byte, 1)}
+	state := NewPingState()
+	wu := pool.New().Queue(SendTimestamp(responder, time.Second, 0xbeef, 7, target.Addr, state))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	ping, err := parseTimestampReply(<-responder.replies, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping.Target = "192.0.2.1"
+	bt.handlePing(0xbeef, state, ping)
+
+	event := client.next(t)
+	if event["protocol"] != "timestamp" || event["seq"] != 7 {
+		t.Errorf("expected timestamp ping 7, got %v", event)
+	}
+	if _, found := event["rtt"]; !found {
+		t.Error("timestamp reply has no rtt")
+	}
+	if _, found := event["remote_transmit_ms"]; !found {
+		t.Error("timestamp reply has no remote_transmit_ms")
+	}
+	skew, _ := event["clock_skew_ms"].(float64)
+	if math.Abs(skew-2000) > 100 {
+		t.Errorf("expected clock skew of about 2000ms, got %v", event["clock_skew_ms"])
+	}
+}
+
+func TestTimestampNonStandardTime(t *testing.T) {
+	b := marshalTimestamp(0xbeef, 1, time.Now())
+	binary.BigEndian.PutUint32(b[12:], nonStandardTime|42)
+	binary.BigEndian.PutUint32(b[16:], nonStandardTime|42)
+	ping, err := parseTimestampReply(b, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping.Timestamp.HasSkew {
+		t.Error("expected no clock skew from non-standard timestamps")
+	}
+	if _, err := parseTimestampReply(b[:12], time.Now()); err == nil {
+		t.Error("expected a short reply to be rejected")
+	}
+}
+
+func TestAddTimestampTarget(t *testing.T) {
+	if _, err := addTargetErr(&targetConfig{Name: "2001:db8::1", Protocol: "timestamp"}); err == nil {
+		t.Error("expected an IPv6 timestamp target to be rejected")
+	}
+	targets := addTarget(t, &targetConfig{Name: "192.0.2.1", Protocol: "timestamp"})
+	if _, ok := targets[0].Addr.(*net.IPAddr); !ok {
+		t.Errorf("expected a raw socket address, got %#v", targets[0].Addr)
+	}
+}
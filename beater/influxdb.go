@@ -0,0 +1,142 @@
+package beater
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/joshuar/pingbeat/config"
+)
+
+const (
+	// influxFlushInterval is how often buffered InfluxDB points are written
+	influxFlushInterval = time.Second
+	// influxWriteTimeout bounds how long a write to InfluxDB can take
+	influxWriteTimeout = 10 * time.Second
+)
+
+// influxTagEscaper escapes the characters with a special meaning in line
+// protocol tag values
+var influxTagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+// InfluxDB writes the results of processed pings to an InfluxDB server in
+// line protocol. Points are buffered and written in batches over HTTP
+type InfluxDB struct {
+	writeURL string
+	username string
+	password string
+	client   *http.Client
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	done     chan struct{}
+}
+
+// NewInfluxDB creates an InfluxDB client writing points to the configured
+// database
+func NewInfluxDB(cfg config.InfluxDBConfig) (*InfluxDB, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid url %s", cfg.URL)
+	}
+	if cfg.Database == "" {
+		return nil, fmt.Errorf("database must be set")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+	u.RawQuery = url.Values{"db": {cfg.Database}, "precision": {"ns"}}.Encode()
+	return &InfluxDB{
+		writeURL: u.String(),
+		username: cfg.Username,
+		password: cfg.Password,
+		client:   &http.Client{Timeout: influxWriteTimeout},
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Start writes the buffered points every interval until stopped
+func (i *InfluxDB) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-i.done:
+				return
+			case <-ticker.C:
+				i.Flush()
+			}
+		}
+	}()
+}
+
+// Stop writes any buffered points
+func (i *InfluxDB) Stop() {
+	close(i.done)
+	i.Flush()
+}
+
+// Observe records a point for a processed ping to the named target, with the
+// RTT in milliseconds for replies. Duplicate replies are not recorded
+func (i *InfluxDB) Observe(name string, ping *PingInfo) {
+	at := ping.Received
+	if at.IsZero() {
+		at = time.Now()
+	}
+	tags := "target=" + influxTagEscaper.Replace(name)
+	switch {
+	case ping.Loss:
+		i.add(fmt.Sprintf("pingbeat,%s loss=1 %d", tags, at.UnixNano()))
+	case !ping.Duplicate:
+		i.add(fmt.Sprintf("pingbeat,%s rtt=%.3f,loss=0 %d", tags, milliSeconds(ping.RTT), at.UnixNano()))
+	}
+}
+
+// add buffers a point
+func (i *InfluxDB) add(line string) {
+	i.mu.Lock()
+	i.buf.WriteString(line)
+	i.buf.WriteByte('\n')
+	i.mu.Unlock()
+}
+
+// Flush writes the buffered points. Points that fail to be written are
+// dropped
+func (i *InfluxDB) Flush() {
+	i.mu.Lock()
+	if i.buf.Len() == 0 {
+		i.mu.Unlock()
+		return
+	}
+	body := make([]byte, i.buf.Len())
+	copy(body, i.buf.Bytes())
+	i.buf.Reset()
+	i.mu.Unlock()
+
+	req, err := http.NewRequest("POST", i.writeURL, bytes.NewReader(body))
+	if err != nil {
+		logp.Err("Error writing points to InfluxDB: %v", err)
+		return
+	}
+	if i.username != "" {
+		req.SetBasicAuth(i.username, i.password)
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		logp.Err("Error writing points to InfluxDB: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		logp.Err("Error writing points to InfluxDB: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+}
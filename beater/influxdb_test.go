@@ -0,0 +1,81 @@
+// +build !integration
+
+package beater
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joshuar/pingbeat/config"
+)
+
+func TestInfluxDB(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	bt, _ := newTestBeat("192.0.2.1")
+	bt.targets["192.0.2.1"] = Target{Name: "core router", Protocol: "icmp"}
+	var err error
+	bt.influxdb, err = NewInfluxDB(config.InfluxDBConfig{
+		URL:      server.URL,
+		Database: "pings",
+		Username: "pingbeat",
+		Password: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := time.Unix(1500000000, 0)
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: 1500 * time.Microsecond, Received: received})
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: time.Millisecond, Received: received, Duplicate: true})
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Loss: true, LossReason: "Timeout", Received: received})
+	bt.influxdb.Stop()
+
+	var r *http.Request
+	select {
+	case r = <-requests:
+	case <-time.After(time.Second):
+		t.Fatal("no points written")
+	}
+	if r.Method != "POST" || r.URL.Path != "/write" || r.URL.Query().Get("db") != "pings" {
+		t.Errorf("unexpected write request %v %v", r.Method, r.URL)
+	}
+	if user, pass, ok := r.BasicAuth(); !ok || user != "pingbeat" || pass != "secret" {
+		t.Errorf("expected credentials pingbeat/secret, got %v/%v", user, pass)
+	}
+	lines := strings.Split(strings.TrimSpace(<-bodies), "\n")
+	expected := []string{
+		`pingbeat,target=core\ router rtt=1.500,loss=0 1500000000000000000`,
+		`pingbeat,target=core\ router loss=1 1500000000000000000`,
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, lines)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], lines[i])
+		}
+	}
+}
+
+func TestNewInfluxDB(t *testing.T) {
+	for _, cfg := range []config.InfluxDBConfig{
+		{URL: "udp://127.0.0.1:8089", Database: "pings"},
+		{URL: "http://127.0.0.1:8086"},
+	} {
+		if _, err := NewInfluxDB(cfg); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
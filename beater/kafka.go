@@ -0,0 +1,175 @@
+package beater
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/joshuar/pingbeat/config"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// kafkaFlushInterval is how often buffered events are sent to Kafka
+	kafkaFlushInterval = time.Second
+	// kafkaWriteTimeout bounds how long sending a batch to Kafka can take
+	kafkaWriteTimeout = 10 * time.Second
+	// kafkaMaxAttempts is how many times a batch is sent before its events
+	// are dropped, backing off from kafkaRetryBackoff between attempts
+	kafkaMaxAttempts  = 3
+	kafkaRetryBackoff = 100 * time.Millisecond
+)
+
+// kafkaWriter sends messages to Kafka, implemented by kafka.Writer
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Kafka produces events to a Kafka topic as JSON, alongside the configured
+// outputs. Events are buffered and sent in batches
+type Kafka struct {
+	writer      kafkaWriter
+	keyByTarget bool
+	mu          sync.Mutex
+	buf         []kafka.Message
+	// flushMU stops batches being sent concurrently, so events stay in order
+	flushMU sync.Mutex
+	done    chan struct{}
+}
+
+// NewKafka creates a producer sending events to the configured brokers and
+// topic
+func NewKafka(cfg config.KafkaConfig) (*Kafka, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, fmt.Errorf("brokers must be set")
+	}
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("topic must be set")
+	}
+	writer := &kafka.Writer{
+		Addr:  kafka.TCP(cfg.Brokers...),
+		Topic: cfg.Topic,
+		// Events are batched before being written, so don't wait for more
+		BatchTimeout: 10 * time.Millisecond,
+		// Retries are done per batch by Flush
+		MaxAttempts:  1,
+		WriteTimeout: kafkaWriteTimeout,
+		RequiredAcks: kafka.RequireOne,
+	}
+	// Events keyed by target are hashed to a partition, keeping the events
+	// of each target in order
+	if cfg.KeyByTarget {
+		writer.Balancer = &kafka.Hash{}
+	}
+	return newKafka(writer, cfg.KeyByTarget), nil
+}
+
+// newKafka creates a producer sending events through writer
+func newKafka(writer kafkaWriter, keyByTarget bool) *Kafka {
+	return &Kafka{
+		writer:      writer,
+		keyByTarget: keyByTarget,
+		done:        make(chan struct{}),
+	}
+}
+
+// Start sends the buffered events every interval until stopped
+func (k *Kafka) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-k.done:
+				return
+			case <-ticker.C:
+				k.Flush()
+			}
+		}
+	}()
+}
+
+// Stop sends any buffered events and closes the producer
+func (k *Kafka) Stop() {
+	close(k.done)
+	k.Flush()
+	if err := k.writer.Close(); err != nil {
+		logp.Err("Error closing Kafka producer: %v", err)
+	}
+}
+
+// Write buffers an event to be sent, keyed by the name of its target if set
+func (k *Kafka) Write(event common.MapStr) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	msg := kafka.Message{Value: value}
+	if k.keyByTarget {
+		if name := eventTargetName(event); name != "" {
+			msg.Key = []byte(name)
+		}
+	}
+	k.mu.Lock()
+	k.buf = append(k.buf, msg)
+	k.mu.Unlock()
+	return nil
+}
+
+// Flush sends the buffered events. A batch that fails is sent again, only
+// the events that failed if Kafka says which, and dropped after
+// kafkaMaxAttempts
+func (k *Kafka) Flush() {
+	k.flushMU.Lock()
+	defer k.flushMU.Unlock()
+	k.mu.Lock()
+	msgs := k.buf
+	k.buf = nil
+	k.mu.Unlock()
+
+	backoff := kafkaRetryBackoff
+	for attempt := 1; len(msgs) > 0; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), kafkaWriteTimeout)
+		err := k.writer.WriteMessages(ctx, msgs...)
+		cancel()
+		if err == nil {
+			return
+		}
+		if writeErrs, ok := err.(kafka.WriteErrors); ok && len(writeErrs) == len(msgs) {
+			var failed []kafka.Message
+			for i, msgErr := range writeErrs {
+				if msgErr != nil {
+					failed = append(failed, msgs[i])
+				}
+			}
+			msgs = failed
+		}
+		if attempt >= kafkaMaxAttempts {
+			logp.Err("Error sending %d events to Kafka, dropping them: %v", len(msgs), err)
+			return
+		}
+		logp.Warn("Error sending %d events to Kafka, retrying in %v: %v", len(msgs), backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// eventTargetName returns the name of the target of an event, empty if it
+// has none
+func eventTargetName(event common.MapStr) string {
+	if target, ok := event["target"].(common.MapStr); ok {
+		name, _ := target["name"].(string)
+		return name
+	}
+	// ECS events label the target instead
+	if labels, ok := event["labels"].(common.MapStr); ok {
+		name, _ := labels["target"].(string)
+		return name
+	}
+	return ""
+}
@@ -0,0 +1,99 @@
+// +build !integration
+
+package beater
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/joshuar/pingbeat/config"
+	"github.com/segmentio/kafka-go"
+)
+
+// stubKafkaWriter captures the messages written, failing the first writes
+// with the given errors
+type stubKafkaWriter struct {
+	mu     sync.Mutex
+	errs   []error
+	writes [][]kafka.Message
+	closed bool
+}
+
+func (w *stubKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, msgs)
+	if len(w.errs) > 0 {
+		err := w.errs[0]
+		w.errs = w.errs[1:]
+		return err
+	}
+	return nil
+}
+
+func (w *stubKafkaWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestKafka(t *testing.T) {
+	writer := &stubKafkaWriter{}
+	bt, client := newTestBeat("192.0.2.1")
+	bt.kafka = newKafka(writer, true)
+
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: 2 * time.Millisecond})
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Loss: true, LossReason: "Timeout"})
+	// Events are still published to the beat outputs
+	client.next(t)
+	client.next(t)
+	bt.kafka.Stop()
+
+	if !writer.closed || len(writer.writes) != 1 || len(writer.writes[0]) != 2 {
+		t.Fatalf("expected one batch of 2 events flushed on stop, got %v", writer.writes)
+	}
+	for _, msg := range writer.writes[0] {
+		var event map[string]interface{}
+		if err := json.Unmarshal(msg.Value, &event); err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Key) != "192.0.2.1" || event["target"].(map[string]interface{})["name"] != "192.0.2.1" {
+			t.Errorf("expected an event keyed by its target, got %s: %s", msg.Key, msg.Value)
+		}
+	}
+}
+
+func TestKafkaRetry(t *testing.T) {
+	event := common.MapStr{"target": common.MapStr{"name": "192.0.2.1"}}
+
+	// Only the events that failed are sent again
+	writer := &stubKafkaWriter{errs: []error{kafka.WriteErrors{nil, kafka.LeaderNotAvailable}}}
+	k := newKafka(writer, false)
+	k.Write(event)
+	k.Write(event)
+	k.Flush()
+	if len(writer.writes) != 2 || len(writer.writes[1]) != 1 || writer.writes[1][0].Key != nil {
+		t.Errorf("expected the failed event sent again without a key, got %v", writer.writes)
+	}
+
+	// Batches that keep failing are dropped
+	failure := errors.New("no brokers")
+	writer = &stubKafkaWriter{errs: []error{failure, failure, failure, failure}}
+	k = newKafka(writer, false)
+	k.Write(event)
+	k.Flush()
+	k.Flush()
+	if len(writer.writes) != kafkaMaxAttempts {
+		t.Errorf("expected %d attempts, got %d", kafkaMaxAttempts, len(writer.writes))
+	}
+
+	for _, cfg := range []config.KafkaConfig{{Topic: "pingbeat"}, {Brokers: []string{"localhost:9092"}}} {
+		if _, err := NewKafka(cfg); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
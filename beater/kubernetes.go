@@ -0,0 +1,126 @@
+package beater
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/joshuar/pingbeat/config"
+)
+
+// kubernetesTimeout bounds how long a Kubernetes API request can take
+const kubernetesTimeout = 10 * time.Second
+
+// kubernetesEndpoints is the part of a Kubernetes Endpoints object listing
+// the pods ready to serve a service
+type kubernetesEndpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP        string `json:"ip"`
+			NodeName  string `json:"nodeName"`
+			TargetRef struct {
+				Kind string `json:"kind"`
+				Name string `json:"name"`
+			} `json:"targetRef"`
+		} `json:"addresses"`
+	} `json:"subsets"`
+}
+
+// kubernetesTargets looks up the endpoints of the configured service through
+// the Kubernetes API and returns a target config for each ready pod. Pods are
+// named after the service, with the pod and node name as custom fields
+func kubernetesTargets(cfg config.KubernetesConfig) ([]*targetConfig, error) {
+	host := cfg.Host
+	if host == "" {
+		// Running in the cluster, the API server is found from the
+		// environment of the pod
+		h, p := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if h == "" || p == "" {
+			return nil, fmt.Errorf("kubernetes.host must be set when not running in a cluster")
+		}
+		host = "https://" + net.JoinHostPort(h, p)
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid kubernetes host %s", host)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + fmt.Sprintf("/api/v1/namespaces/%s/endpoints/%s", url.PathEscape(cfg.Namespace), url.PathEscape(cfg.Service))
+
+	client, err := kubernetesClient(cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Service account tokens are rotated, so the token is read every time
+	if token, err := ioutil.ReadFile(cfg.TokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("kubernetes returned %s for service %s/%s", resp.Status, cfg.Namespace, cfg.Service)
+	}
+	var endpoints kubernetesEndpoints
+	if err := json.NewDecoder(resp.Body).Decode(&endpoints); err != nil {
+		return nil, fmt.Errorf("error decoding kubernetes response: %v", err)
+	}
+
+	var configs []*targetConfig
+	for _, subset := range endpoints.Subsets {
+		for _, addr := range subset.Addresses {
+			fields := map[string]interface{}{"namespace": cfg.Namespace}
+			if addr.TargetRef.Kind == "Pod" {
+				fields["pod"] = addr.TargetRef.Name
+			}
+			if addr.NodeName != "" {
+				fields["node"] = addr.NodeName
+			}
+			configs = append(configs, &targetConfig{
+				Addr:   addr.IP,
+				Name:   cfg.Service,
+				Fields: map[string]interface{}{"kubernetes": fields},
+			})
+		}
+	}
+	logp.Debug("targets", "Found %d endpoints of %v/%v in kubernetes", len(configs), cfg.Namespace, cfg.Service)
+	return configs, nil
+}
+
+// kubernetesClient returns an HTTP client trusting the cluster CA, if the CA
+// file exists
+func kubernetesClient(caFile string) (*http.Client, error) {
+	client := &http.Client{Timeout: kubernetesTimeout}
+	ca, err := ioutil.ReadFile(caFile)
+	if os.IsNotExist(err) {
+		return client, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return client, nil
+}
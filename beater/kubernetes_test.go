@@ -0,0 +1,89 @@
+// +build !integration
+
+package beater
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joshuar/pingbeat/config"
+)
+
+func TestKubernetesTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pingbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	endpoints := `{"subsets": [{
+		"addresses": [
+			{"ip": "10.0.0.1", "nodeName": "node1", "targetRef": {"kind": "Pod", "name": "web-1"}},
+			{"ip": "10.0.0.2", "nodeName": "node2", "targetRef": {"kind": "Pod", "name": "web-2"}}
+		],
+		"notReadyAddresses": [{"ip": "10.0.0.3"}]
+	}]}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/shop/endpoints/web" || r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(w, endpoints)
+	}))
+	defer ts.Close()
+
+	bt, _ := newTestBeat()
+	bt.config.Kubernetes = config.KubernetesConfig{
+		Host:      ts.URL,
+		Namespace: "shop",
+		Service:   "web",
+		TokenFile: tokenFile,
+		CAFile:    filepath.Join(dir, "ca.crt"),
+	}
+	targets, err := bt.loadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 ready pods as targets, got %v", targets)
+	}
+	target, found := targets["10.0.0.1"]
+	if !found {
+		t.Fatalf("missing target for 10.0.0.1 in %v", targets)
+	}
+	k8s := target.fields("10.0.0.1")["kubernetes"].(map[string]interface{})
+	if target.Name != "web" || k8s["pod"] != "web-1" || k8s["node"] != "node1" || k8s["namespace"] != "shop" {
+		t.Errorf("unexpected target %+v", target)
+	}
+
+	// Requests to pods that went away are cleared
+	bt.setTargets(targets)
+	state := NewPingState()
+	state.AddPing("10.0.0.2", 1, time.Now(), 0)
+	mu.Lock()
+	endpoints = `{"subsets": [{"addresses": [{"ip": "10.0.0.1", "nodeName": "node1", "targetRef": {"kind": "Pod", "name": "web-1"}}]}]}`
+	mu.Unlock()
+	if err := bt.ReloadTargets(state); err != nil {
+		t.Fatal(err)
+	}
+	if targets := bt.getTargets(); len(targets) != 1 {
+		t.Errorf("expected only web-1 as a target, got %v", targets)
+	}
+	if state.Pending() != 0 {
+		t.Errorf("expected requests to the removed pod to be cleared, got %d pending", state.Pending())
+	}
+}
@@ -0,0 +1,76 @@
+package beater
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics exposes the results of processed pings for Prometheus to scrape
+type Metrics struct {
+	registry *prometheus.Registry
+	rtt      *prometheus.HistogramVec
+	loss     *prometheus.CounterVec
+	server   *http.Server
+	listener net.Listener
+}
+
+// NewMetrics creates the Prometheus metrics for pingbeat
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		rtt: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "pingbeat_rtt_seconds",
+			Help: "Round trip time of successful pings",
+			// 0.5ms up to ~4s
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"target"}),
+		loss: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pingbeat_loss_total",
+			Help: "Number of lost pings",
+		}, []string{"target", "reason"}),
+	}
+	m.registry.MustRegister(m.rtt, m.loss)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	m.server = &http.Server{Handler: mux}
+	return m
+}
+
+// Start listens on the given address and serves the metrics in the
+// background
+func (m *Metrics) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	m.listener = listener
+	go func() {
+		if err := m.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logp.Err("Error serving metrics: %v", err)
+		}
+	}()
+	logp.Info("Serving metrics on %v", listener.Addr())
+	return nil
+}
+
+// Stop shuts down the metrics server
+func (m *Metrics) Stop() {
+	if err := m.server.Close(); err != nil {
+		logp.Err("Error stopping metrics server: %v", err)
+	}
+}
+
+// Observe updates the metrics with a processed ping to the named target.
+// Duplicate replies are not counted
+func (m *Metrics) Observe(name string, ping *PingInfo) {
+	switch {
+	case ping.Loss:
+		m.loss.WithLabelValues(name, ping.LossReason).Inc()
+	case !ping.Duplicate:
+		m.rtt.WithLabelValues(name).Observe(ping.RTT.Seconds())
+	}
+}
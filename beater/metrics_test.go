@@ -0,0 +1,41 @@
+// +build !integration
+
+package beater
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	bt, _ := newTestBeat("192.0.2.1")
+	bt.metrics = NewMetrics()
+	if err := bt.metrics.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer bt.metrics.Stop()
+
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: 3 * time.Millisecond})
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Loss: true, LossReason: "Timeout"})
+
+	resp, err := http.Get("http://" + bt.metrics.listener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`pingbeat_rtt_seconds_count{target="192.0.2.1"} 1`,
+		`pingbeat_loss_total{reason="Timeout",target="192.0.2.1"} 1`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected %q in metrics:\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// +build linux
+
+package beater
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"golang.org/x/sys/unix"
+)
+
+// netnsDir is where named network namespaces are mounted, as by ip netns add
+const netnsDir = "/var/run/netns"
+
+// netnsPath returns the path of a network namespace given by name or path
+func netnsPath(name string) string {
+	if strings.ContainsRune(name, '/') {
+		return name
+	}
+	return filepath.Join(netnsDir, name)
+}
+
+// checkNetNS checks that the network namespace exists
+func checkNetNS(name string) error {
+	if _, err := os.Stat(netnsPath(name)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("network namespace %s doesn't exist", name)
+		}
+		return err
+	}
+	return nil
+}
+
+// inNetNS calls fn in the named network namespace. Sockets created by fn stay
+// in the namespace once back in ours. Namespaces are a property of OS
+// threads, so fn runs on a thread of its own, locked to a new goroutine
+func inNetNS(name string, fn func() error) error {
+	target, err := os.Open(netnsPath(name))
+	if err != nil {
+		return fmt.Errorf("network namespace %s: %v", name, err)
+	}
+	defer target.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		current, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			result <- err
+			return
+		}
+		defer current.Close()
+		if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			result <- fmt.Errorf("entering network namespace %s: %v", name, err)
+			return
+		}
+		err = fn()
+		// A thread that can't be restored is left locked, so it exits
+		// with the goroutine rather than being reused
+		if restoreErr := unix.Setns(int(current.Fd()), unix.CLONE_NEWNET); restoreErr != nil {
+			logp.Err("Error restoring network namespace: %v", restoreErr)
+		} else {
+			runtime.UnlockOSThread()
+		}
+		result <- err
+	}()
+	return <-result
+}
@@ -0,0 +1,57 @@
+// +build linux,!integration
+
+package beater
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+// sendToLoopback sends an echo request to 127.0.0.1 through the connection
+func sendToLoopback(t *testing.T, bt *Pingbeat) error {
+	conn, err := bt.openConn("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		t.Skipf("cannot open raw ICMP socket: %v", err)
+	}
+	defer conn.Close()
+	echo, err := NewEchoPacket(ipv4.ICMPTypeEcho, 0xbeef, defaultPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wu := pool.New().Queue(SendPing(conn, time.Second, echo, 1, 0, &net.IPAddr{IP: net.ParseIP("127.0.0.1")}, NewPingState()))
+	wu.Wait()
+	return wu.Error()
+}
+
+func TestOpenConnNetNS(t *testing.T) {
+	name := fmt.Sprintf("pingbeat-test-%d", os.Getpid())
+	if out, err := exec.Command("ip", "netns", "add", name).CombinedOutput(); err != nil {
+		t.Skipf("cannot create network namespace: %v: %s", err, out)
+	}
+	defer exec.Command("ip", "netns", "delete", name).Run()
+
+	if err := checkNetNS(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkNetNS(name + "-missing"); err == nil {
+		t.Error("expected missing network namespace to be rejected")
+	}
+
+	// Loopback is down in a new namespace, so nothing can be sent to it
+	bt, _ := newTestBeat()
+	bt.config.NetNS = name
+	if err := sendToLoopback(t, bt); err == nil {
+		t.Error("expected send from the namespace with loopback down to fail")
+	}
+	bt.config.NetNS = ""
+	if err := sendToLoopback(t, bt); err != nil {
+		t.Errorf("expected send from our namespace to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+package beater
+
+import (
+	"errors"
+)
+
+// checkNetNS is only supported on Linux
+func checkNetNS(name string) error {
+	return errors.New("netns is only supported on Linux")
+}
+
+// inNetNS is only supported on Linux
+func inNetNS(name string, fn func() error) error {
+	return errors.New("netns is only supported on Linux")
+}
@@ -0,0 +1,79 @@
+package beater
+
+import (
+	"context"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/joshuar/pingbeat/config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// otelShutdownTimeout bounds how long exporting the last metrics can take
+const otelShutdownTimeout = 5 * time.Second
+
+// OTel records the results of processed pings as OpenTelemetry metrics, which
+// are pushed to a collector over OTLP/gRPC
+type OTel struct {
+	provider *sdkmetric.MeterProvider
+	rtt      metric.Float64Histogram
+	loss     metric.Int64Counter
+}
+
+// NewOTel creates the OpenTelemetry metrics for pingbeat, exported to the
+// configured collector every interval
+func NewOTel(cfg config.OTelConfig) (*OTel, error) {
+	options := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		options = append(options, otlpmetricgrpc.WithInsecure())
+	}
+	exporter, err := otlpmetricgrpc.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+	return newOTel(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(cfg.Interval)))
+}
+
+// newOTel creates the instruments, read by the given reader
+func newOTel(reader sdkmetric.Reader) (*OTel, error) {
+	o := &OTel{
+		provider: sdkmetric.NewMeterProvider(
+			sdkmetric.WithReader(reader),
+			sdkmetric.WithResource(resource.NewWithAttributes("", attribute.String("service.name", "pingbeat"))),
+		),
+	}
+	meter := o.provider.Meter("github.com/joshuar/pingbeat")
+	var err error
+	if o.rtt, err = meter.Float64Histogram("pingbeat.rtt", metric.WithUnit("ms"), metric.WithDescription("Round trip time of successful pings")); err != nil {
+		return nil, err
+	}
+	if o.loss, err = meter.Int64Counter("pingbeat.loss", metric.WithDescription("Number of lost pings")); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Stop exports the last metrics and shuts down the meter provider
+func (o *OTel) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), otelShutdownTimeout)
+	defer cancel()
+	if err := o.provider.Shutdown(ctx); err != nil {
+		logp.Err("Error stopping OpenTelemetry exporter: %v", err)
+	}
+}
+
+// Observe records a processed ping to the named target. Duplicate replies are
+// not counted
+func (o *OTel) Observe(name string, ping *PingInfo) {
+	ctx := context.Background()
+	switch {
+	case ping.Loss:
+		o.loss.Add(ctx, 1, metric.WithAttributes(attribute.String("target", name), attribute.String("reason", ping.LossReason)))
+	case !ping.Duplicate:
+		o.rtt.Record(ctx, milliSeconds(ping.RTT), metric.WithAttributes(attribute.String("target", name)))
+	}
+}
@@ -0,0 +1,61 @@
+// +build !integration
+
+package beater
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestOTelObserve(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	o, err := newOTel(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, _ := newTestBeat("192.0.2.1")
+	bt.otel = o
+
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: 2 * time.Millisecond})
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: 4 * time.Millisecond})
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: time.Millisecond, Duplicate: true})
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Loss: true, LossReason: "Timeout"})
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(map[string]metricdata.Aggregation)
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			metrics[m.Name] = m.Data
+		}
+	}
+
+	rtt, ok := metrics["pingbeat.rtt"].(metricdata.Histogram[float64])
+	if !ok || len(rtt.DataPoints) != 1 {
+		t.Fatalf("expected an rtt histogram for one target, got %#v", metrics["pingbeat.rtt"])
+	}
+	point := rtt.DataPoints[0]
+	if point.Count != 2 || point.Sum != 6 {
+		t.Errorf("expected 2 RTTs summing to 6ms, got %d summing to %v", point.Count, point.Sum)
+	}
+	if target, _ := point.Attributes.Value(attribute.Key("target")); target.AsString() != "192.0.2.1" {
+		t.Errorf("expected target attribute, got %v", point.Attributes)
+	}
+
+	loss, ok := metrics["pingbeat.loss"].(metricdata.Sum[int64])
+	if !ok || len(loss.DataPoints) != 1 || loss.DataPoints[0].Value != 1 {
+		t.Fatalf("expected one lost ping, got %#v", metrics["pingbeat.loss"])
+	}
+	if reason, _ := loss.DataPoints[0].Attributes.Value(attribute.Key("reason")); reason.AsString() != "Timeout" {
+		t.Errorf("expected reason attribute, got %v", loss.DataPoints[0].Attributes)
+	}
+
+	o.Stop()
+}
@@ -3,10 +3,20 @@ package beater
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
 	"net"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/elastic/beats/libbeat/beat"
@@ -20,7 +30,55 @@ import (
 	"gopkg.in/go-playground/pool.v3"
 )
 
-const pingTimeout = 4 * time.Second
+const (
+	// icmpHeaderLen is the length of an ICMP echo header
+	icmpHeaderLen = 8
+	// maxPacketSize is the largest ICMP payload that fits in an IP packet
+	maxPacketSize = 65535 - 20 - icmpHeaderLen
+	// maxIPv4OptionsLen is the most options an IPv4 header can carry
+	maxIPv4OptionsLen = 40
+	// minRecvBufferSize is the smallest buffer used to read ICMP messages
+	minRecvBufferSize = 1500
+	// drainPollInterval is how often outstanding pings are checked when
+	// stopping
+	drainPollInterval = 10 * time.Millisecond
+	// recvDeadline is how long a read waits before checking if Pingbeat has
+	// stopped
+	recvDeadline = 250 * time.Millisecond
+	// cleanInterval is the longest time between sweeps for timed out
+	// requests
+	cleanInterval = 100 * time.Millisecond
+	// recvOOBSize fits the TTL/hop limit and timestamp control messages
+	recvOOBSize = 128
+	// minPeriod is the shortest period pings can be sent with
+	minPeriod = 10 * time.Millisecond
+	// maxSeqNo is the number of distinct ICMP sequence numbers
+	maxSeqNo = 65536
+	// fragmentationNeeded is the ICMPv4 Destination Unreachable code sent
+	// for packets too big to forward with the Don't Fragment bit set
+	fragmentationNeeded = 4
+	// sendRetryBackoff is how long to wait before retrying a failed send,
+	// doubling with each retry
+	sendRetryBackoff = 5 * time.Millisecond
+	// minReopenBackoff and maxReopenBackoff bound how long to wait before
+	// reopening a connection reads fail on, doubling while it keeps failing
+	minReopenBackoff = 100 * time.Millisecond
+	maxReopenBackoff = 30 * time.Second
+	// maxReadFailures is how many reads in a row can fail before the
+	// connection is reopened
+	maxReadFailures = 10
+	// processWorkers is the number of workers processing and publishing
+	// pings
+	processWorkers = 4
+	// processQueueSize is how many pings each worker can have waiting
+	processQueueSize = 1024
+)
+
+// defaultPayload is the data carried in ICMP echo requests
+var defaultPayload = []byte("pingbeat: y'know, for pings!")
+
+// defaultPeriod is used if the period is set to zero
+var defaultPeriod = config.DefaultConfig.Period
 
 // Pingbeat contains configuration details
 type Pingbeat struct {
@@ -29,19 +87,93 @@ type Pingbeat struct {
 	client      publisher.Client
 	ipv4network string
 	ipv6network string
+	ipv4addr    string
+	ipv6addr    string
+	targetsMU   sync.RWMutex
+	updateMU    sync.Mutex // serializes changes replacing the targets
 	targets     map[string]Target
+	pending     []*targetConfig
+	payload     []byte
+	location    *time.Location
+	metrics     *Metrics
+	statsd      *StatsD
+	influxdb    *InfluxDB
+	kafka       *Kafka
+	otel        *OTel
+	file        *FileOutput
+	// geoip adds the country and AS of targets to events, nil if no
+	// databases are configured
+	geoip *GeoIP
+	// batcher publishes events in batches while running, nil if events are
+	// published one at a time
+	batcher *eventBatcher
+	// limiter paces pings to the rate limit, nil if unlimited
+	limiter *rateLimiter
+	// out is where the final summary of count mode and dry run events are
+	// printed
+	out   io.Writer
+	outMU sync.Mutex
+	// drained is closed once Run has finished with outstanding pings
+	drained chan struct{}
+	// cleaning tracks the background reaping of timed out pings
+	cleaning sync.WaitGroup
+	// processing tracks pings being processed in the background
+	processing sync.WaitGroup
+	// draining is set once drain stops queueing pings for processing
+	draining   bool
+	drainingMU sync.RWMutex
+	// queues feed pings to the processing workers, started on first use
+	queues     []chan *PingInfo
+	queuesOnce sync.Once
+	// severities holds the last severity of targets whose RTT is over a
+	// threshold, for publishing transition events
+	severitiesMU sync.Mutex
+	severities   map[string]string
+	// state tracks active requests and the history of targets while
+	// running
+	state *PingState
+	// counters count pings for the stats event
+	counters probeCounters
+	// tick is how often targets are pinged, or checked for pings due if
+	// schedule is set
+	tick time.Duration
+	// schedule tracks when targets are due, nil if every target is pinged
+	// every period
+	schedule *schedule
 }
 
 // PingInfo contains details about active ping requests/replies
 type PingInfo struct {
-	ID         int
-	Seq        int
-	Target     string
-	Sent       time.Time
-	Received   time.Time
-	RTT        time.Duration
+	ID       int
+	Seq      int
+	Target   string
+	Sent     time.Time
+	Received time.Time
+	RTT      time.Duration
+	// RTTInvalid is set for replies whose RTT can't be trusted, e.g. when
+	// the clock was stepped between sending and receiving
+	RTTInvalid bool
+	Jitter     time.Duration
+	HasJitter  bool
+	Duplicate  bool
+	TTL        int
+	// Source is the local address the ping was sent from, if known
+	Source net.IP
+	// Route holds the addresses recorded by the Record Route option of the
+	// reply, if set
+	Route     []net.IP
+	Protocol  string
+	HTTP      *HTTPInfo
+	GRPC      *GRPCInfo
+	DNS       *DNSInfo
+	Timestamp *TimestampInfo
+	// MTU is the next-hop MTU advertised in a Packet Too Big error
+	MTU        int
 	Loss       bool
 	LossReason string
+	// Misses is the number of consecutive pings lost to the target,
+	// including this one
+	Misses int
 }
 
 // New creates a new Pingbeat beater struct
@@ -52,24 +184,335 @@ func New(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
 	}
 
 	bt := &Pingbeat{
-		done:   make(chan struct{}),
-		config: config,
+		done:    make(chan struct{}),
+		drained: make(chan struct{}),
+		config:  config,
+		out:     os.Stdout,
+	}
+
+	if !bt.config.UseIPv4 && !bt.config.UseIPv6 {
+		return nil, fmt.Errorf("at least one of useipv4 and useipv6 must be enabled")
+	}
+
+	// An unset period falls back to the default, anything shorter than
+	// minPeriod would just burn CPU
+	if bt.config.Period == 0 {
+		bt.config.Period = defaultPeriod
+	}
+	if bt.config.Period < minPeriod {
+		return nil, fmt.Errorf("period must be at least %v", minPeriod)
+	}
+	if bt.config.Timeout <= 0 {
+		return nil, fmt.Errorf("timeout must be positive")
+	}
+	if bt.config.MaxCIDRHosts < 1 {
+		return nil, fmt.Errorf("maxcidrhosts must be at least 1")
 	}
 
-	// Use privileged (i.e. raw socket) ping by default, else use a UDP ping
-	if bt.config.Privileged {
-		if os.Getuid() != 0 {
-			return nil, fmt.Errorf("privileged specified but not running with privileges")
+	if bt.config.PacketSize < 0 || bt.config.PacketSize > maxPacketSize {
+		return nil, fmt.Errorf("packetsize must be between 0 and %d bytes", maxPacketSize)
+	}
+	data := defaultPayload
+	if bt.config.Payload != "" {
+		if bt.config.PacketSize > 0 && len(bt.config.Payload) > bt.config.PacketSize {
+			return nil, fmt.Errorf("payload is longer than packetsize (%d bytes)", bt.config.PacketSize)
 		}
+		data = []byte(bt.config.Payload)
+	}
+	if bt.config.PayloadPattern != "" {
+		if bt.config.Payload != "" {
+			return nil, fmt.Errorf("payload and payloadpattern can't both be set")
+		}
+		pattern, err := strconv.ParseUint(bt.config.PayloadPattern, 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("payloadpattern must be a single byte, e.g. 0x00 or 0xff: %v", err)
+		}
+		data = patternPayload(byte(pattern), bt.config.PacketSize)
+	}
+	bt.payload = makePayload(data, bt.config.PacketSize)
+
+	if bt.config.StatsPeriod < 0 {
+		return nil, fmt.Errorf("statsperiod must not be negative")
+	}
+
+	if bt.config.SummaryPeriod > 0 && bt.config.SummaryWindow < 1 {
+		return nil, fmt.Errorf("summarywindow must be at least 1")
+	}
+	if bt.config.SummaryOnly && bt.config.SummaryPeriod <= 0 {
+		return nil, fmt.Errorf("summaryonly needs summaryperiod to be set")
+	}
+
+	if bt.config.TOS < 0 || bt.config.TOS > 255 {
+		return nil, fmt.Errorf("tos must be between 0 and 255")
+	}
+	if bt.config.TTL != 0 && (bt.config.TTL < 1 || bt.config.TTL > 255) {
+		return nil, fmt.Errorf("ttl must be between 1 and 255")
+	}
+
+	// Jitter must leave every ping sent before the next period starts
+	if bt.config.SendJitter < 0 || bt.config.SendJitter >= bt.config.Period {
+		return nil, fmt.Errorf("sendjitter must be between 0 and period (%v)", bt.config.Period)
+	}
+
+	if bt.config.PingsPerPeriod < 1 {
+		return nil, fmt.Errorf("pingsperperiod must be at least 1")
+	}
+
+	if bt.config.Count < 0 {
+		return nil, fmt.Errorf("count must not be negative")
+	}
+
+	if bt.config.EventType == "" {
+		return nil, fmt.Errorf("eventtype must not be empty")
+	}
+	switch bt.config.TimestampSource {
+	case "publish", "sent", "received":
+	default:
+		return nil, fmt.Errorf("timestampsource must be publish, sent or received")
+	}
+	location, err := time.LoadLocation(bt.config.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %s: %v", bt.config.Timezone, err)
+	}
+	bt.location = location
+
+	if bt.config.BatchSize < 0 {
+		return nil, fmt.Errorf("batchsize must not be negative")
+	}
+	if bt.config.BatchSize > 1 && bt.config.FlushInterval <= 0 {
+		return nil, fmt.Errorf("flushinterval must be positive when batching events")
+	}
+
+	if bt.config.RateLimit < 0 {
+		return nil, fmt.Errorf("ratelimit must not be negative")
+	}
+	if bt.config.RateLimit > 0 {
+		bt.limiter = newRateLimiter(bt.config.RateLimit)
+	}
+
+	if bt.config.SendRetries < 0 {
+		return nil, fmt.Errorf("sendretries must not be negative")
+	}
+
+	if bt.config.Workers < 0 {
+		return nil, fmt.Errorf("workers must not be negative")
+	}
+	if bt.config.MaxWorkers < 1 {
+		return nil, fmt.Errorf("maxworkers must be at least 1")
+	}
+
+	if bt.config.LossThreshold < 1 {
+		return nil, fmt.Errorf("lossthreshold must be at least 1")
+	}
+	if bt.config.DownAfter < 0 {
+		return nil, fmt.Errorf("downafter must not be negative")
+	}
+	if bt.config.StateOnly && bt.config.DownAfter == 0 {
+		return nil, fmt.Errorf("stateonly needs downafter to be set")
+	}
+	if bt.config.FlapWindow < 0 || bt.config.FlapThreshold < 0 {
+		return nil, fmt.Errorf("flapwindow and flapthreshold must not be negative")
+	}
+	if (bt.config.FlapWindow > 0) != (bt.config.FlapThreshold > 0) {
+		return nil, fmt.Errorf("flapwindow and flapthreshold must be set together")
+	}
+	if bt.config.FlapThreshold > 0 && bt.config.DownAfter == 0 {
+		return nil, fmt.Errorf("flapthreshold needs downafter to be set")
+	}
+
+	if bt.config.RTTWarn < 0 || bt.config.RTTCrit < 0 {
+		return nil, fmt.Errorf("rttwarn and rttcrit must not be negative")
+	}
+	if bt.config.RTTWarn > 0 && bt.config.RTTCrit > 0 && bt.config.RTTCrit < bt.config.RTTWarn {
+		return nil, fmt.Errorf("rttcrit must not be less than rttwarn")
+	}
+	if bt.config.BaselineFactor != 0 && bt.config.BaselineFactor <= 1 {
+		return nil, fmt.Errorf("baselinefactor must be greater than 1")
+	}
+	for i, bound := range bt.config.RTTBuckets {
+		if bound <= 0 || (i > 0 && bound <= bt.config.RTTBuckets[i-1]) {
+			return nil, fmt.Errorf("rttbuckets must be positive and increasing")
+		}
+	}
+
+	if bt.config.ICMPID < 0 || bt.config.ICMPID > 0xffff {
+		return nil, fmt.Errorf("icmpid must be between 0 and 65535")
+	}
+
+	if bt.config.MetricsAddr != "" {
+		bt.metrics = NewMetrics()
+	}
+
+	if bt.config.StatsD.Addr != "" {
+		var err error
+		if bt.statsd, err = NewStatsD(bt.config.StatsD.Addr, bt.config.StatsD.Prefix); err != nil {
+			return nil, fmt.Errorf("error creating statsd client: %v", err)
+		}
+	}
+
+	if bt.config.InfluxDB.URL != "" {
+		var err error
+		if bt.influxdb, err = NewInfluxDB(bt.config.InfluxDB); err != nil {
+			return nil, fmt.Errorf("error creating influxdb client: %v", err)
+		}
+	}
+
+	if len(bt.config.Kafka.Brokers) > 0 || bt.config.Kafka.Topic != "" {
+		var err error
+		if bt.kafka, err = NewKafka(bt.config.Kafka); err != nil {
+			return nil, fmt.Errorf("error creating kafka producer: %v", err)
+		}
+	}
+
+	if bt.config.GeoIP.CountryDB != "" || bt.config.GeoIP.ASNDB != "" {
+		var err error
+		if bt.geoip, err = NewGeoIP(bt.config.GeoIP); err != nil {
+			return nil, fmt.Errorf("error opening geoip database: %v", err)
+		}
+	}
+
+	if bt.config.OTel.Endpoint != "" {
+		if bt.config.OTel.Interval <= 0 {
+			return nil, fmt.Errorf("otel.interval must be positive")
+		}
+		var err error
+		if bt.otel, err = NewOTel(bt.config.OTel); err != nil {
+			return nil, fmt.Errorf("error creating otel exporter: %v", err)
+		}
+	}
+
+	if bt.config.FileOutput.Path != "" {
+		var err error
+		if bt.file, err = NewFileOutput(bt.config.FileOutput); err != nil {
+			return nil, fmt.Errorf("error opening fileoutput: %v", err)
+		}
+	}
+
+	// Use privileged (i.e. raw socket) ping by default, else use a UDP ping.
+	// Root is only needed for the families enabled
+	privileged := bt.privileges()
+	if (bt.config.UseIPv4 && privileged.ipv4 || bt.config.UseIPv6 && privileged.ipv6) && os.Getuid() != 0 {
+		return nil, fmt.Errorf("privileged specified but not running with privileges")
+	}
+	bt.ipv4network, bt.ipv6network = "udp4", "udp6"
+	if privileged.ipv4 {
 		bt.ipv4network = "ip4:icmp"
+	}
+	if privileged.ipv6 {
 		bt.ipv6network = "ip6:ipv6-icmp"
-	} else {
-		bt.ipv4network = "udp4"
-		bt.ipv6network = "udp6"
+	}
+
+	// Options can only be set on raw IPv4 sockets
+	if bt.config.RecordRoute && (!bt.config.UseIPv4 || !privileged.ipv4) {
+		return nil, fmt.Errorf("recordroute needs privileged mode and IPv4")
+	}
+
+	if bt.config.Traceroute.Period > 0 {
+		// Time Exceeded errors aren't delivered to unprivileged ping sockets
+		if bt.config.UseIPv4 && !privileged.ipv4 || bt.config.UseIPv6 && !privileged.ipv6 {
+			return nil, fmt.Errorf("traceroute needs privileged mode")
+		}
+		if bt.config.Traceroute.MaxHops < 1 || bt.config.Traceroute.MaxHops > 255 {
+			return nil, fmt.Errorf("traceroute.maxhops must be between 1 and 255")
+		}
+	}
+
+	// Listen on all addresses unless bound to a specific interface
+	bt.ipv4addr = "0.0.0.0"
+	bt.ipv6addr = "::"
+	if bt.config.NetNS != "" {
+		if err := checkNetNS(bt.config.NetNS); err != nil {
+			return nil, err
+		}
+	}
+
+	if bt.config.Interface != "" {
+		var err error
+		if bt.config.UseIPv4 {
+			if bt.ipv4addr, err = interfaceAddr(bt.config.Interface, false); err != nil {
+				return nil, err
+			}
+		}
+		if bt.config.UseIPv6 {
+			if bt.ipv6addr, err = interfaceAddr(bt.config.Interface, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// A configured source address takes precedence over the interface
+	if bt.config.SourceIPv4 != "" {
+		ip := net.ParseIP(bt.config.SourceIPv4)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("sourceipv4 %s is not an IPv4 address", bt.config.SourceIPv4)
+		}
+		if !bt.config.UseIPv4 {
+			return nil, fmt.Errorf("sourceipv4 specified but IPv4 is disabled")
+		}
+		bt.ipv4addr = ip.String()
+	}
+	if bt.config.SourceIPv6 != "" {
+		ip := net.ParseIP(bt.config.SourceIPv6)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("sourceipv6 %s is not an IPv6 address", bt.config.SourceIPv6)
+		}
+		if !bt.config.UseIPv6 {
+			return nil, fmt.Errorf("sourceipv6 specified but IPv6 is disabled")
+		}
+		bt.ipv6addr = ip.String()
+	}
+
+	if bt.config.Consul.Service != "" && bt.config.Consul.Refresh <= 0 {
+		return nil, fmt.Errorf("consul.refresh must be positive")
+	}
+	if bt.config.Kubernetes.Service != "" && bt.config.Kubernetes.Refresh <= 0 {
+		return nil, fmt.Errorf("kubernetes.refresh must be positive")
+	}
+
+	// Hostname targets are looked up with the configured resolver, both
+	// here and when they are resolved again
+	if bt.config.Resolver != "" {
+		addr, err := resolverAddr(bt.config.Resolver)
+		if err != nil {
+			return nil, err
+		}
+		lookupIP = resolverLookup(addr)
 	}
 
 	// Fill the IPv4/IPv6 targets maps
-	bt.targets = NewTargets(bt.config.Targets, bt.config.Privileged, bt.config.UseIPv4, bt.config.UseIPv6)
+	targets, err := bt.loadTargets()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading targets: %v", err)
+	}
+	bt.setTargets(targets)
+	// Targets with their own interval are checked every tick for pings due
+	var intervals []time.Duration
+	for _, target := range targets {
+		if target.Interval > 0 {
+			intervals = append(intervals, target.Interval)
+		}
+	}
+	bt.tick = bt.config.Period
+	if len(intervals) > 0 {
+		if bt.config.Count > 0 {
+			return nil, fmt.Errorf("count can't be used with per-target intervals")
+		}
+		bt.tick = scheduleTick(bt.config.Period, intervals)
+		bt.schedule = newSchedule()
+	}
+	if bt.config.DryRun {
+		for addr, target := range targets {
+			logp.Info("Dry run: pinging %v (%v) with %v", target.Name, addr, target.Protocol)
+		}
+	}
+
+	// Sequence numbers are shared by all targets, so they mustn't wrap while
+	// a ping with the same number could still be outstanding
+	_, longest := bt.timeouts()
+	periods := int(math.Ceil(float64(longest)/float64(bt.tick))) + 1
+	if len(targets)*bt.config.PingsPerPeriod*periods > maxSeqNo {
+		return nil, fmt.Errorf("pingsperperiod of %d is too high for %d targets with a timeout of %v", bt.config.PingsPerPeriod, len(targets), longest)
+	}
 	return bt, nil
 }
 
@@ -80,65 +523,184 @@ func (bt *Pingbeat) Run(b *beat.Beat) error {
 
 	bt.client = b.Publisher.Connect()
 
+	// Batched events are published before Stop closes the client, once the
+	// connections are closed and nothing is left to add
+	if bt.config.BatchSize > 1 && !bt.config.DryRun {
+		bt.batcher = newEventBatcher(bt.client, bt.config.BatchSize)
+		bt.batcher.Start(bt.config.FlushInterval)
+		defer bt.batcher.Stop()
+	}
+
+	// Connections are closed once receivers have been told Run is done with
+	// them
+	var ipv4sock, ipv6sock *socket
+	defer func() {
+		if ipv4sock != nil {
+			ipv4sock.Close()
+		}
+		if ipv6sock != nil {
+			ipv6sock.Close()
+		}
+	}()
+	defer close(bt.drained)
+
+	// Serve metrics for Prometheus if configured
+	if bt.metrics != nil {
+		if err := bt.metrics.Start(bt.config.MetricsAddr); err != nil {
+			logp.Err("Error starting metrics server on %v: %v", bt.config.MetricsAddr, err)
+			return err
+		}
+	}
+	if bt.statsd != nil {
+		bt.statsd.Start(statsdFlushInterval)
+	}
+	if bt.influxdb != nil {
+		bt.influxdb.Start(influxFlushInterval)
+	}
+	if bt.kafka != nil {
+		bt.kafka.Start(kafkaFlushInterval)
+	}
+
 	// Set up send/receive pools
-	spool := pool.NewLimited(uint(len(bt.targets)) * uint(pingTimeout.Seconds()))
+	spool := pool.NewLimited(bt.poolSize())
 	defer spool.Close()
 
-	// Set up a ticker to loop for the period specified
-	ticker := time.NewTicker(bt.config.Period)
+	// Set up a ticker to loop for the period specified, or more often for
+	// targets with a shorter interval
+	ticker := time.NewTicker(bt.tick)
 	defer ticker.Stop()
-	timeout := time.NewTicker(pingTimeout)
+	// Clean up timed out requests as often as the shortest timeout of any
+	// target, and at least every cleanInterval for targets added later with
+	// shorter timeouts
+	shortest, _ := bt.timeouts()
+	if shortest > cleanInterval {
+		shortest = cleanInterval
+	}
+	timeout := time.NewTicker(shortest)
 	defer timeout.Stop()
 
 	// Create a new global state to track active ping requests
 	state := NewPingState()
+	state.Timeout = bt.config.Timeout
+	bt.state = state
+	if bt.config.SummaryPeriod > 0 {
+		state.WindowSize = bt.config.SummaryWindow
+		go bt.publishSummaries(state)
+	}
+	if bt.config.StatsPeriod > 0 {
+		go bt.publishStats()
+	}
+	// Serve the API for changing targets if configured
+	if bt.config.APIAddr != "" {
+		api := NewAPI(bt, state)
+		if err := api.Start(bt.config.APIAddr); err != nil {
+			logp.Err("Error starting API server on %v: %v", bt.config.APIAddr, err)
+			return err
+		}
+		defer api.Stop()
+	}
+	// The final summary of count mode covers every ping
+	if n := bt.config.Count * bt.config.PingsPerPeriod; n > state.WindowSize {
+		state.WindowSize = n
+	}
 
 	// Start receivers to capture incoming ping replies
 	// Create required connections
-	var ipv4conn, ipv6conn *icmp.PacketConn
+	var ipv4echo, ipv6echo *EchoPacket
 	var err error
-	var pingID = os.Getpid() & 0xffff
+	// Identify our requests by the PID unless an ID was configured
+	var pingID = bt.config.ICMPID
+	if pingID == 0 {
+		pingID = os.Getpid() & 0xffff
+	}
 	logp.Debug("pingbeat", "pingID: %v", pingID)
 	if bt.config.UseIPv4 {
-		if ipv4conn, err = createConn(bt.ipv4network, "0.0.0.0"); err != nil {
+		if ipv4sock, err = newSocket(func() (*icmp.PacketConn, error) { return bt.openConn(bt.ipv4network, bt.ipv4addr) }); err != nil {
 			logp.Err("Error creating %s connection: %v", bt.ipv4network, err)
 			return nil
 		}
 		logp.Info("Using %s connection", bt.ipv4network)
-		go RecvPings(pingID, bt, state, ipv4conn)
+		if ipv4echo, err = NewEchoPacket(ipv4.ICMPTypeEcho, pingID, bt.payload); err != nil {
+			logp.Err("Error creating echo request: %v", err)
+			return err
+		}
+		go RecvPings(pingID, bt, state, ipv4sock)
 	}
 	if bt.config.UseIPv6 {
-		if ipv6conn, err = createConn(bt.ipv6network, "::"); err != nil {
+		if ipv6sock, err = newSocket(func() (*icmp.PacketConn, error) { return bt.openConn(bt.ipv6network, bt.ipv6addr) }); err != nil {
 			logp.Err("Error creating %s connection: %v", bt.ipv6network, err)
 			return nil
 		}
 		logp.Info("Using %s connection", bt.ipv6network)
-		go RecvPings(pingID, bt, state, ipv6conn)
+		if ipv6echo, err = NewEchoPacket(ipv6.ICMPTypeEchoRequest, pingID, bt.payload); err != nil {
+			logp.Err("Error creating echo request: %v", err)
+			return err
+		}
+		go RecvPings(pingID, bt, state, ipv6sock)
 	}
 
+	// Reload targets on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+	go bt.reloadTargets(reload, state)
+
+	// Trace the route to targets in the background, until Run returns
+	if bt.config.Traceroute.Period > 0 {
+		stopTracing := make(chan struct{})
+		var tracing sync.WaitGroup
+		tracing.Add(1)
+		go func() {
+			defer tracing.Done()
+			bt.traceroutes(pingID, stopTracing)
+		}()
+		defer func() {
+			close(stopTracing)
+			tracing.Wait()
+		}()
+	}
+
+	// Keep hostname targets up to date with DNS changes, which also retries
+	// targets that failed to resolve. Otherwise only those are retried
+	if bt.config.ResolveTTL > 0 {
+		go bt.resolveTargets(bt.config.ResolveTTL, bt.ResolveTargets)
+	} else {
+		go bt.resolveTargets(pendingRetryInterval, bt.ResolvePending)
+	}
+	// Follow instances of the service joining and leaving Consul
+	if bt.config.Consul.Service != "" {
+		go bt.refreshTargets(bt.config.Consul.Refresh, "consul", state)
+	}
+	// Follow pods backing the Kubernetes service
+	if bt.config.Kubernetes.Service != "" {
+		go bt.refreshTargets(bt.config.Kubernetes.Refresh, "kubernetes", state)
+	}
+
+	var rounds int
 	for {
 		select {
 		case <-bt.done:
+			// Stop sending but keep receiving until outstanding pings are
+			// answered or time out
+			bt.drain(state)
 			return nil
 		case <-timeout.C:
 			// Timeout reached, clean up any pending ping requests where there
-			// has been no response
-			go state.CleanPings(pingTimeout)
+			// has been no response and report them as lost
+			bt.cleaning.Add(1)
+			go func() {
+				defer bt.cleaning.Done()
+				for _, ping := range state.CleanPings(bt.config.Timeout) {
+					bt.processPing(ping)
+				}
+			}()
 		case <-ticker.C:
 			// Batch queue echo request
 			sendBatch := spool.Batch()
-			go func(*icmp.PacketConn, *icmp.PacketConn) {
-				for ip, target := range bt.targets {
-					if net.ParseIP(ip).To4() != nil {
-						sendBatch.Queue(SendPing(ipv4conn, pingTimeout, state.GetSeqNo(), target.Addr))
-					} else {
-						sendBatch.Queue(SendPing(ipv6conn, pingTimeout, state.GetSeqNo(), target.Addr))
-					}
-				}
-				sendBatch.QueueComplete()
-			}(ipv4conn, ipv6conn)
+			go bt.queuePings(sendBatch, state, bt.pingFunc(state, pingID, ipv4sock, ipv4echo, ipv6sock, ipv6echo))
 
-			// For each successfully sent echo request
+			// Connection based pings are complete once sent, echo requests
+			// are tracked in state by SendPing unless they couldn't be sent
 			for result := range sendBatch.Results() {
 				// Grab info of the sent request
 				if result.Value() == nil {
@@ -148,141 +710,566 @@ func (bt *Pingbeat) Run(b *beat.Beat) error {
 				info := result.Value().(*PingInfo)
 				if err := result.Error(); err != nil {
 					logp.Debug("pingbeat", "Send unsuccessful: %v", err)
+				} else {
+					bt.counters.addSent()
 				}
-				success := state.AddPing(info.Target, info.Seq, info.Sent)
-				if !success {
-					logp.Err("Error adding ping (%v:%v) to state", info.Seq, info.Target)
+				if info.Loss || (info.Protocol != "icmp" && info.Protocol != "timestamp") {
+					info.Misses = state.AddResult(info.Target, info.RTT, info.Loss)
+					if !info.Loss {
+						info.Jitter, info.HasJitter = state.CalcJitter(info.Target, info.RTT)
+					}
+					bt.processPing(info)
 				}
 			}
+
+			// Finish once count rounds of pings have been sent
+			rounds++
+			if bt.config.Count > 0 && rounds >= bt.config.Count {
+				bt.drain(state)
+				return bt.finishCount(state)
+			}
 		}
 	}
 }
 
-// Stop cleans up Pingbeat
+// Stop cleans up Pingbeat once Run has drained any outstanding pings
 func (bt *Pingbeat) Stop() {
-	bt.client.Close()
 	close(bt.done)
+	<-bt.drained
+	if bt.metrics != nil {
+		bt.metrics.Stop()
+	}
+	if bt.statsd != nil {
+		bt.statsd.Stop()
+	}
+	if bt.influxdb != nil {
+		bt.influxdb.Stop()
+	}
+	if bt.kafka != nil {
+		bt.kafka.Stop()
+	}
+	if bt.otel != nil {
+		bt.otel.Stop()
+	}
+	if bt.file != nil {
+		if err := bt.file.Close(); err != nil {
+			logp.Err("Error closing %v: %v", bt.config.FileOutput.Path, err)
+		}
+	}
+	if bt.geoip != nil {
+		bt.geoip.Close()
+	}
+	bt.client.Close()
 }
 
-// RecvPings listens for ICMP messages, decodes them into the right type and
-// checks if they were sent by this Pingbeat, before processing them
-func RecvPings(myID int, bt *Pingbeat, state *PingState, conn *icmp.PacketConn) {
-	for {
-		// Based on the connection, work out whether we are dealing with
-		// IPv4 or IPv6 ICMP messages
-		var pingType icmp.Type
-		switch {
-		case conn.IPv4PacketConn() != nil:
-			pingType = ipv4.ICMPTypeEcho
-		case conn.IPv4PacketConn() != nil:
-			pingType = ipv6.ICMPTypeEchoRequest
-		default:
-			err := errors.New("Unknown connection type")
-			logp.Err("Error parsing connection: %v", err)
-			break
+// pingFunc returns the function creating the ping of a target for queuePings.
+// Echo and timestamp requests are sent over the connection of the address
+// family of the target, targets of a family without a connection are skipped.
+// A connection found dead when sending is failed, for the receiver to reopen
+func (bt *Pingbeat) pingFunc(state *PingState, pingID int, ipv4sock *socket, ipv4echo *EchoPacket, ipv6sock *socket, ipv6echo *EchoPacket) func(ip string, target Target) pool.WorkFunc {
+	return func(ip string, target Target) pool.WorkFunc {
+		switch target.Protocol {
+		case "tcp":
+			return SendTCPPing(bt.timeout(target), state.GetSeqNo(), target.Addr)
+		case "udp":
+			return SendUDPPing(bt.timeout(target), state.GetSeqNo(), target.Addr, bt.payload)
+		case "http":
+			return SendHTTPPing(bt.timeout(target), state.GetSeqNo(), target.URL, target.Headers)
+		case "dns":
+			return SendDNSPing(bt.timeout(target), state.GetSeqNo(), target.Addr, target.Query, target.QueryType)
+		case "grpc":
+			return SendGRPCPing(bt.timeout(target), state.GetSeqNo(), target.Addr, target.Host, target.TLS, target.Headers)
+		}
+		sock, echo := ipv4sock, ipv4echo
+		if target.IPv6 {
+			sock, echo = ipv6sock, ipv6echo
+		}
+		if sock == nil {
+			logp.Warn("No connection for the address family of %v (%v), not pinging it", target.Name, ip)
+			return nil
+		}
+		conn := sock.Conn()
+		var send pool.WorkFunc
+		if target.Protocol == "timestamp" {
+			send = SendTimestamp(conn, bt.timeout(target), pingID, state.GetSeqNo(), target.Addr, state)
+		} else {
+			send = SendPing(conn, bt.timeout(target), echo, state.GetSeqNo(), bt.config.SendRetries, target.Addr, state)
+		}
+		return func(wu pool.WorkUnit) (interface{}, error) {
+			ping, err := send(wu)
+			if err != nil && deadConn(err) {
+				logp.Warn("Connection for %v is dead, reopening it: %v", ip, err)
+				sock.fail(conn)
+			}
+			return ping, err
+		}
+	}
+}
+
+// queuePings queues pingsperperiod pings created by ping for each target on
+// the batch, skipping targets ping returns nil for. When targets have their
+// own interval, only those due are pinged. Targets with maxinflight
+// set only get as many pings as keep their outstanding requests in state
+// within it. With sendjitter set, each ping is queued at a random offset
+// within the jitter window rather than all at once, to avoid bursts of
+// traffic. With ratelimit set, pings are also queued no faster than the limit.
+// Targets are queued in order of priority, highest first, so they are sent
+// first when the workers are busy. Targets of the same priority are queued in
+// order of address, or with sendjitter set, priority only orders pings with
+// the same offset
+func (bt *Pingbeat) queuePings(batch pool.Batch, state *PingState, ping func(ip string, target Target) pool.WorkFunc) {
+	type send struct {
+		ip     string
+		target Target
+		offset time.Duration
+	}
+	var sends []send
+	targets := bt.getTargets()
+	now := time.Now()
+	if bt.schedule != nil {
+		bt.schedule.retain(targets)
+	}
+	for ip, target := range targets {
+		if bt.schedule != nil && !bt.schedule.due(ip, bt.interval(target), bt.tick, now) {
+			continue
+		}
+		var offset time.Duration
+		if bt.config.SendJitter > 0 {
+			offset = time.Duration(rand.Int63n(int64(bt.config.SendJitter)))
+		}
+		sends = append(sends, send{ip, target, offset})
+	}
+	sort.Slice(sends, func(i, j int) bool {
+		if sends[i].offset != sends[j].offset {
+			return sends[i].offset < sends[j].offset
+		}
+		if sends[i].target.Priority != sends[j].target.Priority {
+			return sends[i].target.Priority > sends[j].target.Priority
+		}
+		return sends[i].ip < sends[j].ip
+	})
+
+	start := time.Now()
+	for _, s := range sends {
+		if wait := s.offset - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+		n := state.Room(s.ip, s.target.MaxInFlight, bt.config.PingsPerPeriod)
+		if n < bt.config.PingsPerPeriod {
+			logp.Debug("pingbeat", "Only sending %d pings to %v, at most %d may be in flight", n, s.ip, s.target.MaxInFlight)
+		}
+		for i := 0; i < n; i++ {
+			if bt.limiter != nil {
+				bt.limiter.wait()
+			}
+			if work := ping(s.ip, s.target); work != nil {
+				batch.Queue(work)
+			}
+		}
+	}
+	batch.QueueComplete()
+}
+
+// eventTime returns the @timestamp of the event of a ping, taken from the
+// configured source. Lost pings have no receive time and use the send time
+// instead, and pings without either use the time they are published
+func (bt *Pingbeat) eventTime(ping *PingInfo) time.Time {
+	sent := ping.Sent
+	// The send time of replies is only known from their RTT
+	if sent.IsZero() && !ping.Received.IsZero() && !ping.RTTInvalid {
+		sent = ping.Received.Add(-ping.RTT)
+	}
+	switch bt.config.TimestampSource {
+	case "received":
+		if !ping.Loss && !ping.Received.IsZero() {
+			return ping.Received
+		}
+		fallthrough
+	case "sent":
+		if !sent.IsZero() {
+			return sent
+		}
+	}
+	return time.Now().UTC()
+}
+
+// privileges holds whether each address family is pinged over raw sockets,
+// rather than unprivileged ICMP datagram sockets
+type privileges struct {
+	ipv4 bool
+	ipv6 bool
+}
+
+// of returns whether the family of an address is pinged over raw sockets
+func (p privileges) of(ip net.IP) bool {
+	if ip.To4() != nil {
+		return p.ipv4
+	}
+	return p.ipv6
+}
+
+// privileges returns which address families are pinged over raw sockets,
+// privileged unless overridden for the family
+func (bt *Pingbeat) privileges() privileges {
+	p := privileges{ipv4: bt.config.Privileged, ipv6: bt.config.Privileged}
+	if bt.config.PrivilegedIPv4 != nil {
+		p.ipv4 = *bt.config.PrivilegedIPv4
+	}
+	if bt.config.PrivilegedIPv6 != nil {
+		p.ipv6 = *bt.config.PrivilegedIPv6
+	}
+	return p
+}
+
+// interval returns how often a target is pinged
+func (bt *Pingbeat) interval(target Target) time.Duration {
+	if target.Interval > 0 {
+		return target.Interval
+	}
+	return bt.config.Period
+}
+
+// timeout returns how long pings to the target wait for a reply
+func (bt *Pingbeat) timeout(target Target) time.Duration {
+	if target.Timeout > 0 {
+		return target.Timeout
+	}
+	return bt.config.Timeout
+}
+
+// timeouts returns the shortest and longest timeout of any target
+func (bt *Pingbeat) timeouts() (shortest time.Duration, longest time.Duration) {
+	shortest, longest = bt.config.Timeout, bt.config.Timeout
+	for _, target := range bt.getTargets() {
+		if t := bt.timeout(target); t < shortest {
+			shortest = t
+		} else if t > longest {
+			longest = t
 		}
+	}
+	return shortest, longest
+}
+
+// poolSize returns the number of workers used to send pings. Unless
+// configured, there is a worker for each ping that can be outstanding per
+// target within a timeout:
+//
+//	targets * pingsperperiod * ceil(longest timeout in seconds)
+//
+// but at least one and at most maxworkers. The size is worked out in floating
+// point so huge target counts can't overflow
+func (bt *Pingbeat) poolSize() uint {
+	if bt.config.Workers > 0 {
+		return uint(bt.config.Workers)
+	}
+	_, longest := bt.timeouts()
+	size := float64(len(bt.getTargets())) * float64(bt.config.PingsPerPeriod) * math.Ceil(longest.Seconds())
+	switch {
+	case size < 1:
+		return 1
+	case size > float64(bt.config.MaxWorkers):
+		return uint(bt.config.MaxWorkers)
+	}
+	return uint(size)
+}
+
+// drain waits up to the longest timeout for replies to outstanding requests,
+// reports any still outstanding as lost and then waits for all pings to be
+// processed. No more pings are queued once it starts waiting, replies still
+// arriving are dropped
+func (bt *Pingbeat) drain(state *PingState) {
+	logp.Info("Waiting for %v outstanding pings", state.Pending())
+	_, longest := bt.timeouts()
+	deadline := time.Now().Add(longest)
+	for state.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	bt.cleaning.Wait()
+	for _, ping := range state.CleanPings(0) {
+		bt.processPing(ping)
+	}
+	bt.drainingMU.Lock()
+	bt.draining = true
+	bt.drainingMU.Unlock()
+	bt.processing.Wait()
+}
+
+// RecvPings listens for ICMP messages, decodes them into the right type and
+// checks if they were sent by this Pingbeat, before processing them. The
+// connection is reopened when it dies or reads on it keep failing
+func RecvPings(myID int, bt *Pingbeat, state *PingState, sock *socket) {
+	// Based on the connection, work out whether we are dealing with
+	// IPv4 or IPv6 ICMP messages
+	var pingType icmp.Type
+	switch conn := sock.Conn(); {
+	case conn.IPv4PacketConn() != nil:
+		pingType = ipv4.ICMPTypeEcho
+	case conn.IPv6PacketConn() != nil:
+		pingType = ipv6.ICMPTypeEchoRequest
+	default:
+		err := errors.New("Unknown connection type")
+		logp.Err("Error parsing connection, not receiving pings: %v", err)
+		return
+	}
 
+	var failures int
+	backoff := minReopenBackoff
+	for {
 		// Read data from the connection
-		bd := make([]byte, 1500)
-		n, peer, err := conn.ReadFrom(bd)
+		bd := make([]byte, bt.recvBufferSize())
+		conn := sock.Conn()
+		conn.SetReadDeadline(time.Now().Add(recvDeadline))
+		n, ttl, received, local, peer, route, err := readFrom(conn, bd)
 		if err != nil {
-			logp.Err("Couldn't read from connection: %v", err)
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				// Replies are still received while draining, only stop
+				// once drained
+				select {
+				case <-bt.drained:
+					return
+				default:
+				}
+				continue
+			}
+			// The connection is closed once drained
+			select {
+			case <-bt.drained:
+				return
+			default:
+			}
+			// A dead connection, or one reads keep failing on, won't
+			// recover, e.g. after the interface flapped, so it is reopened.
+			// Backing off stops a connection that can't be reopened from
+			// spinning
+			if failures++; !deadConn(err) && failures < maxReadFailures {
+				logp.Err("Couldn't read from connection: %v", err)
+				continue
+			}
+			logp.Err("Couldn't read from connection, reopening it in %v: %v", backoff, err)
+			select {
+			case <-bt.drained:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxReopenBackoff {
+				backoff = maxReopenBackoff
+			}
+			if err := sock.reopen(conn); err != nil {
+				logp.Err("Couldn't reopen connection: %v", err)
+			}
+			failures = 0
 			continue
 		}
-		var target string
-		switch peer.(type) {
-		case *net.UDPAddr:
-			target, _, _ = net.SplitHostPort(peer.String())
-		case *net.IPAddr:
-			target = peer.String()
-		default:
-			logp.Err("Error parsing received address %v", target)
+		failures, backoff = 0, minReopenBackoff
+		target, err := peerTarget(peer)
+		if err != nil {
+			logp.Err("Error parsing received address %v: %v", peer, err)
 			continue
 		}
 
 		if n == 0 {
 			continue
 		}
-		// Parse the data into an ICMP message
-		message, err := icmp.ParseMessage(pingType.Protocol(), bd[:n])
+		ping, err := parsePing(pingType, bd[:n], target, ttl, received)
 		if err != nil {
 			logp.Err("Couldn't parse response: %v", err)
 			continue
 		}
+		if ping != nil {
+			// The reply was sent to the address the request was sent from
+			ping.Source = local
+			ping.Route = route
+			bt.handlePing(myID, state, ping)
+		}
+	}
+}
 
-		ping := &PingInfo{}
-		// Switch for the ICMP message type
-		switch message.Body.(type) {
-		case *icmp.Echo:
-			ping.Seq = message.Body.(*icmp.Echo).Seq
-			ping.ID = message.Body.(*icmp.Echo).ID
-			ping.Target = target
-			ping.Loss = false
-			ping.Received = time.Now().UTC()
-		case *icmp.TimeExceeded:
-			ping.Loss = true
-			ping.LossReason = "Time Exceeded"
-			ping.ID, ping.Seq, ping.Target = parseICMPError(message.Body.(*icmp.TimeExceeded).Data)
-		case *icmp.PacketTooBig:
-			ping.Loss = true
-			ping.LossReason = "Packet Too Big"
-			ping.ID, ping.Seq, ping.Target = parseICMPError(message.Body.(*icmp.PacketTooBig).Data)
-		case *icmp.DstUnreach:
-			ping.Loss = true
-			ping.LossReason = "Destination Unreachable"
-			ping.ID, ping.Seq, ping.Target = parseICMPError(message.Body.(*icmp.DstUnreach).Data)
+// peerTarget returns the address a message was received from in the form used
+// as target key. IPv4-mapped IPv6 addresses, as reported by dual-stack sockets,
+// become plain IPv4 addresses, which have no zone
+func peerTarget(peer net.Addr) (string, error) {
+	var ip net.IP
+	var zone string
+	switch addr := peer.(type) {
+	case *net.UDPAddr:
+		ip, zone = addr.IP, addr.Zone
+	case *net.IPAddr:
+		ip, zone = addr.IP, addr.Zone
+	default:
+		return "", fmt.Errorf("unknown address type %T", peer)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, zone = ip4, ""
+	}
+	return (&net.IPAddr{IP: ip, Zone: zone}).String(), nil
+}
+
+// parsePing decodes an ICMP message received from target into a ping. Echo
+// replies and timestamp replies answer a request, while errors report a
+// request as lost. Any other message, including the echo requests raw sockets
+// also receive, is ignored and no ping is returned
+func parsePing(pingType icmp.Type, b []byte, target string, ttl int, received time.Time) (*PingInfo, error) {
+	message, err := icmp.ParseMessage(pingType.Protocol(), b)
+	if err != nil {
+		return nil, err
+	}
+
+	ping := &PingInfo{}
+	// Switch for the ICMP message type
+	switch body := message.Body.(type) {
+	case *icmp.Echo:
+		// Requests and replies share the same body, so the type tells
+		// them apart
+		switch message.Type {
+		case ipv4.ICMPTypeEchoReply, ipv6.ICMPTypeEchoReply:
+		case ipv4.ICMPTypeEcho, ipv6.ICMPTypeEchoRequest:
+			logp.Debug("RecvPings", "Ignoring echo request %v from %v", body.Seq, target)
+			return nil, nil
 		default:
+			logp.Debug("RecvPings", "Ignoring unexpected %v message from %v", message.Type, target)
+			return nil, nil
 		}
-		if ping.ID != 0 && ping.ID != myID {
-			logp.Debug("RecvPings", "Ping response from %v not from me:", target)
+		ping.Seq = body.Seq
+		ping.ID = body.ID
+		ping.Target = target
+		ping.Loss = false
+		ping.TTL = ttl
+		ping.Received = received
+	case *icmp.TimeExceeded:
+		ping.Loss = true
+		ping.LossReason = "Time Exceeded"
+		if ping.ID, ping.Seq, ping.Target, err = parseICMPError(pingType, body.Data); err != nil {
+			return nil, err
+		}
+	case *icmp.PacketTooBig:
+		ping.Loss = true
+		ping.LossReason = "Packet Too Big"
+		ping.MTU = body.MTU
+		if ping.ID, ping.Seq, ping.Target, err = parseICMPError(pingType, body.Data); err != nil {
+			return nil, err
+		}
+	case *icmp.DstUnreach:
+		ping.Loss = true
+		ping.LossReason = "Destination Unreachable"
+		// Fragmentation needed is the IPv4 equivalent of Packet Too
+		// Big, with the MTU in the otherwise unused header field
+		if message.Type == ipv4.ICMPTypeDestinationUnreachable && message.Code == fragmentationNeeded {
+			ping.LossReason = "Packet Too Big"
+			ping.MTU = int(binary.BigEndian.Uint16(b[6:8]))
+		}
+		if ping.ID, ping.Seq, ping.Target, err = parseICMPError(pingType, body.Data); err != nil {
+			return nil, err
+		}
+	default:
+		if message.Type != ipv4.ICMPTypeTimestampReply {
+			logp.Debug("RecvPings", "Ignoring unexpected %v message from %v", message.Type, target)
+			return nil, nil
+		}
+		if ping, err = parseTimestampReply(b, received); err != nil {
+			return nil, err
+		}
+		ping.Target = target
+		ping.TTL = ttl
+	}
+	return ping, nil
+}
+
+// handlePing records a received reply or error for one of our requests in
+// PingState and processes it. Replies to requests that were already answered
+// are processed as duplicates. Replies to unknown requests, and anything
+// carrying another ICMP ID, are ignored
+func (bt *Pingbeat) handlePing(myID int, state *PingState, ping *PingInfo) {
+	if ping.ID != 0 && ping.ID != myID {
+		logp.Debug("RecvPings", "Ping response from %v not from me: ID %v", ping.Target, ping.ID)
+		return
+	}
+	if !ping.Loss {
+		if rtt, dup := state.IsDuplicate(ping.Target, ping.Seq, ping.Received); dup {
+			logp.Debug("RecvPings", "Duplicate response %v from %v", ping.Seq, ping.Target)
+			ping.RTT = rtt
+			ping.Duplicate = true
+			bt.processPing(ping)
+			return
+		}
+		var valid, found bool
+		ping.RTT, valid, found = state.CalcPingRTT(ping.Target, ping.Seq, ping.Received)
+		if !found {
+			// Most likely a reply arriving after its request was reaped
+			// and published as lost
+			logp.Debug("RecvPings", "Dropping reply %v from %v to an unknown request", ping.Seq, ping.Target)
+			return
+		}
+		if valid {
+			ping.Jitter, ping.HasJitter = state.CalcJitter(ping.Target, ping.RTT)
 		} else {
-			if !ping.Loss {
-				ping.RTT = state.CalcPingRTT(ping.Seq, ping.Received)
-			} else {
-				logp.Warn("%v: %v", ping.LossReason, ping.Target)
-			}
-			go bt.ProcessPing(ping)
-			state.DelPing(ping.Seq)
+			logp.Warn("Invalid RTT %v for ping %v from %v, clock changed?", ping.RTT, ping.Seq, ping.Target)
+			ping.RTTInvalid = true
 		}
+	} else {
+		logp.Warn("%v: %v", ping.LossReason, ping.Target)
+		ping.Misses = state.AddResult(ping.Target, 0, true)
+	}
+	bt.processPing(ping)
+	state.DelPing(ping.Target, ping.Seq)
+}
+
+// processPing queues a ping to be processed in the background. Pings are
+// sharded over a fixed number of workers by target, so the events of each
+// target are published in order. Pings queued once draining are dropped
+func (bt *Pingbeat) processPing(ping *PingInfo) {
+	bt.drainingMU.RLock()
+	defer bt.drainingMU.RUnlock()
+	if bt.draining {
+		logp.Debug("RecvPings", "Dropping ping from %v, already draining", ping.Target)
+		return
+	}
+	bt.queuesOnce.Do(bt.startWorkers)
+	h := fnv.New32a()
+	h.Write([]byte(ping.Target))
+	bt.processing.Add(1)
+	select {
+	case bt.queues[h.Sum32()%processWorkers] <- ping:
+	case <-bt.drained:
+		logp.Debug("RecvPings", "Dropping ping from %v, already drained", ping.Target)
+		bt.processing.Done()
+	}
+}
+
+// startWorkers starts the workers processing queued pings, which run until
+// Pingbeat is drained
+func (bt *Pingbeat) startWorkers() {
+	bt.queues = make([]chan *PingInfo, processWorkers)
+	for i := range bt.queues {
+		queue := make(chan *PingInfo, processQueueSize)
+		bt.queues[i] = queue
+		go func() {
+			for {
+				select {
+				case ping := <-queue:
+					bt.ProcessPing(ping)
+					bt.processing.Done()
+				case <-bt.drained:
+					return
+				}
+			}
+		}()
 	}
 }
 
-// SendPing sends an ICMP EchoRequest packet to with provided sequence number to
-// the provided target through the given connection
-func SendPing(conn *icmp.PacketConn, timeout time.Duration, seq int, addr net.Addr) pool.WorkFunc {
+// SendPing sends the ICMP EchoRequest packet with the provided sequence number
+// to the provided target through the given connection. The payload is sent
+// byte for byte, escape sequences in a configured payload are not interpreted.
+// Failed writes, e.g. when socket buffers are full, are retried up to retries
+// times with a growing backoff, as long as that leaves time for a reply
+// within timeout
+func SendPing(conn net.PacketConn, timeout time.Duration, echo *EchoPacket, seq int, retries int, addr net.Addr, state *PingState) pool.WorkFunc {
 	return func(wu pool.WorkUnit) (interface{}, error) {
 		if wu.IsCancelled() {
 			logp.Debug("SendPings", "SendPing: workunit cancelled")
 			return nil, nil
 		}
-		// Based on the connection, work out whether we are dealing with
-		// IPv4 or IPv6 ICMP messages
-		var pingType icmp.Type
-		switch {
-		case conn.IPv4PacketConn() != nil:
-			pingType = ipv4.ICMPTypeEcho
-		case conn.IPv4PacketConn() != nil:
-			pingType = ipv6.ICMPTypeEchoRequest
-		default:
-			err := errors.New("Unknown connection type")
-			return nil, err
-		}
-
-		// Create an ICMP Echo Request
-		var id = os.Getpid() & 0xffff
-		message := &icmp.Message{
-			Type: pingType, Code: 0,
-			Body: &icmp.Echo{
-				ID:   id,
-				Seq:  seq,
-				Data: []byte("pingbeat: y'know, for pings!"),
-			},
-		}
-		// Marshall the Echo request for sending via a connection
-		binary, err := message.Marshal(nil)
-		if err != nil {
-			return nil, err
-		}
+		// Create an ICMP Echo Request from the pre-marshaled packet
+		binary := echo.Packet(seq)
 		var t string
 		switch addr.(type) {
 		case *net.UDPAddr:
@@ -295,73 +1282,393 @@ func SendPing(conn *icmp.PacketConn, timeout time.Duration, seq int, addr net.Ad
 		}
 
 		ping := &PingInfo{
-			Seq:    seq,
-			Target: t,
+			ID:       echo.ID,
+			Seq:      seq,
+			Target:   t,
+			Protocol: "icmp",
 		}
+		// Track the request before sending it, otherwise a fast reply can
+		// arrive before there is a request to match it to
+		ping.Sent = time.Now().UTC()
+		state.AddPing(t, seq, ping.Sent, timeout)
 		// Send the request
-		if _, err := conn.WriteTo(binary, addr); err != nil {
-			return ping, err
+		deadline := ping.Sent.Add(timeout)
+		backoff := sendRetryBackoff
+		for attempt := 0; ; attempt++ {
+			_, err := conn.WriteTo(binary, addr)
+			if err == nil {
+				return ping, nil
+			}
+			if attempt >= retries || wu.IsCancelled() || time.Now().Add(backoff).After(deadline) {
+				// Report the ping as never sent rather than letting it
+				// time out as if lost on the network
+				state.CancelPing(t, seq)
+				ping.Loss = true
+				ping.LossReason = "Send failed"
+				return ping, err
+			}
+			logp.Debug("SendPings", "Retrying send to %v in %v: %v", t, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+			ping.Sent = time.Now().UTC()
+			state.AddPing(t, seq, ping.Sent, timeout)
 		}
-		ping.Sent = time.Now().UTC()
-		return ping, nil
 	}
 }
 
 // ProcessPing fetches the details of this ping from the current state
 // and then creates an ping event to be published
 func (bt *Pingbeat) ProcessPing(ping *PingInfo) {
-	if _, found := bt.targets[ping.Target]; !found {
-		logp.Err("No details for %v in targets!", ping.Target)
+	if !ping.Duplicate {
+		bt.counters.addResult(ping.Loss)
+	}
+	details, found := bt.lookupTarget(ping.Target)
+	if !found {
+		// Still publish the ping under its address rather than losing it
+		logp.Debug("ProcessPing", "No details for %v in targets, publishing it under its address", ping.Target)
+		details = Target{Name: ping.Target, Protocol: ping.Protocol}
+		if details.Protocol == "" {
+			details.Protocol = "icmp"
+		}
+	}
+	name := details.Name
+	target := details.fields(ping.Target)
+	protocol := details.Protocol
+	if bt.metrics != nil && !ping.RTTInvalid {
+		bt.metrics.Observe(name, ping)
+	}
+	if bt.statsd != nil && !ping.RTTInvalid {
+		bt.statsd.Observe(name, ping)
+	}
+	if bt.influxdb != nil && !ping.RTTInvalid {
+		bt.influxdb.Observe(name, ping)
+	}
+	if bt.otel != nil && !ping.RTTInvalid {
+		bt.otel.Observe(name, ping)
+	}
+	var event common.MapStr
+	var severity string
+	if ping.Loss {
+		event = common.MapStr{
+			"@timestamp": common.Time(bt.eventTime(ping)),
+			"type":       bt.config.EventType,
+			"target":     target,
+			"protocol":   protocol,
+			"seq":        ping.Seq,
+			"loss":       true,
+			"reason":     ping.LossReason,
+		}
+		if ping.MTU > 0 {
+			event["mtu"] = ping.MTU
+		}
+		logp.Debug("ProcessPing", "Processed ping error for %v (%v): %v", name, ping.Target, ping.LossReason)
 	} else {
-		name := bt.targets[ping.Target].Name
-		tags := bt.targets[ping.Target].Tags
-		if ping.Loss {
-			event := common.MapStr{
-				"@timestamp": common.Time(time.Now().UTC()),
-				"type":       "pingbeat",
-				"target": common.MapStr{
-					"name": name,
-					"addr": ping.Target,
-					"tags": tags,
-				},
-				"loss":   true,
-				"reason": ping.LossReason,
-			}
-			go bt.client.PublishEvent(event)
-			logp.Debug("ProcessPing", "Processed ping error for %v (%v): %v", name, ping.Target, ping.LossReason)
+		event = common.MapStr{
+			"@timestamp": common.Time(bt.eventTime(ping)),
+			"type":       bt.config.EventType,
+			"target":     target,
+			"protocol":   protocol,
+			"seq":        ping.Seq,
+		}
+		if ping.RTTInvalid {
+			event["rtt_invalid"] = true
 		} else {
-			event := common.MapStr{
-				"@timestamp": common.Time(time.Now().UTC()),
-				"type":       "pingbeat",
-				"target": common.MapStr{
-					"name": name,
-					"addr": ping.Target,
-					"tags": tags,
-				},
-				"rtt": milliSeconds(ping.RTT),
+			event["rtt"] = milliSeconds(ping.RTT)
+			event["rtt_ns"] = ping.RTT.Nanoseconds()
+			if len(bt.config.RTTBuckets) > 0 {
+				event["rtt_bucket"] = rttBucket(ping.RTT, bt.config.RTTBuckets)
+			}
+			if bt.config.BaselineFactor > 0 && !ping.Duplicate {
+				if baseline, ok := bt.baseline(details, ping); ok {
+					event["rtt_deviation_ms"] = milliSeconds(ping.RTT - baseline)
+					if float64(ping.RTT) > float64(baseline)*bt.config.BaselineFactor {
+						event["anomaly"] = true
+					}
+				}
+			}
+		}
+		if ping.HasJitter {
+			event["jitter_ms"] = milliSeconds(ping.Jitter)
+		}
+		if ping.Duplicate {
+			event["duplicate"] = true
+		}
+		if protocol == "icmp" || protocol == "timestamp" {
+			event["ttl"] = ping.TTL
+		}
+		if ping.Source != nil {
+			event["source"] = common.MapStr{"ip": ping.Source.String()}
+		}
+		if len(ping.Route) > 0 {
+			route := make([]string, len(ping.Route))
+			for i, hop := range ping.Route {
+				route[i] = hop.String()
+			}
+			event["route"] = route
+		}
+		if ping.Timestamp != nil {
+			event["remote_transmit_ms"] = ping.Timestamp.RemoteTransmit
+			if ping.Timestamp.HasSkew {
+				event["clock_skew_ms"] = milliSeconds(ping.Timestamp.ClockSkew)
+			}
+		}
+		if !ping.Duplicate && !ping.RTTInvalid {
+			severity = bt.severity(details, ping.RTT)
+			if severity != "" {
+				event["severity"] = severity
 			}
-			go bt.client.PublishEvent(event)
-			logp.Debug("ProcessPing", "Processed ping %v for %v (%v): %v", ping.Seq, name, ping.Target, ping.RTT)
 		}
+		logp.Debug("ProcessPing", "Processed ping %v for %v (%v): %v", ping.Seq, name, ping.Target, ping.RTT)
 	}
+	if protocol == "icmp" {
+		event["payload_size"] = len(bt.payload)
+	}
+	if (protocol == "icmp" || protocol == "timestamp") && bt.config.TOS != 0 {
+		event["tos"] = bt.config.TOS
+	}
+	if ping.HTTP != nil {
+		event["http"] = common.MapStr{
+			"dns_ms":     milliSeconds(ping.HTTP.DNS),
+			"connect_ms": milliSeconds(ping.HTTP.Connect),
+			"ttfb_ms":    milliSeconds(ping.HTTP.TTFB),
+			"status":     ping.HTTP.Status,
+		}
+	}
+	if ping.DNS != nil {
+		event["dns"] = common.MapStr{
+			"rcode":   ping.DNS.RCode,
+			"answers": ping.DNS.Answers,
+		}
+	}
+	if ping.GRPC != nil {
+		event["grpc"] = common.MapStr{
+			"status": ping.GRPC.Status,
+		}
+	}
+	if bt.geoip != nil {
+		bt.geoip.enrich(event, details.Addr)
+	}
+	if bt.config.ECS {
+		event = ecsEvent(event, ping, details)
+	}
+	// Losses are only published once enough pings in a row were lost.
+	// Pings not tracked in the state have no count and always are published
+	missed := ping.Misses == 0 || ping.Misses >= bt.config.LossThreshold
+	perPing := !bt.config.StateOnly && !bt.config.SummaryOnly
+	if perPing && (!ping.Loss || bt.config.EmitLoss && missed) {
+		bt.publish(event)
+	}
+	bt.publishStatus(ping, details)
+	if bt.config.ThresholdEvents && !ping.Loss && !ping.Duplicate && !ping.RTTInvalid {
+		if previous, changed := bt.severityChanged(ping.Target, severity); changed {
+			event = transitionEvent(bt.config.EventType, details.fields(ping.Target), protocol, ping, severity, previous)
+			if bt.config.ECS {
+				event = ecsEvent(event, ping, details)
+			}
+			bt.publish(event)
+		}
+	}
+}
+
+// publish publishes an event, batched if configured, or prints it as JSON in
+// a dry run. With fileoutput set, events are also written to the file, or only
+// to the file unless fileoutput.publish is set. Events are also sent to Kafka
+// if configured. The outputs pingbeat writes itself stamp events in the
+// configured timezone, libbeat always writes UTC
+func (bt *Pingbeat) publish(event common.MapStr) {
+	zoned := bt.zoned(event)
+	if bt.kafka != nil && !bt.config.DryRun {
+		if err := bt.kafka.Write(zoned); err != nil {
+			logp.Err("Error encoding event for Kafka: %v", err)
+		}
+	}
+	if bt.file != nil && !bt.config.DryRun {
+		if err := bt.file.Write(zoned); err != nil {
+			logp.Err("Error writing event to %v: %v", bt.config.FileOutput.Path, err)
+		}
+		if !bt.config.FileOutput.Publish {
+			return
+		}
+	}
+	if !bt.config.DryRun {
+		if bt.batcher != nil {
+			bt.batcher.Add(event)
+		} else {
+			bt.client.PublishEvent(event)
+		}
+		return
+	}
+	b, err := json.Marshal(zoned)
+	if err != nil {
+		logp.Err("Error encoding event: %v", err)
+		return
+	}
+	bt.outMU.Lock()
+	fmt.Fprintf(bt.out, "%s\n", b)
+	bt.outMU.Unlock()
 }
 
-func parseICMPError(data []byte) (int, int, string) {
-	IPheader, err := ipv4.ParseHeader(data[:len(data)-8])
+// parseICMPError recovers the ID, sequence number and destination of an echo
+// request from the packet quoted in an ICMP error, which is an IPv4 or IPv6
+// packet depending on the type of echo requests sent
+func parseICMPError(pingType icmp.Type, data []byte) (int, int, string, error) {
+	if pingType.Protocol() == ipv6.ICMPTypeEchoRequest.Protocol() {
+		return parseICMPv6Error(data)
+	}
+	// The quoted packet must hold the IP header and the first 8 bytes of the
+	// echo request, which carry its ID and sequence number
+	if len(data) < ipv4.HeaderLen+icmpHeaderLen {
+		return 0, 0, "", fmt.Errorf("parseICMPError: quoted packet too short: %d bytes", len(data))
+	}
+	IPheader, err := ipv4.ParseHeader(data[:len(data)-icmpHeaderLen])
 	if err != nil {
-		logp.Err("parseICMPError", "Failed to parse packet header:", err)
+		return 0, 0, "", fmt.Errorf("parseICMPError: failed to parse header: %v", err)
+	}
+	if IPheader.Len < ipv4.HeaderLen || len(data) < IPheader.Len+icmpHeaderLen {
+		return 0, 0, "", fmt.Errorf("parseICMPError: quoted packet too short for %d byte header: %d bytes", IPheader.Len, len(data))
 	}
 	ICMPHdr := data[IPheader.Len:]
-	var ID, Seq uint16
-	err = binary.Read(bytes.NewReader(ICMPHdr[6:8]), binary.BigEndian, &Seq)
+	ID := binary.BigEndian.Uint16(ICMPHdr[4:6])
+	Seq := binary.BigEndian.Uint16(ICMPHdr[6:8])
+	return int(ID), int(Seq), IPheader.Dst.String(), nil
+}
+
+// parseICMPv6Error recovers the ID, sequence number and destination of an
+// echo request from the IPv6 packet quoted in an ICMPv6 error. Echo requests
+// are sent without extension headers, so the echo follows the fixed header
+func parseICMPv6Error(data []byte) (int, int, string, error) {
+	header, err := ipv6.ParseHeader(data)
 	if err != nil {
-		logp.Err("parseICMPError", "Failed to parse packet header:", err)
+		return 0, 0, "", fmt.Errorf("parseICMPv6Error: failed to parse header: %v", err)
+	}
+	if len(data) < ipv6.HeaderLen+icmpHeaderLen {
+		return 0, 0, "", fmt.Errorf("parseICMPv6Error: quoted packet too short: %d bytes", len(data))
+	}
+	echo := data[ipv6.HeaderLen:]
+	id := binary.BigEndian.Uint16(echo[4:6])
+	seq := binary.BigEndian.Uint16(echo[6:8])
+	return int(id), int(seq), header.Dst.String(), nil
+}
+
+// patternPayload fills a payload of size bytes with pattern, or one as long as
+// the default payload if size is zero
+func patternPayload(pattern byte, size int) []byte {
+	if size == 0 {
+		size = len(defaultPayload)
+	}
+	return bytes.Repeat([]byte{pattern}, size)
+}
+
+// makePayload pads or truncates data to size bytes. A size of zero leaves data
+// untouched.
+func makePayload(data []byte, size int) []byte {
+	if size == 0 {
+		return data
+	}
+	payload := make([]byte, size)
+	copy(payload, data)
+	return payload
+}
+
+// recvBufferSize returns a read buffer size large enough for an echo reply
+// carrying the configured payload. Reads from raw IPv4 sockets include the IP
+// header, with up to 40 bytes of options such as a recorded route
+func (bt *Pingbeat) recvBufferSize() int {
+	if n := ipv4.HeaderLen + maxIPv4OptionsLen + icmpHeaderLen + len(bt.payload); n > minRecvBufferSize {
+		return n
+	}
+	return minRecvBufferSize
+}
+
+// interfaceAddr returns an IPv4 or IPv6 address of the named interface to
+// bind connections to. Global IPv6 addresses are preferred over link-local
+// ones
+func interfaceAddr(name string, ipv6 bool) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("interface %s: %v", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("interface %s: %v", name, err)
+	}
+	var linkLocal string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || (ipnet.IP.To4() == nil) != ipv6 {
+			continue
+		}
+		if ipnet.IP.IsLinkLocalUnicast() {
+			linkLocal = ipnet.IP.String() + "%" + iface.Name
+			continue
+		}
+		return ipnet.IP.String(), nil
+	}
+	if linkLocal != "" {
+		return linkLocal, nil
+	}
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+	return "", fmt.Errorf("interface %s has no %s address", name, family)
+}
+
+// openConn creates an ICMP connection with the configured socket options, in
+// the configured network namespace if set
+func (bt *Pingbeat) openConn(network string, address string) (*icmp.PacketConn, error) {
+	var conn *icmp.PacketConn
+	create := func() (err error) {
+		conn, err = createConn(network, address)
+		return err
+	}
+	var err error
+	if bt.config.NetNS != "" {
+		err = inNetNS(bt.config.NetNS, create)
+	} else {
+		err = create()
 	}
-	err = binary.Read(bytes.NewReader(ICMPHdr[4:6]), binary.BigEndian, &ID)
 	if err != nil {
-		logp.Err("parseICMPError", "Failed to parse packet header:", err)
+		return nil, err
+	}
+	if bt.config.TOS != 0 {
+		if err := setTOS(conn, bt.config.TOS); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if bt.config.DontFragment {
+		if err := setDontFragment(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if bt.config.TTL != 0 {
+		if err := setTTL(conn, bt.config.TTL); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if bt.config.RecordRoute && network == "ip4:icmp" {
+		if err := setRecordRoute(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// setTOS sets the type of service (IPv4) or traffic class (IPv6) of packets
+// sent through the connection
+func setTOS(conn *icmp.PacketConn, tos int) error {
+	switch {
+	case conn.IPv4PacketConn() != nil:
+		return conn.IPv4PacketConn().SetTOS(tos)
+	case conn.IPv6PacketConn() != nil:
+		return conn.IPv6PacketConn().SetTrafficClass(tos)
+	default:
+		return errors.New("Unknown connection type")
 	}
-	return int(ID), int(Seq), IPheader.Dst.String()
 }
 
 func createConn(n string, a string) (*icmp.PacketConn, error) {
@@ -369,9 +1676,76 @@ func createConn(n string, a string) (*icmp.PacketConn, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Ask for the TTL/hop limit and destination address of received
+	// packets to be reported
+	if p := c.IPv4PacketConn(); p != nil {
+		err = p.SetControlMessage(ipv4.FlagTTL|ipv4.FlagDst, true)
+	} else if p := c.IPv6PacketConn(); p != nil {
+		err = p.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagDst, true)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	// RTTs are more accurate with kernel receive timestamps, but can do
+	// without
+	if err := enableTimestamps(c); err != nil {
+		logp.Debug("pingbeat", "Kernel receive timestamps not available: %v", err)
+	}
 	return c, nil
 }
 
+// readFrom reads an ICMP message from the connection, returning its length,
+// the TTL (IPv4) or hop limit (IPv6) it arrived with, when it was received,
+// the local address it was sent to, the sender and the route recorded in its
+// IPv4 Record Route option, if any. The receive time is taken from the kernel
+// where supported, so it isn't delayed by scheduling
+func readFrom(conn *icmp.PacketConn, b []byte) (int, int, time.Time, net.IP, net.Addr, []net.IP, error) {
+	oob := make([]byte, recvOOBSize)
+	switch {
+	case conn.IPv4PacketConn() != nil:
+		ms := []ipv4.Message{{Buffers: [][]byte{b}, OOB: oob}}
+		if _, err := conn.IPv4PacketConn().ReadBatch(ms, 0); err != nil {
+			return 0, 0, time.Time{}, nil, nil, nil, err
+		}
+		n := ms[0].N
+		var route []net.IP
+		// Unlike ReadFrom, ReadBatch leaves the IPv4 header read from raw
+		// sockets in place
+		if _, raw := ms[0].Addr.(*net.IPAddr); raw && n > 0 {
+			hlen := int(b[0]&0x0f) << 2
+			if hlen > n || hlen < ipv4.HeaderLen {
+				return 0, 0, time.Time{}, nil, nil, nil, fmt.Errorf("short IPv4 packet: %d bytes", n)
+			}
+			route = parseRecordRoute(b[ipv4.HeaderLen:hlen])
+			n = copy(b, b[hlen:n])
+		}
+		var cm ipv4.ControlMessage
+		cm.Parse(oob[:ms[0].NN])
+		return n, cm.TTL, receivedAt(oob[:ms[0].NN]), cm.Dst, ms[0].Addr, route, nil
+	case conn.IPv6PacketConn() != nil:
+		ms := []ipv6.Message{{Buffers: [][]byte{b}, OOB: oob}}
+		if _, err := conn.IPv6PacketConn().ReadBatch(ms, 0); err != nil {
+			return 0, 0, time.Time{}, nil, nil, nil, err
+		}
+		var cm ipv6.ControlMessage
+		cm.Parse(oob[:ms[0].NN])
+		return ms[0].N, cm.HopLimit, receivedAt(oob[:ms[0].NN]), cm.Dst, ms[0].Addr, nil, nil
+	default:
+		n, peer, err := conn.ReadFrom(b)
+		return n, 0, time.Now().UTC(), nil, peer, nil, err
+	}
+}
+
+// receivedAt returns the kernel receive timestamp from the control messages
+// of a packet, or the current time if there isn't one
+func receivedAt(oob []byte) time.Time {
+	if t, ok := rxTimestamp(oob); ok {
+		return t
+	}
+	return time.Now().UTC()
+}
+
 func milliSeconds(d time.Duration) float64 {
 	msec := d / time.Millisecond
 	nsec := d % time.Millisecond
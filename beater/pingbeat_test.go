@@ -0,0 +1,1721 @@
+// +build !integration
+
+package beater
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/publisher"
+	"github.com/joshuar/pingbeat/config"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+// testClient is a publisher.Client that hands published events to a channel
+type testClient struct {
+	events chan common.MapStr
+}
+
+func newTestClient() *testClient {
+	return &testClient{events: make(chan common.MapStr, 100)}
+}
+
+func (c *testClient) Close() error { return nil }
+
+func (c *testClient) PublishEvent(event common.MapStr, opts ...publisher.ClientOption) bool {
+	c.events <- event
+	return true
+}
+
+func (c *testClient) PublishEvents(events []common.MapStr, opts ...publisher.ClientOption) bool {
+	for _, event := range events {
+		c.events <- event
+	}
+	return true
+}
+
+func (c *testClient) next(t *testing.T) common.MapStr {
+	select {
+	case event := <-c.events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return nil
+}
+
+func newTestBeat(addrs ...string) (*Pingbeat, *testClient) {
+	client := newTestClient()
+	bt := &Pingbeat{
+		done:    make(chan struct{}),
+		drained: make(chan struct{}),
+		config:  config.DefaultConfig,
+		client:  client,
+		targets: make(map[string]Target),
+	}
+	for _, addr := range addrs {
+		bt.targets[addr] = Target{
+			Addr:     &net.IPAddr{IP: net.ParseIP(addr)},
+			Name:     addr,
+			Protocol: "icmp",
+		}
+	}
+	return bt, client
+}
+
+func TestTimeoutProducesLossEvent(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.config.Timeout = 100 * time.Millisecond
+
+	state := NewPingState()
+	state.AddPing("192.0.2.1", 7, time.Now().UTC(), 0)
+	time.Sleep(2 * bt.config.Timeout)
+
+	for _, ping := range state.CleanPings(bt.config.Timeout) {
+		bt.ProcessPing(ping)
+	}
+	event := client.next(t)
+	if event["loss"] != true {
+		t.Errorf("expected loss event, got %v", event)
+	}
+	if event["reason"] != "Timeout" {
+		t.Errorf("expected Timeout reason, got %v", event["reason"])
+	}
+}
+
+func newTestConfig(t *testing.T, settings map[string]interface{}) *common.Config {
+	cfg := map[string]interface{}{"privileged": false}
+	for k, v := range settings {
+		cfg[k] = v
+	}
+	c, err := common.NewConfigFrom(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestMakePayload(t *testing.T) {
+	tests := []struct {
+		size     int
+		expected int
+	}{
+		{0, len(defaultPayload)},
+		{8, 8},
+		{1400, 1400},
+	}
+	for _, test := range tests {
+		payload := makePayload(defaultPayload, test.size)
+		if len(payload) != test.expected {
+			t.Errorf("size %d: expected %d byte payload, got %d", test.size, test.expected, len(payload))
+		}
+	}
+}
+
+func TestNewNoAddressFamily(t *testing.T) {
+	_, err := New(nil, newTestConfig(t, map[string]interface{}{"useipv4": false, "useipv6": false}))
+	if err == nil {
+		t.Error("expected disabling both IPv4 and IPv6 to be rejected")
+	}
+}
+
+func TestNewPeriod(t *testing.T) {
+	tests := []struct {
+		period   string
+		expected time.Duration
+		valid    bool
+	}{
+		{"0s", defaultPeriod, true},
+		{"-1s", 0, false},
+		{"5ms", 0, false},
+		{"10ms", 10 * time.Millisecond, true},
+		{"30s", 30 * time.Second, true},
+	}
+	for _, test := range tests {
+		b, err := New(nil, newTestConfig(t, map[string]interface{}{"period": test.period}))
+		if !test.valid {
+			if err == nil {
+				t.Errorf("expected period %v to be rejected", test.period)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("period %v: %v", test.period, err)
+			continue
+		}
+		if period := b.(*Pingbeat).config.Period; period != test.expected {
+			t.Errorf("period %v: expected %v, got %v", test.period, test.expected, period)
+		}
+	}
+}
+
+func TestNewTimeout(t *testing.T) {
+	for _, timeout := range []string{"0s", "-1s"} {
+		if _, err := New(nil, newTestConfig(t, map[string]interface{}{"timeout": timeout})); err == nil {
+			t.Errorf("expected timeout %v to be rejected", timeout)
+		}
+	}
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"timeout": "1s"})); err != nil {
+		t.Errorf("timeout 1s: %v", err)
+	}
+}
+
+func TestNewPacketSize(t *testing.T) {
+	for _, size := range []int{-1, maxPacketSize + 1} {
+		if _, err := New(nil, newTestConfig(t, map[string]interface{}{"packetsize": size})); err == nil {
+			t.Errorf("expected packetsize %d to be rejected", size)
+		}
+	}
+
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{"packetsize": 4000}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt := b.(*Pingbeat)
+	if len(bt.payload) != 4000 {
+		t.Errorf("expected 4000 byte payload, got %d", len(bt.payload))
+	}
+	if bt.recvBufferSize() < icmpHeaderLen+4000 {
+		t.Errorf("receive buffer too small for payload: %d", bt.recvBufferSize())
+	}
+}
+
+func TestNewPayload(t *testing.T) {
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{"payload": "tenant-a"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b.(*Pingbeat).payload) != "tenant-a" {
+		t.Errorf("unexpected payload %q", b.(*Pingbeat).payload)
+	}
+
+	_, err = New(nil, newTestConfig(t, map[string]interface{}{
+		"payload":    "longer than eight",
+		"packetsize": 8,
+	}))
+	if err == nil {
+		t.Error("expected payload longer than packetsize to be rejected")
+	}
+}
+
+// wirePayload sends a ping carrying payload to localhost and returns the
+// payload of the echo request seen on the wire
+func wirePayload(t *testing.T, payload []byte) []byte {
+	conn, err := createConn("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		t.Skipf("cannot open raw ICMP socket: %v", err)
+	}
+	defer conn.Close()
+
+	echo, err := NewEchoPacket(ipv4.ICMPTypeEcho, os.Getpid()&0xffff, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wu := pool.New().Queue(SendPing(conn, time.Second, echo, 4242, 0, &net.IPAddr{IP: net.ParseIP("127.0.0.1")}, NewPingState()))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, minRecvBufferSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("no echo seen on the wire: %v", err)
+		}
+		message, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), buf[:n])
+		if err != nil {
+			continue
+		}
+		if echo, ok := message.Body.(*icmp.Echo); ok && echo.Seq == 4242 {
+			return echo.Data
+		}
+	}
+}
+
+func TestSendPingPayload(t *testing.T) {
+	payload := []byte("tenant-a: \\x00 stays literal")
+	if data := wirePayload(t, payload); !bytes.Equal(data, payload) {
+		t.Errorf("expected payload %q on the wire, got %q", payload, data)
+	}
+}
+
+func TestPayloadPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		b       byte
+	}{
+		{"0x00", 0x00},
+		{"0xff", 0xff},
+		{"90", 0x5a},
+	}
+	for _, test := range tests {
+		b, err := New(nil, newTestConfig(t, map[string]interface{}{
+			"payloadpattern": test.pattern,
+			"packetsize":     100,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := bytes.Repeat([]byte{test.b}, 100)
+		if data := wirePayload(t, b.(*Pingbeat).payload); !bytes.Equal(data, want) {
+			t.Errorf("expected %s pattern on the wire, got %x", test.pattern, data)
+		}
+	}
+
+	for _, settings := range []map[string]interface{}{
+		{"payloadpattern": "0x100"},
+		{"payloadpattern": "zeros"},
+		{"payloadpattern": "0xff", "payload": "tenant-a"},
+	} {
+		if _, err := New(nil, newTestConfig(t, settings)); err == nil {
+			t.Errorf("expected %v to be rejected", settings)
+		}
+	}
+}
+
+func TestReadFromTTL(t *testing.T) {
+	tests := []struct {
+		network string
+		listen  string
+		target  string
+		typ     icmp.Type
+		reply   icmp.Type
+	}{
+		{"ip4:icmp", "0.0.0.0", "127.0.0.1", ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply},
+		{"ip6:ipv6-icmp", "::", "::1", ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply},
+	}
+	for _, test := range tests {
+		conn, err := createConn(test.network, test.listen)
+		if err != nil {
+			t.Logf("skipping %s: %v", test.network, err)
+			continue
+		}
+		message := &icmp.Message{
+			Type: test.typ,
+			Body: &icmp.Echo{ID: 4242, Seq: 1, Data: defaultPayload},
+		}
+		wb, err := message.Marshal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.WriteTo(wb, &net.IPAddr{IP: net.ParseIP(test.target)}); err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, minRecvBufferSize)
+		for {
+			n, ttl, _, _, _, _, err := readFrom(conn, buf)
+			if err != nil {
+				t.Fatalf("%s: no echo reply received: %v", test.network, err)
+			}
+			m, err := icmp.ParseMessage(test.typ.Protocol(), buf[:n])
+			if err != nil || m.Type != test.reply {
+				continue
+			}
+			if ttl <= 0 {
+				t.Errorf("%s: expected a positive TTL, got %d", test.network, ttl)
+			}
+			break
+		}
+		conn.Close()
+	}
+}
+
+func TestSendPingIPv6Type(t *testing.T) {
+	conn, err := createConn("ip6:ipv6-icmp", "::")
+	if err != nil {
+		t.Skipf("cannot open raw ICMPv6 socket: %v", err)
+	}
+	defer conn.Close()
+
+	echo, err := NewEchoPacket(ipv6.ICMPTypeEchoRequest, os.Getpid()&0xffff, defaultPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wu := pool.New().Queue(SendPing(conn, time.Second, echo, 4343, 0, &net.IPAddr{IP: net.ParseIP("::1")}, NewPingState()))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, minRecvBufferSize)
+	for {
+		n, _, _, _, _, _, err := readFrom(conn, buf)
+		if err != nil {
+			t.Fatalf("no echo request seen on the wire: %v", err)
+		}
+		message, err := icmp.ParseMessage(ipv6.ICMPTypeEchoRequest.Protocol(), buf[:n])
+		if err != nil {
+			continue
+		}
+		if echo, ok := message.Body.(*icmp.Echo); ok && echo.Seq == 4343 && message.Type != ipv6.ICMPTypeEchoReply {
+			if buf[0] != 128 {
+				t.Errorf("expected ICMPv6 echo request type 128, got %d", buf[0])
+			}
+			return
+		}
+	}
+}
+
+func TestOpenConnTOS(t *testing.T) {
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"tos": 256})); err == nil {
+		t.Error("expected tos 256 to be rejected")
+	}
+
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{"tos": 0xb8}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt := b.(*Pingbeat)
+
+	if conn, err := bt.openConn("ip4:icmp", "0.0.0.0"); err != nil {
+		t.Logf("skipping IPv4: %v", err)
+	} else {
+		tos, err := conn.IPv4PacketConn().TOS()
+		if err != nil || tos != 0xb8 {
+			t.Errorf("expected IPv4 TOS 0xb8, got %#x (%v)", tos, err)
+		}
+		conn.Close()
+	}
+	if conn, err := bt.openConn("ip6:ipv6-icmp", "::"); err != nil {
+		t.Logf("skipping IPv6: %v", err)
+	} else {
+		tc, err := conn.IPv6PacketConn().TrafficClass()
+		if err != nil || tc != 0xb8 {
+			t.Errorf("expected IPv6 traffic class 0xb8, got %#x (%v)", tc, err)
+		}
+		conn.Close()
+	}
+}
+
+// hopConn is a mock connection to a target beyond the first hop, which
+// answers every echo request with a Time Exceeded error as the first router
+// would for pings sent with a TTL of 1
+type hopConn struct {
+	net.PacketConn
+	errors chan []byte
+}
+
+func (c *hopConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	header, err := (&ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(b),
+		TTL:      1,
+		Protocol: 1,
+		Src:      net.ParseIP("192.0.2.100"),
+		Dst:      addr.(*net.IPAddr).IP,
+	}).Marshal()
+	if err != nil {
+		return 0, err
+	}
+	message, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{Data: append(header, b...)},
+	}).Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	c.errors <- message
+	return len(b), nil
+}
+
+func TestTTL(t *testing.T) {
+	for _, ttl := range []int{-1, 256} {
+		if _, err := New(nil, newTestConfig(t, map[string]interface{}{"ttl": ttl})); err == nil {
+			t.Errorf("expected ttl %d to be rejected", ttl)
+		}
+	}
+
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{"ttl": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt := b.(*Pingbeat)
+	if conn, err := bt.openConn("ip4:icmp", "0.0.0.0"); err != nil {
+		t.Logf("skipping IPv4: %v", err)
+	} else {
+		if ttl, err := conn.IPv4PacketConn().TTL(); err != nil || ttl != 1 {
+			t.Errorf("expected IPv4 TTL 1, got %d (%v)", ttl, err)
+		}
+		conn.Close()
+	}
+	if conn, err := bt.openConn("ip6:ipv6-icmp", "::"); err != nil {
+		t.Logf("skipping IPv6: %v", err)
+	} else {
+		if hops, err := conn.IPv6PacketConn().HopLimit(); err != nil || hops != 1 {
+			t.Errorf("expected IPv6 hop limit 1, got %d (%v)", hops, err)
+		}
+		conn.Close()
+	}
+
+	// Pings to a target beyond the first hop are lost
+	bt, client := newTestBeat("192.0.2.1")
+	state := NewPingState()
+	conn := &hopConn{errors: make(chan []byte, 1)}
+	echo, err := NewEchoPacket(ipv4.ICMPTypeEcho, 0xbeef, defaultPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wu := pool.New().Queue(SendPing(conn, time.Second, echo, 5, 0, bt.targets["192.0.2.1"].Addr, state))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		t.Fatal(err)
+	}
+	ping, err := parsePing(ipv4.ICMPTypeEcho, <-conn.errors, "192.0.2.100", 64, time.Now().UTC())
+	if err != nil || ping == nil {
+		t.Fatalf("expected a ping from the Time Exceeded error, got %v (%v)", ping, err)
+	}
+	bt.handlePing(0xbeef, state, ping)
+	event := client.next(t)
+	if event["loss"] != true || event["reason"] != "Time Exceeded" || event["seq"] != 5 {
+		t.Errorf("expected ping 5 lost to Time Exceeded, got %v", event)
+	}
+	if state.Pending() != 0 {
+		t.Errorf("expected the lost ping to no longer be outstanding, got %d", state.Pending())
+	}
+}
+
+func TestNewInterface(t *testing.T) {
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"interface": "nonexistent0"})); err == nil {
+		t.Error("expected a missing interface to be rejected")
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loopback string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"privileged": true,
+		"interface":  loopback,
+		"useipv6":    false,
+	}))
+	if err != nil {
+		t.Skipf("cannot create privileged pingbeat: %v", err)
+	}
+	bt := b.(*Pingbeat)
+	if bt.ipv4addr != "127.0.0.1" {
+		t.Fatalf("expected to bind to 127.0.0.1, got %v", bt.ipv4addr)
+	}
+	conn, err := bt.openConn(bt.ipv4network, bt.ipv4addr)
+	if err != nil {
+		t.Skipf("cannot open raw ICMP socket: %v", err)
+	}
+	defer conn.Close()
+	if local := conn.LocalAddr().String(); local != "127.0.0.1" {
+		t.Errorf("expected socket bound to 127.0.0.1, got %v", local)
+	}
+}
+
+func TestNewSourceIP(t *testing.T) {
+	invalid := []map[string]interface{}{
+		{"sourceipv4": "not-an-ip"},
+		{"sourceipv4": "::1"},
+		{"sourceipv6": "127.0.0.1"},
+		{"sourceipv4": "127.0.0.1", "useipv4": false},
+		{"sourceipv6": "::1", "useipv6": false},
+	}
+	for _, settings := range invalid {
+		if _, err := New(nil, newTestConfig(t, settings)); err == nil {
+			t.Errorf("expected %v to be rejected", settings)
+		}
+	}
+
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"privileged": true,
+		"sourceipv4": "127.0.0.1",
+		"sourceipv6": "::1",
+	}))
+	if err != nil {
+		t.Skipf("cannot create privileged pingbeat: %v", err)
+	}
+	bt := b.(*Pingbeat)
+	for network, addr := range map[string]string{bt.ipv4network: bt.ipv4addr, bt.ipv6network: bt.ipv6addr} {
+		conn, err := bt.openConn(network, addr)
+		if err != nil {
+			t.Logf("skipping %s: %v", network, err)
+			continue
+		}
+		if local := conn.LocalAddr().String(); local != addr {
+			t.Errorf("%s: expected socket bound to %v, got %v", network, addr, local)
+		}
+		conn.Close()
+	}
+}
+
+func TestPrivilegedPerFamily(t *testing.T) {
+	tests := []struct {
+		settings map[string]interface{}
+		ipv4     string
+		ipv6     string
+		root     bool
+	}{
+		{map[string]interface{}{}, "udp4", "udp6", false},
+		// Raw sockets of a disabled family don't need root
+		{map[string]interface{}{"privilegedipv4": true, "useipv4": false}, "ip4:icmp", "udp6", false},
+		{map[string]interface{}{"privileged": true, "privilegedipv6": false}, "ip4:icmp", "udp6", true},
+		{map[string]interface{}{"privilegedipv6": true}, "udp4", "ip6:ipv6-icmp", true},
+	}
+	for _, test := range tests {
+		b, err := New(nil, newTestConfig(t, test.settings))
+		if test.root && os.Getuid() != 0 {
+			if err == nil {
+				t.Errorf("%v: expected raw sockets to need root", test.settings)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.settings, err)
+			continue
+		}
+		bt := b.(*Pingbeat)
+		if bt.ipv4network != test.ipv4 || bt.ipv6network != test.ipv6 {
+			t.Errorf("%v: expected networks %s and %s, got %s and %s", test.settings, test.ipv4, test.ipv6, bt.ipv4network, bt.ipv6network)
+		}
+	}
+
+	// Targets are addressed for the socket of their family
+	targets, _ := NewTargets([]*targetConfig{{Name: "192.0.2.1"}, {Name: "2001:db8::1"}}, privileges{ipv4: true}, true, true, 1024)
+	if _, ok := targets["192.0.2.1"].Addr.(*net.IPAddr); !ok {
+		t.Errorf("expected a raw IPv4 address, got %T", targets["192.0.2.1"].Addr)
+	}
+	if _, ok := targets["2001:db8::1"].Addr.(*net.UDPAddr); !ok {
+		t.Errorf("expected an unprivileged IPv6 address, got %T", targets["2001:db8::1"].Addr)
+	}
+
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"privilegedipv4": true,
+		"traceroute":     map[string]interface{}{"period": "1m", "maxhops": 30},
+	})); err == nil {
+		t.Error("expected traceroute over an unprivileged family to be rejected")
+	}
+}
+
+func TestDuplicateReply(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	state := NewPingState()
+	sent := time.Now().UTC()
+	state.AddPing("192.0.2.1", 3, sent, 0)
+
+	for i := 0; i < 2; i++ {
+		bt.handlePing(0, state, &PingInfo{
+			Seq:      3,
+			Target:   "192.0.2.1",
+			Received: sent.Add(time.Duration(i+1) * time.Millisecond),
+		})
+	}
+
+	var normal, duplicate int
+	for i := 0; i < 2; i++ {
+		event := client.next(t)
+		if event["duplicate"] == true {
+			duplicate++
+		} else {
+			normal++
+		}
+	}
+	if normal != 1 || duplicate != 1 {
+		t.Errorf("expected one normal and one duplicate event, got %v and %v", normal, duplicate)
+	}
+
+	// Duplicates are only recognised until the request would have timed out
+	state.CleanPings(0)
+	if _, dup := state.IsDuplicate("192.0.2.1", 3, time.Now()); dup {
+		t.Error("answered request not cleaned up after timeout")
+	}
+}
+
+func TestLateReply(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	state := NewPingState()
+	state.WindowSize = 10
+	sent := time.Now().UTC()
+	state.AddPing("192.0.2.1", 3, sent, 0)
+	if lost := state.CleanPings(0); len(lost) != 1 {
+		t.Fatalf("expected the request reaped as lost, got %v", lost)
+	}
+
+	// The reply arrives after its request was published as lost
+	bt.handlePing(0, state, &PingInfo{Seq: 3, Target: "192.0.2.1", Received: sent.Add(time.Second)})
+	select {
+	case event := <-client.events:
+		t.Errorf("late reply was processed: %v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if sent, received := state.GetWindow("192.0.2.1"); sent != 1 || received != 0 {
+		t.Errorf("expected the late reply not counted, got %d of %d", received, sent)
+	}
+	if rtt, valid, found := state.CalcPingRTT("192.0.2.1", 3, time.Now()); found || valid || rtt != 0 {
+		t.Errorf("expected no RTT for an unknown request, got %v (%v, %v)", rtt, valid, found)
+	}
+}
+
+func TestICMPID(t *testing.T) {
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"icmpid": 0x10000})); err == nil {
+		t.Error("expected icmpid above 16 bits to be rejected")
+	}
+
+	bt, client := newTestBeat("192.0.2.1")
+	state := NewPingState()
+	state.AddPing("192.0.2.1", 5, time.Now().UTC(), 0)
+
+	bt.handlePing(1000, state, &PingInfo{ID: 2000, Seq: 5, Target: "192.0.2.1", Received: time.Now().UTC()})
+	select {
+	case event := <-client.events:
+		t.Errorf("reply with another ID was processed: %v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	bt.handlePing(1000, state, &PingInfo{ID: 1000, Seq: 5, Target: "192.0.2.1", Received: time.Now().UTC()})
+	if event := client.next(t); event["duplicate"] == true {
+		t.Error("reply with our ID was treated as a duplicate of the rejected one")
+	}
+}
+
+func TestSendPingID(t *testing.T) {
+	conn, err := createConn("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		t.Skipf("cannot open raw ICMP socket: %v", err)
+	}
+	defer conn.Close()
+
+	echo, err := NewEchoPacket(ipv4.ICMPTypeEcho, 0x1234, defaultPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wu := pool.New().Queue(SendPing(conn, time.Second, echo, 4444, 0, &net.IPAddr{IP: net.ParseIP("127.0.0.1")}, NewPingState()))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if id := wu.Value().(*PingInfo).ID; id != 0x1234 {
+		t.Errorf("expected sent ping to record ID 0x1234, got %#x", id)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, minRecvBufferSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("no echo seen on the wire: %v", err)
+		}
+		message, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), buf[:n])
+		if err != nil {
+			continue
+		}
+		if echo, ok := message.Body.(*icmp.Echo); ok && echo.Seq == 4444 {
+			if echo.ID != 0x1234 {
+				t.Errorf("expected ID 0x1234 on the wire, got %#x", echo.ID)
+			}
+			return
+		}
+	}
+}
+
+func TestStopDrainsPendingPings(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.config.Timeout = 200 * time.Millisecond
+	state := NewPingState()
+	state.AddPing("192.0.2.1", 1, time.Now().UTC(), 0)
+	state.AddPing("192.0.2.1", 2, time.Now().UTC(), 0)
+
+	// Stand in for Run, which drains once stopped
+	go func() {
+		defer close(bt.drained)
+		<-bt.done
+		bt.drain(state)
+	}()
+	// A reply arriving just after Stop is called
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		bt.handlePing(0, state, &PingInfo{Seq: 1, Target: "192.0.2.1", Received: time.Now().UTC()})
+	}()
+	bt.Stop()
+
+	if len(client.events) != 2 {
+		t.Fatalf("expected 2 events published before Stop returned, got %v", len(client.events))
+	}
+	var replies, lost int
+	for i := 0; i < 2; i++ {
+		if event := <-client.events; event["loss"] == true {
+			lost++
+		} else {
+			replies++
+		}
+	}
+	if replies != 1 || lost != 1 {
+		t.Errorf("expected one reply and one lost ping, got %v and %v", replies, lost)
+	}
+}
+
+func TestDrainStopsQueueing(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.config.Timeout = 50 * time.Millisecond
+	client.events = make(chan common.MapStr, 100000)
+	state := NewPingState()
+	state.AddPing("192.0.2.1", 1, time.Now().UTC(), 0)
+
+	// A receiver keeps processing replies while draining
+	stop := make(chan struct{})
+	var receiving sync.WaitGroup
+	receiving.Add(1)
+	go func() {
+		defer receiving.Done()
+		for seq := 2; ; seq++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			bt.processPing(&PingInfo{Target: "192.0.2.1", Seq: seq, RTT: time.Millisecond})
+		}
+	}()
+	bt.drain(state)
+	published := len(client.events)
+
+	// Nothing is queued once drained
+	bt.processPing(&PingInfo{Target: "192.0.2.1", Seq: 0, RTT: time.Millisecond})
+	close(stop)
+	receiving.Wait()
+	time.Sleep(50 * time.Millisecond)
+	if len(client.events) != published {
+		t.Errorf("expected %d events once drained, got %d", published, len(client.events))
+	}
+	var lost int
+	for len(client.events) > 0 {
+		if event := <-client.events; event["loss"] == true {
+			lost++
+		}
+	}
+	if lost != 1 {
+		t.Errorf("expected the outstanding ping reported lost, got %d lost", lost)
+	}
+	close(bt.drained)
+}
+
+func TestPoolSize(t *testing.T) {
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"workers": -1})); err == nil {
+		t.Error("expected negative workers to be rejected")
+	}
+
+	bt, _ := newTestBeat("192.0.2.1")
+	bt.config.Timeout = 100 * time.Millisecond
+	size := bt.poolSize()
+	if size != 1 {
+		t.Errorf("expected a single worker, got %v", size)
+	}
+	wu := pool.NewLimited(size).Queue(func(wu pool.WorkUnit) (interface{}, error) {
+		return true, nil
+	})
+	wu.Wait()
+	if wu.Value() != true {
+		t.Error("pool did not run queued work")
+	}
+
+	bt.targets = map[string]Target{}
+	if size := bt.poolSize(); size != 1 {
+		t.Errorf("expected at least one worker without targets, got %v", size)
+	}
+	bt.config.Workers = 8
+	if size := bt.poolSize(); size != 8 {
+		t.Errorf("expected configured 8 workers, got %v", size)
+	}
+	bt.config.Workers = 0
+
+	// A sub-second timeout still gives a worker per target
+	for i := 0; i < 10; i++ {
+		bt.targets[fmt.Sprintf("192.0.2.%d", i)] = Target{}
+	}
+	bt.config.Timeout = 100 * time.Millisecond
+	if size := bt.poolSize(); size != 10 {
+		t.Errorf("expected 10 workers, got %v", size)
+	}
+	// Workers cover the longest timeout of any target
+	bt.targets["192.0.2.10"] = Target{Timeout: 3 * time.Second}
+	if size := bt.poolSize(); size != 33 {
+		t.Errorf("expected 33 workers for a 3s target timeout, got %v", size)
+	}
+
+	// Very many targets are capped at maxworkers
+	bt.config.Timeout = time.Duration(math.MaxInt64)
+	bt.config.PingsPerPeriod = math.MaxInt32
+	bt.config.MaxWorkers = 100
+	if size := bt.poolSize(); size != 100 {
+		t.Errorf("expected workers capped at 100, got %v", size)
+	}
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"maxworkers": 0})); err == nil {
+		t.Error("expected maxworkers of 0 to be rejected")
+	}
+}
+
+func TestRecvPingsStops(t *testing.T) {
+	conn, err := createConn("ip4:icmp", "127.0.0.1")
+	if err != nil {
+		t.Skipf("cannot open raw ICMP socket: %v", err)
+	}
+	defer conn.Close()
+
+	bt, _ := newTestBeat()
+	stopped := make(chan struct{})
+	go func() {
+		RecvPings(0, bt, NewPingState(), &socket{conn: conn})
+		close(stopped)
+	}()
+
+	// Replies are still received while draining
+	close(bt.done)
+	select {
+	case <-stopped:
+		t.Fatal("receiver stopped before draining finished")
+	case <-time.After(2 * recvDeadline):
+	}
+
+	close(bt.drained)
+	select {
+	case <-stopped:
+	case <-time.After(2 * recvDeadline):
+		t.Fatal("receiver still running after being drained")
+	}
+}
+
+func TestParseICMPv6Error(t *testing.T) {
+	echo, err := marshalEcho(ipv6.ICMPTypeEchoRequest, 0xbeef, 1234, defaultPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// IPv6 header of the echo request from 2001:db8::1 to 2001:db8::2
+	header := []byte{
+		0x60, 0x00, 0x00, 0x00, 0x00, byte(len(echo)), 58, 1,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x02,
+	}
+	quoted := append(header, echo...)
+
+	for _, body := range []icmp.MessageBody{
+		&icmp.TimeExceeded{Data: quoted},
+		&icmp.DstUnreach{Data: quoted},
+		&icmp.PacketTooBig{MTU: 1280, Data: quoted},
+	} {
+		var msgType icmp.Type
+		switch body.(type) {
+		case *icmp.TimeExceeded:
+			msgType = ipv6.ICMPTypeTimeExceeded
+		case *icmp.DstUnreach:
+			msgType = ipv6.ICMPTypeDestinationUnreachable
+		case *icmp.PacketTooBig:
+			msgType = ipv6.ICMPTypePacketTooBig
+		}
+		b, err := (&icmp.Message{Type: msgType, Body: body}).Marshal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, err := icmp.ParseMessage(ipv6.ICMPTypeEchoRequest.Protocol(), b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data []byte
+		switch body := message.Body.(type) {
+		case *icmp.TimeExceeded:
+			data = body.Data
+		case *icmp.DstUnreach:
+			data = body.Data
+		case *icmp.PacketTooBig:
+			data = body.Data
+		}
+
+		id, seq, target, err := parseICMPError(ipv6.ICMPTypeEchoRequest, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 0xbeef || seq != 1234 || target != "2001:db8::2" {
+			t.Errorf("%v: expected ID 0xbeef, seq 1234 to 2001:db8::2, got %#x, %v to %v", msgType, id, seq, target)
+		}
+	}
+
+	if _, _, target, err := parseICMPError(ipv6.ICMPTypeEchoRequest, quoted[:20]); err == nil {
+		t.Errorf("expected truncated packet to be rejected, got %v", target)
+	}
+}
+
+func TestSourceAddress(t *testing.T) {
+	// Bound to another loopback address than the target, so the source can
+	// only have come from the reply
+	conn, err := createConn("ip4:icmp", "127.0.0.2")
+	if err != nil {
+		t.Skipf("cannot open raw ICMP socket on 127.0.0.2: %v", err)
+	}
+	sock := &socket{conn: conn}
+	defer sock.Close()
+
+	bt, client := newTestBeat("127.0.0.1")
+	state := NewPingState()
+	go RecvPings(0xbeef, bt, state, sock)
+	defer close(bt.drained)
+
+	echo, err := NewEchoPacket(ipv4.ICMPTypeEcho, 0xbeef, defaultPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wu := pool.New().Queue(SendPing(conn, time.Second, echo, 1, 0, &net.IPAddr{IP: net.ParseIP("127.0.0.1")}, state))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		t.Fatal(err)
+	}
+	event := client.next(t)
+	source, ok := event["source"].(common.MapStr)
+	if !ok || source["ip"] != "127.0.0.2" {
+		t.Errorf("expected source 127.0.0.2 the socket is bound to, got %v", event["source"])
+	}
+}
+
+func TestRecvPingsUnknownConnection(t *testing.T) {
+	bt, _ := newTestBeat()
+	stopped := make(chan struct{})
+	go func() {
+		RecvPings(0, bt, NewPingState(), &socket{conn: &icmp.PacketConn{}})
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("receiver kept running on a connection of neither family")
+	}
+}
+
+func TestQueuePingsSendJitter(t *testing.T) {
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"period": "1s", "sendjitter": "1s"})); err == nil {
+		t.Error("expected sendjitter of a whole period to be rejected")
+	}
+
+	var addrs []string
+	for i := 1; i <= 20; i++ {
+		addrs = append(addrs, fmt.Sprintf("192.0.2.%d", i))
+	}
+	bt, _ := newTestBeat(addrs...)
+	bt.config.SendJitter = 200 * time.Millisecond
+
+	start := time.Now()
+	batch := pool.New().Batch()
+	go bt.queuePings(batch, NewPingState(), func(ip string, target Target) pool.WorkFunc {
+		return func(wu pool.WorkUnit) (interface{}, error) {
+			return time.Now(), nil
+		}
+	})
+	var first, last time.Time
+	for result := range batch.Results() {
+		sent := result.Value().(time.Time)
+		if first.IsZero() || sent.Before(first) {
+			first = sent
+		}
+		if sent.After(last) {
+			last = sent
+		}
+	}
+	if spread := last.Sub(first); spread < bt.config.SendJitter/2 {
+		t.Errorf("expected pings spread over the %v window, got %v", bt.config.SendJitter, spread)
+	}
+	if elapsed := last.Sub(start); elapsed > bt.config.SendJitter+50*time.Millisecond {
+		t.Errorf("expected pings sent within the %v window, took %v", bt.config.SendJitter, elapsed)
+	}
+}
+
+func TestQueuePingsPriority(t *testing.T) {
+	bt, _ := newTestBeat("192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4")
+	priorities := map[string]int{"192.0.2.1": -1, "192.0.2.3": 10, "192.0.2.4": 5}
+	for addr, priority := range priorities {
+		target := bt.targets[addr]
+		target.Priority = priority
+		bt.targets[addr] = target
+	}
+
+	// With a single worker, pings are sent in the order they are queued
+	var queued []string
+	batch := pool.NewLimited(1).Batch()
+	go bt.queuePings(batch, NewPingState(), func(ip string, target Target) pool.WorkFunc {
+		queued = append(queued, ip)
+		return func(wu pool.WorkUnit) (interface{}, error) {
+			return ip, nil
+		}
+	})
+	for range batch.Results() {
+	}
+	expected := []string{"192.0.2.3", "192.0.2.4", "192.0.2.2", "192.0.2.1"}
+	if fmt.Sprint(queued) != fmt.Sprint(expected) {
+		t.Errorf("expected pings queued in order %v, got %v", expected, queued)
+	}
+}
+
+func TestEventSeq(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+
+	bt.ProcessPing(&PingInfo{Seq: 11, Target: "192.0.2.1", RTT: time.Millisecond})
+	if event := client.next(t); event["seq"] != 11 {
+		t.Errorf("expected seq 11 on reply event, got %v", event["seq"])
+	}
+
+	state := NewPingState()
+	state.AddPing("192.0.2.1", 12, time.Now().UTC(), 0)
+	for _, ping := range state.CleanPings(0) {
+		bt.ProcessPing(ping)
+	}
+	if event := client.next(t); event["seq"] != 12 {
+		t.Errorf("expected seq 12 on timeout event, got %v", event["seq"])
+	}
+
+	// The sequence number of ICMP errors comes from the quoted echo request
+	echo, err := marshalEcho(ipv4.ICMPTypeEcho, 0xbeef, 13, defaultPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := (&ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(echo),
+		TTL:      1,
+		Protocol: 1,
+		Src:      net.ParseIP("192.0.2.100"),
+		Dst:      net.ParseIP("192.0.2.1"),
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping := &PingInfo{Loss: true, LossReason: "Time Exceeded"}
+	if ping.ID, ping.Seq, ping.Target, err = parseICMPError(ipv4.ICMPTypeEcho, append(header, echo...)); err != nil {
+		t.Fatal(err)
+	}
+	bt.ProcessPing(ping)
+	if event := client.next(t); event["seq"] != 13 {
+		t.Errorf("expected seq 13 on ICMP error event, got %v", event["seq"])
+	}
+}
+
+func TestPingsPerPeriod(t *testing.T) {
+	if conn, err := createConn("ip4:icmp", "127.0.0.1"); err != nil {
+		t.Skipf("cannot open raw ICMP socket: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"privileged":     true,
+		"useipv6":        false,
+		"period":         "100ms",
+		"timeout":        "1s",
+		"count":          2,
+		"pingsperperiod": 3,
+		"targets":        []map[string]interface{}{{"name": "127.0.0.1"}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt := b.(*Pingbeat)
+	client := newTestClient()
+	if err := bt.Run(&beat.Beat{Publisher: testPublisher{client}}); err != nil {
+		t.Errorf("expected no loss on loopback, got %v", err)
+	}
+
+	seqs := make(map[interface{}]bool)
+	for len(client.events) > 0 {
+		event := <-client.events
+		if event["type"] == "pingbeat" && event["duplicate"] != true {
+			seqs[event["seq"]] = true
+		}
+	}
+	if len(seqs) != 6 {
+		t.Errorf("expected 3 pings with distinct sequence numbers per period, got %v", seqs)
+	}
+}
+
+func TestNewPingsPerPeriod(t *testing.T) {
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"pingsperperiod": 0})); err == nil {
+		t.Error("expected pingsperperiod of 0 to be rejected")
+	}
+	// 3 targets with 5 periods per timeout can't have 5000 pings each
+	// outstanding
+	_, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"pingsperperiod": 5000,
+		"targets": []map[string]interface{}{
+			{"name": "192.0.2.1"}, {"name": "192.0.2.2"}, {"name": "192.0.2.3"},
+		},
+	}))
+	if err == nil {
+		t.Error("expected sequence numbers wrapping within the timeout to be rejected")
+	}
+}
+
+func TestParsePing(t *testing.T) {
+	marshal := func(message *icmp.Message) []byte {
+		b, err := message.Marshal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	received := time.Now().UTC()
+
+	reply := marshal(&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 0xbeef, Seq: 3}})
+	ping, err := parsePing(ipv4.ICMPTypeEcho, reply, "192.0.2.1", 64, received)
+	if err != nil || ping == nil {
+		t.Fatalf("expected a ping from an echo reply, got %v (%v)", ping, err)
+	}
+	if ping.Loss || ping.ID != 0xbeef || ping.Seq != 3 || ping.Target != "192.0.2.1" || ping.TTL != 64 || ping.Received != received {
+		t.Errorf("unexpected ping from echo reply: %+v", ping)
+	}
+
+	// Raw sockets receive echo requests too, e.g. our own to local targets
+	for _, typ := range []icmp.Type{ipv4.ICMPTypeEcho, ipv6.ICMPTypeEchoRequest} {
+		pingType := icmp.Type(ipv4.ICMPTypeEcho)
+		if typ.Protocol() == ipv6.ICMPTypeEchoRequest.Protocol() {
+			pingType = ipv6.ICMPTypeEchoRequest
+		}
+		request := marshal(&icmp.Message{Type: typ, Body: &icmp.Echo{ID: 0xbeef, Seq: 3}})
+		if ping, err := parsePing(pingType, request, "192.0.2.1", 64, received); err != nil || ping != nil {
+			t.Errorf("expected %v to be ignored, got %v (%v)", typ, ping, err)
+		}
+	}
+
+	exceeded := marshal(&icmp.Message{
+		Type: ipv4.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{Data: quotedEcho(t, "192.0.2.1", 0xbeef, 3)},
+	})
+	ping, err = parsePing(ipv4.ICMPTypeEcho, exceeded, "198.51.100.1", 250, received)
+	if err != nil || ping == nil {
+		t.Fatalf("expected a ping from a time exceeded error, got %v (%v)", ping, err)
+	}
+	if !ping.Loss || ping.LossReason != "Time Exceeded" || ping.ID != 0xbeef || ping.Seq != 3 || ping.Target != "192.0.2.1" {
+		t.Errorf("unexpected ping from time exceeded error: %+v", ping)
+	}
+
+	redirect := marshal(&icmp.Message{Type: ipv4.ICMPTypeRedirect, Body: &icmp.DefaultMessageBody{Data: []byte{0, 0, 0, 0}}})
+	if ping, err := parsePing(ipv4.ICMPTypeEcho, redirect, "192.0.2.1", 64, received); err != nil || ping != nil {
+		t.Errorf("expected a redirect to be ignored, got %v (%v)", ping, err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.config.DryRun = true
+	var out bytes.Buffer
+	bt.out = &out
+
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 1, RTT: 1500 * time.Microsecond})
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 2, Loss: true, LossReason: "Timeout"})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 events written, got %q", out.String())
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event["rtt"] != 1.5 || event["seq"] != float64(1) {
+		t.Errorf("unexpected event written: %v", event)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event["reason"] != "Timeout" {
+		t.Errorf("unexpected event written: %v", event)
+	}
+	select {
+	case event := <-client.events:
+		t.Errorf("dry run published event %v", event)
+	default:
+	}
+}
+
+func TestProcessPingOrder(t *testing.T) {
+	const targets, pings = 50, 200
+	var addrs []string
+	for i := 1; i <= targets; i++ {
+		addrs = append(addrs, fmt.Sprintf("192.0.2.%d", i))
+	}
+	bt, client := newTestBeat(addrs...)
+	client.events = make(chan common.MapStr, targets*pings)
+	goroutines := runtime.NumGoroutine()
+
+	for seq := 0; seq < pings; seq++ {
+		for _, addr := range addrs {
+			bt.processPing(&PingInfo{Target: addr, Seq: seq, RTT: time.Millisecond})
+		}
+	}
+	bt.processing.Wait()
+	if len(client.events) != targets*pings {
+		t.Fatalf("expected %d events, got %d", targets*pings, len(client.events))
+	}
+	next := make(map[interface{}]int)
+	for i := 0; i < targets*pings; i++ {
+		event := <-client.events
+		addr := event["target"].(common.MapStr)["addr"]
+		if event["seq"] != next[addr] {
+			t.Fatalf("expected seq %d from %v, got %v", next[addr], addr, event["seq"])
+		}
+		next[addr]++
+	}
+
+	close(bt.drained)
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("expected workers to stop once drained, %d goroutines left of %d", n, goroutines)
+	}
+}
+
+func TestEventType(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.config.EventType = "pingbeat_dc1"
+
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 1, RTT: time.Millisecond})
+	if event := client.next(t); event["type"] != "pingbeat_dc1" {
+		t.Errorf("expected configured type in reply event, got %v", event["type"])
+	}
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 2, Loss: true, LossReason: "Timeout"})
+	if event := client.next(t); event["type"] != "pingbeat_dc1" {
+		t.Errorf("expected configured type in loss event, got %v", event["type"])
+	}
+
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"eventtype": ""})); err == nil {
+		t.Error("expected empty eventtype to be rejected")
+	}
+}
+
+func TestParsePacketTooBig(t *testing.T) {
+	received := time.Now().UTC()
+
+	// IPv4 routers report the MTU in the second half of the otherwise unused
+	// header field of a fragmentation needed error
+	b, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeDestinationUnreachable,
+		Code: fragmentationNeeded,
+		Body: &icmp.DstUnreach{Data: quotedEcho(t, "192.0.2.1", 0xbeef, 7)},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint16(b[6:], 1400)
+	ping, err := parsePing(ipv4.ICMPTypeEcho, b, "198.51.100.1", 64, received)
+	if err != nil || ping == nil {
+		t.Fatalf("expected fragmentation needed to be parsed, got %v (%v)", ping, err)
+	}
+	if !ping.Loss || ping.LossReason != "Packet Too Big" || ping.MTU != 1400 || ping.Target != "192.0.2.1" || ping.Seq != 7 {
+		t.Errorf("unexpected ping %+v", ping)
+	}
+
+	bt, client := newTestBeat("192.0.2.1")
+	bt.ProcessPing(ping)
+	if event := client.next(t); event["mtu"] != 1400 || event["reason"] != "Packet Too Big" {
+		t.Errorf("expected mtu 1400 in loss event, got %v", event)
+	}
+
+	// Other unreachable errors carry no MTU
+	b, err = (&icmp.Message{
+		Type: ipv4.ICMPTypeDestinationUnreachable,
+		Code: 1,
+		Body: &icmp.DstUnreach{Data: quotedEcho(t, "192.0.2.1", 0xbeef, 8)},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping, err = parsePing(ipv4.ICMPTypeEcho, b, "198.51.100.1", 64, received); err != nil || ping.MTU != 0 {
+		t.Errorf("expected host unreachable without an MTU, got %+v (%v)", ping, err)
+	}
+
+	echo, err := marshalEcho(ipv6.ICMPTypeEchoRequest, 0xbeef, 9, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []byte{
+		0x60, 0x00, 0x00, 0x00, 0x00, byte(len(echo)), 58, 64,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x02,
+	}
+	b, err = (&icmp.Message{
+		Type: ipv6.ICMPTypePacketTooBig,
+		Body: &icmp.PacketTooBig{MTU: 1280, Data: append(header, echo...)},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping, err = parsePing(ipv6.ICMPTypeEchoRequest, b, "2001:db8::ff", 64, received)
+	if err != nil || ping == nil {
+		t.Fatalf("expected packet too big to be parsed, got %v (%v)", ping, err)
+	}
+	if !ping.Loss || ping.LossReason != "Packet Too Big" || ping.MTU != 1280 || ping.Target != "2001:db8::2" || ping.Seq != 9 {
+		t.Errorf("unexpected ping %+v", ping)
+	}
+}
+
+// flakyConn is a net.PacketConn whose first writes fail
+type flakyConn struct {
+	net.PacketConn
+	failures int
+	writes   int
+}
+
+func (c *flakyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.writes++
+	if c.writes <= c.failures {
+		return 0, syscall.ENOBUFS
+	}
+	return len(b), nil
+}
+
+func TestSendPingRetry(t *testing.T) {
+	echo, err := NewEchoPacket(ipv4.ICMPTypeEcho, 0xbeef, defaultPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+	send := func(conn net.PacketConn, retries int, timeout time.Duration) (*PingInfo, *PingState, error) {
+		state := NewPingState()
+		wu := pool.New().Queue(SendPing(conn, timeout, echo, 1, retries, addr, state))
+		wu.Wait()
+		return wu.Value().(*PingInfo), state, wu.Error()
+	}
+
+	conn := &flakyConn{failures: 2}
+	ping, state, err := send(conn, 2, time.Second)
+	if err != nil || ping.Loss {
+		t.Fatalf("expected send to succeed on the last retry, got %+v (%v)", ping, err)
+	}
+	if conn.writes != 3 || state.Pending() != 1 {
+		t.Errorf("expected 3 writes and a pending request, got %d writes and %d pending", conn.writes, state.Pending())
+	}
+
+	conn = &flakyConn{failures: 3}
+	ping, state, err = send(conn, 2, time.Second)
+	if err == nil || !ping.Loss || ping.LossReason != "Send failed" {
+		t.Fatalf("expected send failure once out of retries, got %+v (%v)", ping, err)
+	}
+	if conn.writes != 3 || state.Pending() != 0 {
+		t.Errorf("expected 3 writes and no pending request, got %d writes and %d pending", conn.writes, state.Pending())
+	}
+
+	// Retries must leave time for a reply
+	conn = &flakyConn{failures: 3}
+	if ping, _, _ = send(conn, 2, sendRetryBackoff/2); !ping.Loss || conn.writes != 1 {
+		t.Errorf("expected no retries past the timeout, got %d writes", conn.writes)
+	}
+}
+
+func TestPingFuncMissingFamily(t *testing.T) {
+	bt, _ := newTestBeat("192.0.2.1", "2001:db8::1")
+	bt.targets["2001:db8::1"] = Target{
+		Addr:     &net.IPAddr{IP: net.ParseIP("2001:db8::1")},
+		Name:     "2001:db8::1",
+		Protocol: "icmp",
+		IPv6:     true,
+	}
+	echo, err := NewEchoPacket(ipv6.ICMPTypeEchoRequest, 0xbeef, defaultPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only IPv6 is enabled, so there is no IPv4 connection
+	ping := bt.pingFunc(NewPingState(), 0xbeef, nil, nil, &socket{conn: &icmp.PacketConn{}}, echo)
+	if work := ping("192.0.2.1", bt.targets["192.0.2.1"]); work != nil {
+		t.Error("expected IPv4 target to be skipped without an IPv4 connection")
+	}
+	if work := ping("2001:db8::1", bt.targets["2001:db8::1"]); work == nil {
+		t.Error("expected IPv6 target to be pinged")
+	}
+
+	delete(bt.targets, "2001:db8::1")
+	batch := pool.New().Batch()
+	go bt.queuePings(batch, NewPingState(), ping)
+	for result := range batch.Results() {
+		t.Errorf("expected no pings queued, got %v (%v)", result.Value(), result.Error())
+	}
+}
+
+func TestParseICMPErrorTruncated(t *testing.T) {
+	quoted := quotedEcho(t, "192.0.2.1", 0xbeef, 1)
+	// Cut the quoted IPv4 header short, the error body is still well formed
+	b, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{Data: quoted[:icmpHeaderLen+12]},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping, err := parsePing(ipv4.ICMPTypeEcho, b, "198.51.100.1", 64, time.Now())
+	if err == nil || ping != nil {
+		t.Errorf("expected truncated quoted packet to be rejected, got %+v (%v)", ping, err)
+	}
+	if _, _, _, err := parseICMPError(ipv4.ICMPTypeEcho, quoted); err != nil {
+		t.Errorf("expected whole quoted packet to be parsed, got %v", err)
+	}
+}
+
+func TestParseICMPErrorShortBuffers(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	v4 := quotedEcho(t, "192.0.2.1", 0xbeef, 1)
+	for n := 0; n < len(v4); n++ {
+		if _, _, _, err := parseICMPError(ipv4.ICMPTypeEcho, v4[:n]); err == nil {
+			t.Errorf("expected %d byte quoted packet to be rejected", n)
+		}
+	}
+	// A header length beyond the quoted packet
+	long := append([]byte(nil), v4...)
+	long[0] = 0x4f
+	if _, _, _, err := parseICMPError(ipv4.ICMPTypeEcho, long); err == nil {
+		t.Error("expected header longer than the quoted packet to be rejected")
+	}
+
+	for i := 0; i < 10000; i++ {
+		b := make([]byte, r.Intn(64))
+		r.Read(b)
+		if len(b) > 0 && r.Intn(2) == 0 {
+			// Mostly valid looking IPv4 headers get further
+			b[0] = 0x45
+		}
+		parseICMPError(ipv4.ICMPTypeEcho, b)
+		parseICMPError(ipv6.ICMPTypeEchoRequest, b)
+		for _, msgType := range []icmp.Type{ipv4.ICMPTypeTimeExceeded, ipv4.ICMPTypeDestinationUnreachable} {
+			if m, err := (&icmp.Message{Type: msgType, Body: &icmp.DstUnreach{Data: b}}).Marshal(nil); err == nil {
+				parsePing(ipv4.ICMPTypeEcho, m, "198.51.100.1", 64, time.Now())
+			}
+		}
+		for _, msgType := range []icmp.Type{ipv6.ICMPTypeTimeExceeded, ipv6.ICMPTypePacketTooBig} {
+			if m, err := (&icmp.Message{Type: msgType, Body: &icmp.DstUnreach{Data: b}}).Marshal(nil); err == nil {
+				parsePing(ipv6.ICMPTypeEchoRequest, m, "2001:db8::ff", 64, time.Now())
+			}
+		}
+	}
+}
+
+func TestEventRTTNanoseconds(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	rtt := 123456 * time.Nanosecond
+
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 1, RTT: rtt})
+	event := client.next(t)
+	if event["rtt_ns"] != int64(123456) {
+		t.Errorf("expected rtt_ns 123456, got %v", event["rtt_ns"])
+	}
+	if ms := event["rtt"].(float64); math.Abs(ms-float64(event["rtt_ns"].(int64))/1e6) > 1e-9 {
+		t.Errorf("rtt %v doesn't match rtt_ns %v", ms, event["rtt_ns"])
+	}
+
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 2, Loss: true, LossReason: "Timeout"})
+	if event := client.next(t); event["rtt_ns"] != nil {
+		t.Errorf("expected no rtt_ns for a lost ping, got %v", event["rtt_ns"])
+	}
+}
+
+func TestInvalidRTTEvent(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	state := NewPingState()
+	sent := time.Now()
+	state.AddPing("192.0.2.1", 1, sent, 0)
+
+	bt.handlePing(0, state, &PingInfo{Target: "192.0.2.1", Seq: 1, Received: sent.Add(-time.Second)})
+	event := client.next(t)
+	if event["rtt_invalid"] != true {
+		t.Errorf("expected reply to be flagged with an invalid RTT, got %v", event)
+	}
+	if _, found := event["rtt"]; found {
+		t.Errorf("expected no rtt for an invalid RTT, got %v", event["rtt"])
+	}
+	if _, found := event["jitter_ms"]; found {
+		t.Errorf("expected no jitter for an invalid RTT, got %v", event["jitter_ms"])
+	}
+}
+
+func TestEmitLossDisabled(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.config.EmitLoss = false
+
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 1, Loss: true, LossReason: "Timeout"})
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 2, RTT: time.Millisecond})
+	if event := client.next(t); event["seq"] != 2 || event["loss"] != nil {
+		t.Errorf("expected only the reply to be published, got %v", event)
+	}
+	select {
+	case event := <-client.events:
+		t.Errorf("unexpected event %v", event)
+	default:
+	}
+	if _, received, lost := bt.counters.get(); received != 1 || lost != 1 {
+		t.Errorf("expected the lost ping to still be counted, got %d received and %d lost", received, lost)
+	}
+}
+
+func TestLossThreshold(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.config.LossThreshold = 3
+	state := NewPingState()
+	miss := func(seq int) {
+		state.AddPing("192.0.2.1", seq, time.Now().UTC().Add(-time.Second), 0)
+		for _, ping := range state.CleanPings(time.Millisecond) {
+			bt.ProcessPing(ping)
+		}
+	}
+	noEvent := func() {
+		select {
+		case event := <-client.events:
+			t.Errorf("unexpected event %v", event)
+		default:
+		}
+	}
+
+	miss(1)
+	miss(2)
+	noEvent()
+	miss(3)
+	if event := client.next(t); event["seq"] != 3 || event["loss"] != true {
+		t.Errorf("expected a loss event for the third miss, got %v", event)
+	}
+
+	// A reply resets the count
+	state.AddResult("192.0.2.1", time.Millisecond, false)
+	miss(4)
+	noEvent()
+}
+
+func TestMaxInFlight(t *testing.T) {
+	bt, _ := newTestBeat("192.0.2.1", "192.0.2.2")
+	bt.config.PingsPerPeriod = 10
+	target := bt.targets["192.0.2.1"]
+	target.MaxInFlight = 3
+	bt.targets["192.0.2.1"] = target
+
+	// Nothing is ever answered, so pings stay in flight across periods
+	state := NewPingState()
+	ping := func(ip string, target Target) pool.WorkFunc {
+		return func(wu pool.WorkUnit) (interface{}, error) {
+			state.AddPing(ip, state.GetSeqNo(), time.Now().UTC(), 0)
+			return ip, nil
+		}
+	}
+	period := func() map[string]int {
+		sent := make(map[string]int)
+		batch := pool.New().Batch()
+		go bt.queuePings(batch, state, ping)
+		for result := range batch.Results() {
+			sent[result.Value().(string)]++
+		}
+		return sent
+	}
+
+	if sent := period(); sent["192.0.2.1"] != 3 || sent["192.0.2.2"] != 10 {
+		t.Errorf("expected 3 capped and 10 uncapped pings, got %v", sent)
+	}
+	if sent := period(); sent["192.0.2.1"] != 0 {
+		t.Errorf("expected no pings while 3 are in flight, got %d", sent["192.0.2.1"])
+	}
+	// Sequence numbers are shared by all targets, so find one to answer
+	for key := range state.Pings {
+		if key.Target == "192.0.2.1" {
+			state.DelPing(key.Target, key.Seq)
+			break
+		}
+	}
+	if sent := period(); sent["192.0.2.1"] != 1 {
+		t.Errorf("expected 1 ping once a reply freed room, got %d", sent["192.0.2.1"])
+	}
+	if _, err := addTargetErr(&targetConfig{Name: "192.0.2.1", MaxInFlight: -1}); err == nil {
+		t.Error("expected negative maxinflight to be rejected")
+	}
+}
+
+func TestPeerTargetMapped(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	tests := []struct {
+		peer net.Addr
+		want string
+	}{
+		{&net.IPAddr{IP: net.ParseIP("::ffff:192.0.2.1")}, "192.0.2.1"},
+		{&net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Zone: "eth0"}, "192.0.2.1"},
+		{&net.IPAddr{IP: net.ParseIP("192.0.2.1").To4()}, "192.0.2.1"},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "lo"}, "fe80::1%lo"},
+	}
+	for _, test := range tests {
+		target, err := peerTarget(test.peer)
+		if err != nil || target != test.want {
+			t.Errorf("%v: expected %v, got %v (%v)", test.peer, test.want, target, err)
+		}
+	}
+
+	target, _ := peerTarget(tests[0].peer)
+	if _, found := bt.lookupTarget(target); !found {
+		t.Fatalf("expected mapped address to find target 192.0.2.1")
+	}
+	bt.ProcessPing(&PingInfo{Target: target, RTT: time.Millisecond})
+	if event := client.next(t); event["target"].(common.MapStr)["name"] != "192.0.2.1" {
+		t.Errorf("expected event for 192.0.2.1, got %v", event)
+	}
+
+	if _, err := peerTarget(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}); err == nil {
+		t.Error("expected TCP peer to be rejected")
+	}
+}
+
+func TestEventTimestampSource(t *testing.T) {
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"timestampsource": "now"})); err == nil {
+		t.Error("expected an unknown timestamp source to be rejected")
+	}
+
+	sent := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	received := sent.Add(20 * time.Millisecond)
+	tests := []struct {
+		source   string
+		ping     *PingInfo
+		expected time.Time
+	}{
+		{"sent", &PingInfo{Target: "192.0.2.1", Sent: sent, Received: received, RTT: 20 * time.Millisecond}, sent},
+		{"received", &PingInfo{Target: "192.0.2.1", Sent: sent, Received: received, RTT: 20 * time.Millisecond}, received},
+		// Echo replies only know their send time from the RTT
+		{"sent", &PingInfo{Target: "192.0.2.1", Received: received, RTT: 20 * time.Millisecond}, sent},
+		// Losses fall back to the send time
+		{"received", &PingInfo{Target: "192.0.2.1", Sent: sent, Loss: true, LossReason: "Timeout"}, sent},
+	}
+	for _, test := range tests {
+		bt, client := newTestBeat("192.0.2.1")
+		bt.config.TimestampSource = test.source
+		bt.ProcessPing(test.ping)
+		if ts := time.Time(client.next(t)["@timestamp"].(common.Time)); !ts.Equal(test.expected) {
+			t.Errorf("%s: expected @timestamp %v, got %v", test.source, test.expected, ts)
+		}
+	}
+
+	bt, client := newTestBeat("192.0.2.1")
+	before := time.Now()
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Sent: sent, Received: received, RTT: 20 * time.Millisecond})
+	if ts := time.Time(client.next(t)["@timestamp"].(common.Time)); ts.Before(before) {
+		t.Errorf("expected the publish time by default, got %v", ts)
+	}
+}
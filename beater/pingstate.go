@@ -1,17 +1,20 @@
 package beater
 
 import (
+	"math"
 	"sync"
 	"time"
 
 	"github.com/elastic/beats/libbeat/logp"
-	"gopkg.in/go-playground/pool.v3"
 )
 
 // PingRecord is used to hold when a EchoRequest was sent to a target
 type PingRecord struct {
 	Target string
 	Sent   time.Time
+	// Timeout is how long the request is outstanding before it counts as
+	// lost, the timeout CleanPings is called with if zero
+	Timeout time.Duration
 }
 
 // NewPingRecord creates a new PingRecord for the given target
@@ -22,79 +25,546 @@ func NewPingRecord(target string) *PingRecord {
 	}
 }
 
+// expired returns whether the request has been outstanding for longer than
+// its timeout, or the given timeout if it has none or that is zero
+func (r *PingRecord) expired(timeout time.Duration) bool {
+	if timeout > 0 && r.Timeout > 0 {
+		timeout = r.Timeout
+	}
+	return r.Sent.Add(timeout).Before(time.Now())
+}
+
+// PingKey identifies an active EchoRequest. Sequence numbers are shared by
+// all targets, so requests are keyed by both target and sequence number
+type PingKey struct {
+	Target string
+	Seq    int
+}
+
+// PingWindow holds whether each of the most recent pings to a target was
+// lost, and the RTT of those replied to, in a ring buffer
+type PingWindow struct {
+	Results []bool
+	// RTTs holds the RTT of each result, negative for losses and replies
+	// without an RTT
+	RTTs []time.Duration
+	Next int
+	Full bool
+}
+
+// add records a result, overwriting the oldest once the window is full
+func (w *PingWindow) add(rtt time.Duration, loss bool) {
+	if loss {
+		rtt = -1
+	}
+	w.Results[w.Next] = loss
+	w.RTTs[w.Next] = rtt
+	w.Next = (w.Next + 1) % len(w.Results)
+	if w.Next == 0 {
+		w.Full = true
+	}
+}
+
+// len returns the number of results in the window
+func (w *PingWindow) len() int {
+	if w.Full {
+		return len(w.Results)
+	}
+	return w.Next
+}
+
+// Summary returns the number of pings sent and received in the window
+func (w *PingWindow) Summary() (sent int, received int) {
+	sent = w.len()
+	for _, loss := range w.Results[:sent] {
+		if !loss {
+			received++
+		}
+	}
+	return sent, received
+}
+
+// Stats returns the aggregates of the RTTs in the window
+func (w *PingWindow) Stats() RTTStats {
+	var stats RTTStats
+	for _, rtt := range w.RTTs[:w.len()] {
+		if rtt >= 0 {
+			stats.add(rtt)
+		}
+	}
+	return stats
+}
+
+// RTTStats holds running aggregates of the RTTs of a target. The variance is
+// maintained with Welford's online algorithm
+type RTTStats struct {
+	Count int
+	Min   time.Duration
+	Max   time.Duration
+	Mean  float64
+	M2    float64
+}
+
+// add updates the aggregates with a new RTT
+func (s *RTTStats) add(rtt time.Duration) {
+	s.Count++
+	if s.Count == 1 || rtt < s.Min {
+		s.Min = rtt
+	}
+	if rtt > s.Max {
+		s.Max = rtt
+	}
+	x := float64(rtt)
+	delta := x - s.Mean
+	s.Mean += delta / float64(s.Count)
+	s.M2 += delta * (x - s.Mean)
+}
+
+// Avg returns the mean RTT
+func (s RTTStats) Avg() time.Duration {
+	return time.Duration(s.Mean)
+}
+
+// StdDev returns the population standard deviation of the RTTs
+func (s RTTStats) StdDev() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return time.Duration(math.Sqrt(s.M2 / float64(s.Count)))
+}
+
+// TargetState holds the history of a target used to derive metrics across
+// pings
+type TargetState struct {
+	Window *PingWindow
+	Stats  RTTStats
+	// Replies is the number of replies received from the target
+	Replies int
+	LastRTT time.Duration
+	// Jitter is the smoothed RTT variation as defined in RFC 3550
+	Jitter time.Duration
+	// Baseline is the smoothed RTT learned from BaselineSamples replies
+	Baseline        time.Duration
+	BaselineSamples int
+	// Losses is the number of consecutive lost pings, since FirstLoss
+	Losses    int
+	FirstLoss time.Time
+	// Down is set once Losses reaches the down threshold, until a reply is
+	// received
+	Down bool
+	// Changes holds the times of the status changes within the flap window,
+	// oldest first
+	Changes []time.Time
+	// Flapping is set once the status changes too often within the flap
+	// window, until it stops changing for a whole window
+	Flapping bool
+	// Misses is the number of consecutive lost pings, reset by any reply
+	Misses int
+}
+
 // PingState is used to keep track of active EchoRequests
 type PingState struct {
-	MU      sync.RWMutex
-	Pings   map[int]*PingRecord
-	SeqNo   int
+	MU    sync.RWMutex
+	Pings map[PingKey]*PingRecord
+	// Answered holds requests that were recently replied to so duplicate
+	// replies can be recognised until they time out
+	Answered map[PingKey]*PingRecord
+	SeqNo    int
+	// PendingSeqs counts the outstanding requests using each sequence
+	// number, so numbers aren't reused until they are answered or time out
+	PendingSeqs map[int]int
+	// PendingTargets counts the outstanding requests to each target
+	PendingTargets map[string]int
+	// Timeout is how long requests are outstanding before being cleaned
+	// up, used to recognise implausible RTTs if set
 	Timeout time.Duration
+	// WindowSize is the number of results kept per target for summaries, no
+	// results are kept if zero
+	WindowSize int
+	Targets    map[string]*TargetState
 }
 
 // NewPingState initialises the PingState struct
 func NewPingState() *PingState {
 	return &PingState{
-		SeqNo: 0,
-		Pings: make(map[int]*PingRecord),
+		SeqNo:          0,
+		Pings:          make(map[PingKey]*PingRecord),
+		Answered:       make(map[PingKey]*PingRecord),
+		PendingSeqs:    make(map[int]int),
+		PendingTargets: make(map[string]int),
+		Targets:        make(map[string]*TargetState),
+	}
+}
+
+// targetState returns the state of a target, creating it if needed. The
+// caller must hold the lock
+func (p *PingState) targetState(target string) *TargetState {
+	ts, found := p.Targets[target]
+	if !found {
+		ts = &TargetState{}
+		p.Targets[target] = ts
+	}
+	return ts
+}
+
+// CalcJitter updates the jitter of a target with the RTT of a new reply and
+// returns it. There is no jitter until a second reply has been received
+func (p *PingState) CalcJitter(target string, rtt time.Duration) (time.Duration, bool) {
+	p.MU.Lock()
+	defer p.MU.Unlock()
+	ts := p.targetState(target)
+	ts.Replies++
+	if ts.Replies == 1 {
+		ts.LastRTT = rtt
+		return 0, false
+	}
+	d := rtt - ts.LastRTT
+	if d < 0 {
+		d = -d
+	}
+	ts.Jitter += (d - ts.Jitter) / 16
+	ts.LastRTT = rtt
+	return ts.Jitter, true
+}
+
+// UpdateBaseline learns the normal RTT of a target from the RTT of a new
+// reply, as a moving average weighting each reply by 1/8 like the smoothed RTT
+// of TCP. The baseline before the reply is returned, once it has been learned
+// from minBaselineSamples replies
+func (p *PingState) UpdateBaseline(target string, rtt time.Duration) (time.Duration, bool) {
+	p.MU.Lock()
+	defer p.MU.Unlock()
+	ts := p.targetState(target)
+	baseline, learned := ts.Baseline, ts.BaselineSamples >= minBaselineSamples
+	if ts.BaselineSamples == 0 {
+		ts.Baseline = rtt
+	} else {
+		ts.Baseline += (rtt - ts.Baseline) / 8
+	}
+	ts.BaselineSamples++
+	return baseline, learned
+}
+
+// UpdateStatus records whether a ping to a target was lost at the given time
+// and returns whether the target is "up" or "down". A target goes down after
+// downAfter consecutive losses and comes back up with the next reply, so
+// isolated losses don't make it flap. When the status changes, the time the
+// target was down for is also returned
+func (p *PingState) UpdateStatus(target string, loss bool, downAfter int, at time.Time) (string, time.Duration, bool) {
+	p.MU.Lock()
+	defer p.MU.Unlock()
+	ts := p.targetState(target)
+	if !loss {
+		ts.Losses = 0
+		if !ts.Down {
+			return "up", 0, false
+		}
+		ts.Down = false
+		return "up", at.Sub(ts.FirstLoss), true
+	}
+	if ts.Losses == 0 {
+		ts.FirstLoss = at
+	}
+	ts.Losses++
+	if ts.Down || ts.Losses < downAfter {
+		return statusName(ts.Down), 0, false
+	}
+	ts.Down = true
+	return "down", 0, true
+}
+
+// UpdateFlapping records whether the status of a target changed at the given
+// time and returns whether the target is flapping. A target starts flapping
+// when its status changes more than threshold times within window, and stops
+// once it has gone a whole window without changing. Whether flapping started
+// or stopped is also returned
+func (p *PingState) UpdateFlapping(target string, changed bool, at time.Time, window time.Duration, threshold int) (bool, bool) {
+	p.MU.Lock()
+	defer p.MU.Unlock()
+	ts := p.targetState(target)
+	if changed {
+		ts.Changes = append(ts.Changes, at)
+	}
+	var expired int
+	for expired < len(ts.Changes) && at.Sub(ts.Changes[expired]) > window {
+		expired++
+	}
+	ts.Changes = ts.Changes[expired:]
+	switch {
+	case !ts.Flapping && len(ts.Changes) > threshold:
+		ts.Flapping = true
+		return true, true
+	case ts.Flapping && len(ts.Changes) == 0:
+		ts.Flapping = false
+		return false, true
+	}
+	return ts.Flapping, false
+}
+
+// statusName returns the name of a target status
+func statusName(down bool) string {
+	if down {
+		return "down"
+	}
+	return "up"
+}
+
+// AddResult records the result of a completed ping to a target and returns
+// the number of consecutive pings now lost to it
+func (p *PingState) AddResult(target string, rtt time.Duration, loss bool) int {
+	p.MU.Lock()
+	defer p.MU.Unlock()
+	return p.addResult(target, rtt, loss)
+}
+
+// addResult records a result, the caller must hold the lock. A negative rtt
+// records a reply without an RTT
+func (p *PingState) addResult(target string, rtt time.Duration, loss bool) int {
+	ts := p.targetState(target)
+	if loss {
+		ts.Misses++
+	} else {
+		ts.Misses = 0
+	}
+	if p.WindowSize <= 0 {
+		return ts.Misses
+	}
+	if ts.Window == nil {
+		ts.Window = &PingWindow{
+			Results: make([]bool, p.WindowSize),
+			RTTs:    make([]time.Duration, p.WindowSize),
+		}
+	}
+	ts.Window.add(rtt, loss)
+	if !loss && rtt >= 0 {
+		ts.Stats.add(rtt)
+	}
+	return ts.Misses
+}
+
+// GetWindow returns the sent/received counts of the recent results for a
+// target
+func (p *PingState) GetWindow(target string) (sent int, received int) {
+	p.MU.RLock()
+	defer p.MU.RUnlock()
+	if ts, found := p.Targets[target]; found && ts.Window != nil {
+		return ts.Window.Summary()
+	}
+	return 0, 0
+}
+
+// GetWindowStats returns the aggregates of the recent RTTs of a target, over
+// the same results as GetWindow
+func (p *PingState) GetWindowStats(target string) RTTStats {
+	p.MU.RLock()
+	defer p.MU.RUnlock()
+	if ts, found := p.Targets[target]; found && ts.Window != nil {
+		return ts.Window.Stats()
 	}
+	return RTTStats{}
 }
 
-// GetSeqNo generates a new unique sequence number for an EchoRequest
+// GetStats returns the RTT aggregates of a target, starting new aggregates
+// afterwards if reset is set
+func (p *PingState) GetStats(target string, reset bool) RTTStats {
+	p.MU.Lock()
+	defer p.MU.Unlock()
+	ts, found := p.Targets[target]
+	if !found {
+		return RTTStats{}
+	}
+	stats := ts.Stats
+	if reset {
+		ts.Stats = RTTStats{}
+	}
+	return stats
+}
+
+// GetSeqNo generates a new unique sequence number for an EchoRequest. The
+// ICMP sequence number is 16 bits, so numbers wrap after 0xffff and skip any
+// still used by an outstanding request. New refuses configurations sending
+// more pings per timeout than there are sequence numbers, as with many
+// targets, a high pingsperperiod or a timeout of many periods, so a free
+// number is normally found straight away
 func (p *PingState) GetSeqNo() int {
+	p.MU.Lock()
+	defer p.MU.Unlock()
+	for i := 0; i < maxSeqNo; i++ {
+		s := p.nextSeqNo()
+		if p.PendingSeqs[s] == 0 {
+			return s
+		}
+	}
+	logp.Warn("All sequence numbers are in use by outstanding pings")
+	return p.nextSeqNo()
+}
+
+// nextSeqNo returns the next sequence number, wrapping after 0xffff. It must
+// be called with MU held
+func (p *PingState) nextSeqNo() int {
 	s := p.SeqNo
 	p.SeqNo++
-	// reset sequence no if we go above a 32-bit value
-	if p.SeqNo > 65535 {
+	if p.SeqNo > 0xffff {
 		logp.Debug("pingstate", "Resetting sequence number")
 		p.SeqNo = 0
 	}
 	return s
 }
 
-// AddPing adds a new request to PingState
-func (p *PingState) AddPing(target string, seq int, sent time.Time) bool {
+// AddPing adds a new request to PingState, outstanding until its timeout or
+// the timeout CleanPings is called with if zero
+func (p *PingState) AddPing(target string, seq int, sent time.Time, timeout time.Duration) bool {
 	p.MU.Lock()
-	p.Pings[seq] = &PingRecord{
-		Target: target,
-		Sent:   sent,
+	key := PingKey{target, seq}
+	if _, found := p.Pings[key]; !found {
+		p.PendingSeqs[seq]++
+		p.PendingTargets[target]++
+		expvarPending.Add(1)
+	}
+	p.Pings[key] = &PingRecord{
+		Target:  target,
+		Sent:    sent,
+		Timeout: timeout,
 	}
 	p.MU.Unlock()
 	return true
 }
 
-// DelPing removes a request from PingState
-func (p *PingState) DelPing(seq int) pool.WorkFunc {
-	return func(wu pool.WorkUnit) (interface{}, error) {
-		if wu.IsCancelled() {
-			// return values not used
-			return nil, nil
+// Pending returns the number of requests still waiting for a reply
+func (p *PingState) Pending() int {
+	p.MU.RLock()
+	defer p.MU.RUnlock()
+	return len(p.Pings)
+}
+
+// Room returns how many of n more pings can be sent to a target without
+// exceeding max outstanding requests to it. There is no limit if max is zero
+func (p *PingState) Room(target string, max int, n int) int {
+	if max <= 0 {
+		return n
+	}
+	p.MU.RLock()
+	defer p.MU.RUnlock()
+	if room := max - p.PendingTargets[target]; room < n {
+		if room < 0 {
+			return 0
 		}
-		p.MU.Lock()
-		delete(p.Pings, seq)
-		p.MU.Unlock()
-		return seq, nil
+		return room
+	}
+	return n
+}
+
+// DelPing removes a request from PingState, remembering it as answered
+func (p *PingState) DelPing(target string, seq int) {
+	p.MU.Lock()
+	key := PingKey{target, seq}
+	if record, found := p.Pings[key]; found {
+		p.Answered[key] = record
+		p.delPing(key)
+	}
+	p.MU.Unlock()
+}
+
+// CancelPing removes a request that couldn't be sent from PingState
+func (p *PingState) CancelPing(target string, seq int) {
+	p.MU.Lock()
+	if _, found := p.Pings[PingKey{target, seq}]; found {
+		p.delPing(PingKey{target, seq})
+	}
+	p.MU.Unlock()
+}
+
+// delPing removes an outstanding request. It must be called with MU held
+func (p *PingState) delPing(key PingKey) {
+	delete(p.Pings, key)
+	if p.PendingSeqs[key.Seq]--; p.PendingSeqs[key.Seq] <= 0 {
+		delete(p.PendingSeqs, key.Seq)
+	}
+	if p.PendingTargets[key.Target]--; p.PendingTargets[key.Target] <= 0 {
+		delete(p.PendingTargets, key.Target)
 	}
+	expvarPending.Add(-1)
 }
 
-// CalcPingRTT calculates the time since a request was sent, e.g., the RTT
-func (p *PingState) CalcPingRTT(seq int, received time.Time) time.Duration {
+// IsDuplicate checks whether a request was already answered and if so
+// returns the RTT of the duplicate reply
+func (p *PingState) IsDuplicate(target string, seq int, received time.Time) (time.Duration, bool) {
 	p.MU.RLock()
 	defer p.MU.RUnlock()
-	if p.Pings[seq] != nil {
-		return received.Sub(p.Pings[seq].Sent)
+	if record, found := p.Answered[PingKey{target, seq}]; found {
+		return received.Sub(record.Sent), true
 	}
-	logp.Debug("pingstate", "Ping %v not found!", seq)
-	return 0
+	return 0, false
+}
+
+// DelTarget removes all requests to a target from PingState
+func (p *PingState) DelTarget(target string) {
+	p.MU.Lock()
+	defer p.MU.Unlock()
+	for key := range p.Pings {
+		if key.Target == target {
+			p.delPing(key)
+		}
+	}
+	for key := range p.Answered {
+		if key.Target == target {
+			delete(p.Answered, key)
+		}
+	}
+	delete(p.Targets, target)
+}
+
+// CalcPingRTT calculates the time since a request was sent, e.g., the RTT.
+// An RTT that is negative, or longer than the request can be outstanding
+// before being cleaned up, can only come from the clock changing and is
+// reported as invalid. The reply still counts as received but its RTT isn't
+// recorded. Requests that aren't found, e.g. already reaped as lost, have no
+// RTT and aren't counted at all
+func (p *PingState) CalcPingRTT(target string, seq int, received time.Time) (rtt time.Duration, valid bool, found bool) {
+	p.MU.Lock()
+	defer p.MU.Unlock()
+	if record := p.Pings[PingKey{target, seq}]; record != nil {
+		rtt := received.Sub(record.Sent)
+		timeout := p.Timeout
+		if record.Timeout > 0 {
+			timeout = record.Timeout
+		}
+		if rtt < 0 || (timeout > 0 && rtt > 2*timeout) {
+			p.addResult(target, -1, false)
+			return rtt, false, true
+		}
+		p.addResult(target, rtt, false)
+		return rtt, true, true
+	}
+	logp.Debug("pingstate", "Ping %v for %v not found!", seq, target)
+	return 0, false, false
 }
 
 // CleanPings reaps requests in PingState that have timed out (i.e., no response
-// received before Pingbeat global timeout)
-func (p *PingState) CleanPings(timeout time.Duration) {
+// received before their own timeout, or the given timeout if they have none)
+// and returns them as lost pings. A zero timeout reaps every request
+func (p *PingState) CleanPings(timeout time.Duration) []*PingInfo {
 	p.MU.Lock()
 	defer p.MU.Unlock()
-	for seq, details := range p.Pings {
-		if p.Pings[seq].Sent.Add(timeout).Before(time.Now()) {
-			logp.Debug("pingstate", "CleanPings: Removing timed out packet (Seq ID: %v) for %v", seq, details.Target)
-			delete(p.Pings, seq)
+	var lost []*PingInfo
+	for key, details := range p.Pings {
+		if details.expired(timeout) {
+			logp.Debug("pingstate", "CleanPings: Removing timed out packet (Seq ID: %v) for %v", key.Seq, details.Target)
+			lost = append(lost, &PingInfo{
+				Seq:        key.Seq,
+				Target:     details.Target,
+				Sent:       details.Sent,
+				Loss:       true,
+				LossReason: "Timeout",
+				Misses:     p.addResult(details.Target, 0, true),
+			})
+			p.delPing(key)
+		}
+	}
+	for key, details := range p.Answered {
+		if details.expired(timeout) {
+			delete(p.Answered, key)
 		}
 	}
+	return lost
 }
@@ -0,0 +1,248 @@
+// +build !integration
+
+package beater
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCleanPingsSubSecondTimeout(t *testing.T) {
+	state := NewPingState()
+	timeout := 200 * time.Millisecond
+
+	state.AddPing("192.0.2.1", 1, time.Now().UTC().Add(-2*timeout), 0)
+	state.AddPing("192.0.2.2", 2, time.Now().UTC(), 0)
+
+	lost := state.CleanPings(timeout)
+	if len(lost) != 1 {
+		t.Fatalf("expected 1 lost ping, got %d", len(lost))
+	}
+	if lost[0].Target != "192.0.2.1" || lost[0].Seq != 1 {
+		t.Errorf("unexpected lost ping %+v", lost[0])
+	}
+	if !lost[0].Loss || lost[0].LossReason != "Timeout" {
+		t.Errorf("lost ping not flagged as a timeout: %+v", lost[0])
+	}
+	if _, found := state.Pings[PingKey{"192.0.2.2", 2}]; !found {
+		t.Error("ping within the timeout was reaped")
+	}
+}
+
+func TestCalcPingRTTSameSeqDifferentTargets(t *testing.T) {
+	state := NewPingState()
+	now := time.Now().UTC()
+
+	state.AddPing("192.0.2.1", 42, now.Add(-10*time.Millisecond), 0)
+	state.AddPing("192.0.2.2", 42, now.Add(-30*time.Millisecond), 0)
+
+	if rtt, _, _ := state.CalcPingRTT("192.0.2.1", 42, now); rtt != 10*time.Millisecond {
+		t.Errorf("expected 10ms RTT for 192.0.2.1, got %v", rtt)
+	}
+	if rtt, _, _ := state.CalcPingRTT("192.0.2.2", 42, now); rtt != 30*time.Millisecond {
+		t.Errorf("expected 30ms RTT for 192.0.2.2, got %v", rtt)
+	}
+
+	state.DelPing("192.0.2.1", 42)
+	if rtt, _, _ := state.CalcPingRTT("192.0.2.2", 42, now); rtt != 30*time.Millisecond {
+		t.Errorf("deleting 192.0.2.1 affected 192.0.2.2, got RTT %v", rtt)
+	}
+}
+
+func TestCalcJitter(t *testing.T) {
+	state := NewPingState()
+	rtts := []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		15 * time.Millisecond,
+		15 * time.Millisecond,
+	}
+	expected := []time.Duration{0, 625000, 898437, 842285}
+
+	for i, rtt := range rtts {
+		jitter, ok := state.CalcJitter("192.0.2.1", rtt)
+		if i == 0 {
+			if ok {
+				t.Error("first reply should have no jitter")
+			}
+			continue
+		}
+		if !ok || jitter != expected[i] {
+			t.Errorf("reply %d: expected jitter %v, got %v", i, expected[i], jitter)
+		}
+	}
+
+	if _, ok := state.CalcJitter("192.0.2.2", rtts[0]); ok {
+		t.Error("jitter shared between targets")
+	}
+}
+
+func TestPingStateConcurrentAccess(t *testing.T) {
+	state := NewPingState()
+	state.WindowSize = 10
+	targets := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+
+	var wg sync.WaitGroup
+	seen := make([]map[int]bool, 4)
+	for i := range seen {
+		seen[i] = make(map[int]bool)
+		wg.Add(1)
+		go func(seen map[int]bool) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				seq := state.GetSeqNo()
+				seen[seq] = true
+				target := targets[seq%len(targets)]
+				state.AddPing(target, seq, time.Now(), 0)
+			}
+		}(seen[i])
+	}
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			for seq := 0; seq < 4000; seq++ {
+				if rtt, _, _ := state.CalcPingRTT(target, seq, time.Now()); rtt > 0 {
+					state.CalcJitter(target, rtt)
+					state.DelPing(target, seq)
+				}
+				state.IsDuplicate(target, seq, time.Now())
+				state.UpdateStatus(target, seq%7 == 0, 3, time.Now())
+				state.GetWindow(target)
+				state.GetStats(target, seq%100 == 0)
+			}
+		}(target)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			state.CleanPings(time.Millisecond)
+			state.Pending()
+		}
+	}()
+	wg.Wait()
+
+	// Every sequence number was handed out once
+	all := make(map[int]bool)
+	for _, s := range seen {
+		for seq := range s {
+			if all[seq] {
+				t.Errorf("sequence number %d handed out twice", seq)
+			}
+			all[seq] = true
+		}
+	}
+	if len(all) != 4000 {
+		t.Errorf("expected 4000 sequence numbers, got %d", len(all))
+	}
+}
+
+func TestGetSeqNoWraparound(t *testing.T) {
+	state := NewPingState()
+	old := time.Now().Add(-time.Second)
+	// A request from before the wrap is still outstanding
+	state.AddPing("192.0.2.1", 0, old, 0)
+	state.SeqNo = 0xfffe
+
+	for _, want := range []int{0xfffe, 0xffff, 1} {
+		if seq := state.GetSeqNo(); seq != want {
+			t.Fatalf("expected sequence number %d, got %d", want, seq)
+		}
+	}
+	sent := time.Now()
+	state.AddPing("192.0.2.1", 1, sent, 0)
+
+	received := sent.Add(10 * time.Millisecond)
+	if rtt, _, _ := state.CalcPingRTT("192.0.2.1", 1, received); rtt != 10*time.Millisecond {
+		t.Errorf("expected reply to the new request to be matched to it, got RTT %v", rtt)
+	}
+	if rtt, _, _ := state.CalcPingRTT("192.0.2.1", 0, received); rtt != received.Sub(old) {
+		t.Errorf("expected reply to the old request to be matched to it, got RTT %v", rtt)
+	}
+
+	// Once answered, the number is free again
+	state.DelPing("192.0.2.1", 0)
+	state.SeqNo = 0
+	if seq := state.GetSeqNo(); seq != 0 {
+		t.Errorf("expected answered sequence number to be reused, got %d", seq)
+	}
+}
+
+func TestCalcPingRTTInvalid(t *testing.T) {
+	state := NewPingState()
+	state.WindowSize = 10
+	state.Timeout = time.Second
+	sent := time.Now()
+	state.AddPing("192.0.2.1", 1, sent, 0)
+	state.AddPing("192.0.2.1", 2, sent, 0)
+	state.AddPing("192.0.2.1", 3, sent, 0)
+
+	// The clock was stepped back between sending and receiving
+	if rtt, valid, _ := state.CalcPingRTT("192.0.2.1", 1, sent.Add(-time.Second)); valid {
+		t.Errorf("expected negative RTT %v to be invalid", rtt)
+	}
+	if rtt, valid, _ := state.CalcPingRTT("192.0.2.1", 2, sent.Add(time.Hour)); valid {
+		t.Errorf("expected RTT %v beyond the timeout to be invalid", rtt)
+	}
+	if rtt, valid, _ := state.CalcPingRTT("192.0.2.1", 3, sent.Add(time.Millisecond)); !valid || rtt != time.Millisecond {
+		t.Errorf("expected valid RTT of 1ms, got %v (%v)", rtt, valid)
+	}
+
+	// Invalid replies are received but leave the RTT statistics alone
+	if sent, received := state.GetWindow("192.0.2.1"); sent != 3 || received != 3 {
+		t.Errorf("expected 3 replies, got %d of %d", received, sent)
+	}
+	if stats := state.GetStats("192.0.2.1", false); stats.Count != 1 || stats.Min != time.Millisecond {
+		t.Errorf("expected only the valid RTT in stats, got %+v", stats)
+	}
+}
+
+func TestTargetTimeouts(t *testing.T) {
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"timeout": "1s",
+		"targets": []map[string]interface{}{
+			{"name": "192.0.2.1", "timeout": "20ms"},
+			{"name": "192.0.2.2", "timeout": "5s"},
+			{"name": "192.0.2.3"},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt := b.(*Pingbeat)
+	if shortest, longest := bt.timeouts(); shortest != 20*time.Millisecond || longest != 5*time.Second {
+		t.Errorf("expected timeouts from 20ms to 5s, got %v to %v", shortest, longest)
+	}
+
+	// Pings outstanding for 2s are only lost to the targets with a shorter
+	// timeout, pings outstanding for 50ms only to the 20ms target
+	state := NewPingState()
+	now := time.Now().UTC()
+	for addr, target := range bt.getTargets() {
+		state.AddPing(addr, 1, now.Add(-2*time.Second), bt.timeout(target))
+		state.AddPing(addr, 2, now.Add(-50*time.Millisecond), bt.timeout(target))
+	}
+	lost := make(map[PingKey]bool)
+	for _, ping := range state.CleanPings(bt.config.Timeout) {
+		lost[PingKey{ping.Target, ping.Seq}] = true
+	}
+	expected := map[PingKey]bool{
+		{"192.0.2.1", 1}: true,
+		{"192.0.2.1", 2}: true,
+		{"192.0.2.3", 1}: true,
+	}
+	if len(lost) != len(expected) {
+		t.Errorf("expected %v lost, got %v", expected, lost)
+	}
+	for key := range expected {
+		if !lost[key] {
+			t.Errorf("expected %v lost, got %v", key, lost)
+		}
+	}
+
+	if _, err := addTargetErr(&targetConfig{Name: "192.0.2.1", Timeout: -time.Second}); err == nil {
+		t.Error("expected negative timeout to be rejected")
+	}
+}
@@ -0,0 +1,31 @@
+package beater
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter paces events to a number per second. It is a token bucket that
+// holds a single token, so events are evenly spaced rather than sent in bursts
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newRateLimiter creates a rateLimiter allowing rate events per second
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{interval: time.Second / time.Duration(rate)}
+}
+
+// wait blocks until the next event is allowed
+func (r *rateLimiter) wait() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if r.next.After(now) {
+		time.Sleep(r.next.Sub(now))
+		now = r.next
+	}
+	r.next = now.Add(r.interval)
+}
@@ -0,0 +1,52 @@
+// +build !integration
+
+package beater
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gopkg.in/go-playground/pool.v3"
+)
+
+func TestQueuePingsRateLimit(t *testing.T) {
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"ratelimit": -1})); err == nil {
+		t.Error("expected negative ratelimit to be rejected")
+	}
+
+	var addrs []string
+	for i := 1; i <= 40; i++ {
+		addrs = append(addrs, fmt.Sprintf("192.0.2.%d", i))
+	}
+	bt, _ := newTestBeat(addrs...)
+	rate := 200
+	bt.limiter = newRateLimiter(rate)
+
+	batch := pool.New().Batch()
+	go bt.queuePings(batch, NewPingState(), func(ip string, target Target) pool.WorkFunc {
+		sent := time.Now()
+		return func(wu pool.WorkUnit) (interface{}, error) {
+			return sent, nil
+		}
+	})
+	var sends []time.Time
+	for result := range batch.Results() {
+		sends = append(sends, result.Value().(time.Time))
+	}
+
+	var first, last time.Time
+	for _, sent := range sends {
+		if first.IsZero() || sent.Before(first) {
+			first = sent
+		}
+		if sent.After(last) {
+			last = sent
+		}
+	}
+	// n pings paced at the limit take n-1 intervals
+	effective := float64(len(sends)-1) / last.Sub(first).Seconds()
+	if effective > float64(rate)*1.05 {
+		t.Errorf("expected at most %v pings/s, sent %.1f pings/s", rate, effective)
+	}
+}
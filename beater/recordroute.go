@@ -0,0 +1,59 @@
+package beater
+
+import (
+	"net"
+)
+
+const (
+	// ipOptRR is the type of the IPv4 Record Route option
+	ipOptRR = 7
+	// maxRouteHops is the number of addresses that fit in a Record Route
+	// option, as IPv4 options are limited to 40 bytes
+	maxRouteHops = 9
+)
+
+// recordRouteOption returns the IPv4 options of a packet recording its route,
+// with room for maxRouteHops addresses and padded to a multiple of 4 bytes
+func recordRouteOption() []byte {
+	length := 3 + 4*maxRouteHops
+	opt := make([]byte, length+1)
+	opt[0] = ipOptRR
+	opt[1] = byte(length)
+	// The pointer is where the next address is recorded, counting from 1
+	opt[2] = 4
+	return opt
+}
+
+// parseRecordRoute returns the addresses recorded in the Record Route option
+// of IPv4 options, or nil if there is none
+func parseRecordRoute(opts []byte) []net.IP {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0:
+			// End of options
+			return nil
+		case 1:
+			// No operation, used for padding
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			return nil
+		}
+		opt := opts[:opts[1]]
+		opts = opts[opts[1]:]
+		if opt[0] != ipOptRR || len(opt) < 3 {
+			continue
+		}
+		end := int(opt[2]) - 1
+		if end > len(opt) {
+			end = len(opt)
+		}
+		var route []net.IP
+		for i := 3; i+4 <= end; i += 4 {
+			route = append(route, net.IPv4(opt[i], opt[i+1], opt[i+2], opt[i+3]))
+		}
+		return route
+	}
+	return nil
+}
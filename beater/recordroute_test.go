@@ -0,0 +1,165 @@
+// +build !integration
+
+package beater
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestParseRecordRoute(t *testing.T) {
+	option := recordRouteOption()
+	if len(option)%4 != 0 || option[0] != ipOptRR || option[1] != 39 || option[2] != 4 {
+		t.Errorf("unexpected record route option % x", option)
+	}
+
+	tests := []struct {
+		opts  []byte
+		route []string
+	}{
+		{nil, nil},
+		{[]byte{0, 0, 0, 0}, nil},
+		// Empty route
+		{[]byte{7, 11, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0}, nil},
+		// Two of three slots filled, after a no-op
+		{[]byte{1, 7, 15, 12, 192, 0, 2, 1, 198, 51, 100, 1, 0, 0, 0, 0}, []string{"192.0.2.1", "198.51.100.1"}},
+		// Full route, the pointer is past the end of the option
+		{[]byte{7, 7, 8, 192, 0, 2, 1, 0}, []string{"192.0.2.1"}},
+		// Truncated option
+		{[]byte{7, 39, 4}, nil},
+	}
+	for _, test := range tests {
+		var route []string
+		for _, hop := range parseRecordRoute(test.opts) {
+			route = append(route, hop.String())
+		}
+		if !reflect.DeepEqual(route, test.route) {
+			t.Errorf("% x: expected route %v, got %v", test.opts, test.route, route)
+		}
+	}
+}
+
+func TestRecordRoute(t *testing.T) {
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"recordroute": true})); err == nil {
+		t.Error("expected recordroute without privileged mode to be rejected")
+	}
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"privileged":  true,
+		"recordroute": true,
+	}))
+	if err != nil {
+		t.Skipf("cannot create privileged pingbeat: %v", err)
+	}
+	bt := b.(*Pingbeat)
+	conn, err := bt.openConn(bt.ipv4network, "127.0.0.1")
+	if err != nil {
+		t.Skipf("cannot open connection with record route: %v", err)
+	}
+	defer conn.Close()
+	// A second raw socket sees the sent request with its IP header
+	c, err := net.ListenPacket("ip4:icmp", "127.0.0.1")
+	if err != nil {
+		t.Skipf("cannot open raw ICMP socket: %v", err)
+	}
+	defer c.Close()
+	capture, err := ipv4.NewRawConn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := &icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: 4545, Seq: 1, Data: defaultPayload},
+	}
+	wb, err := message.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(wb, &net.IPAddr{IP: net.ParseIP("127.0.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	capture.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, minRecvBufferSize)
+	for {
+		header, payload, _, err := capture.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("no echo request captured: %v", err)
+		}
+		if m, err := icmp.ParseMessage(1, payload); err != nil || m.Type != ipv4.ICMPTypeEcho {
+			continue
+		}
+		if len(header.Options) < 2 || header.Options[0] != ipOptRR || header.Options[1] != 39 {
+			t.Errorf("expected a record route option on the request, got % x", header.Options)
+		}
+		break
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, _, _, _, route, err := readFrom(conn, buf)
+		if err != nil {
+			t.Fatalf("no echo reply received: %v", err)
+		}
+		if m, err := icmp.ParseMessage(1, buf[:n]); err != nil || m.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if len(route) == 0 || !route[0].Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("expected the route through loopback recorded, got %v", route)
+		}
+		break
+	}
+}
+
+func TestRecordRouteLargePayload(t *testing.T) {
+	// The reply carries a full 60 byte IP header besides the payload, which
+	// the receive buffer must have room for
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"privileged":  true,
+		"recordroute": true,
+		"packetsize":  65000,
+	}))
+	if err != nil {
+		t.Skipf("cannot create privileged pingbeat: %v", err)
+	}
+	bt := b.(*Pingbeat)
+	conn, err := bt.openConn(bt.ipv4network, "127.0.0.1")
+	if err != nil {
+		t.Skipf("cannot open connection with record route: %v", err)
+	}
+	defer conn.Close()
+
+	message := &icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: 4546, Seq: 1, Data: bt.payload},
+	}
+	wb, err := message.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(wb, &net.IPAddr{IP: net.ParseIP("127.0.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, bt.recvBufferSize())
+	for {
+		n, _, _, _, _, _, err := readFrom(conn, buf)
+		if err != nil {
+			t.Fatalf("no echo reply received: %v", err)
+		}
+		m, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || m.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := m.Body.(*icmp.Echo); !ok || echo.ID != 4546 || len(echo.Data) != len(bt.payload) {
+			t.Errorf("expected the full %d byte payload in the reply, got %d bytes", len(bt.payload), n-icmpHeaderLen)
+		}
+		break
+	}
+}
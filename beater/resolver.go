@@ -0,0 +1,54 @@
+package beater
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// resolverTimeout bounds how long looking up a hostname target can take when
+// using a configured resolver
+const resolverTimeout = 5 * time.Second
+
+// resolverAddr validates the address of a DNS server, which must be an IP
+// address with an optional port, defaulting to 53
+func resolverAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, strconv.Itoa(defaultDNSPort)
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("resolver %s must be an IP address", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port %s for resolver %s", port, addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// resolverLookup returns a lookup sending every query to the DNS server at
+// addr, rather than those the system is configured with
+func resolverLookup(addr string) func(string) ([]net.IP, error) {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	return func(name string) ([]net.IP, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), resolverTimeout)
+		defer cancel()
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		ips := make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = addr.IP
+		}
+		return ips, nil
+	}
+}
@@ -0,0 +1,63 @@
+package beater
+
+import (
+	"sync"
+	"time"
+)
+
+// schedule tracks when each target is next due to be pinged, for targets
+// pinged at their own interval rather than every period
+type schedule struct {
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+func newSchedule() *schedule {
+	return &schedule{next: make(map[string]time.Time)}
+}
+
+// due reports whether the target at addr is due to be pinged at now, and if
+// so schedules its next ping an interval later. Pings are due up to half a
+// tick early, so ticker jitter doesn't delay them by a whole tick
+func (s *schedule) due(addr string, interval time.Duration, tick time.Duration, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next, found := s.next[addr]
+	if found && now.Add(tick/2).Before(next) {
+		return false
+	}
+	// Keep to the interval rather than drifting with each tick, unless
+	// pings fell behind by more than an interval
+	if !found || now.Sub(next) > interval {
+		next = now
+	}
+	s.next[addr] = next.Add(interval)
+	return true
+}
+
+// retain forgets targets that are no longer pinged
+func (s *schedule) retain(targets map[string]Target) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr := range s.next {
+		if _, found := targets[addr]; !found {
+			delete(s.next, addr)
+		}
+	}
+}
+
+// scheduleTick returns how often targets must be checked for pings due to
+// keep to the period and every interval, which is their greatest common
+// divisor but no less than minPeriod
+func scheduleTick(period time.Duration, intervals []time.Duration) time.Duration {
+	tick := period
+	for _, interval := range intervals {
+		for interval != 0 {
+			tick, interval = interval, tick%interval
+		}
+	}
+	if tick < minPeriod {
+		return minPeriod
+	}
+	return tick
+}
@@ -0,0 +1,98 @@
+// +build !integration
+
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/go-playground/pool.v3"
+)
+
+func TestScheduleTick(t *testing.T) {
+	tests := []struct {
+		intervals []time.Duration
+		tick      time.Duration
+	}{
+		{nil, time.Second},
+		{[]time.Duration{5 * time.Second}, time.Second},
+		{[]time.Duration{500 * time.Millisecond}, 500 * time.Millisecond},
+		{[]time.Duration{1500 * time.Millisecond, time.Minute}, 500 * time.Millisecond},
+		// Ticking every millisecond would just burn CPU
+		{[]time.Duration{1001 * time.Millisecond}, minPeriod},
+	}
+	for _, test := range tests {
+		if tick := scheduleTick(time.Second, test.intervals); tick != test.tick {
+			t.Errorf("%v: expected tick %v, got %v", test.intervals, test.tick, tick)
+		}
+	}
+}
+
+func TestTargetIntervals(t *testing.T) {
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"period": "100ms",
+		"targets": []map[string]interface{}{
+			{"name": "192.0.2.1", "interval": "20ms"},
+			{"name": "192.0.2.2"},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt := b.(*Pingbeat)
+	if bt.tick != 20*time.Millisecond || bt.schedule == nil {
+		t.Fatalf("expected a 20ms schedule tick, got %v", bt.tick)
+	}
+
+	// Each target is pinged at its own rate over a second of ticks, with
+	// some jitter in the ticks
+	start := time.Now()
+	pinged := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		now := start.Add(time.Duration(i)*bt.tick + time.Duration(i%3)*time.Millisecond)
+		for addr, target := range bt.getTargets() {
+			if bt.schedule.due(addr, bt.interval(target), bt.tick, now) {
+				pinged[target.Name]++
+			}
+		}
+	}
+	if pinged["192.0.2.1"] != 50 || pinged["192.0.2.2"] != 10 {
+		t.Errorf("expected 50 and 10 pings, got %v", pinged)
+	}
+
+	// queuePings only queues pings due
+	queued := func() map[string]int {
+		sent := make(map[string]int)
+		batch := pool.New().Batch()
+		go bt.queuePings(batch, NewPingState(), func(ip string, target Target) pool.WorkFunc {
+			return func(wu pool.WorkUnit) (interface{}, error) {
+				return ip, nil
+			}
+		})
+		for result := range batch.Results() {
+			sent[result.Value().(string)]++
+		}
+		return sent
+	}
+	bt.schedule = newSchedule()
+	if sent := queued(); sent["192.0.2.1"] != 1 || sent["192.0.2.2"] != 1 {
+		t.Errorf("expected both targets pinged first, got %v", sent)
+	}
+	time.Sleep(bt.tick)
+	if sent := queued(); sent["192.0.2.1"] != 1 || sent["192.0.2.2"] != 0 {
+		t.Errorf("expected only the 20ms target pinged a tick later, got %v", sent)
+	}
+}
+
+func TestTargetIntervalInvalid(t *testing.T) {
+	if _, err := addTargetErr(&targetConfig{Name: "192.0.2.1", Interval: time.Millisecond}); err == nil {
+		t.Error("expected interval shorter than the minimum period to be rejected")
+	}
+	_, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"count":   3,
+		"targets": []map[string]interface{}{{"name": "192.0.2.1", "interval": "1s"}},
+	}))
+	if err == nil {
+		t.Error("expected count with per-target intervals to be rejected")
+	}
+}
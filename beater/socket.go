@@ -0,0 +1,93 @@
+package beater
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/icmp"
+)
+
+// socket holds an ICMP connection that is reopened when it stops working,
+// e.g. after the interface it was bound to flapped. Senders and the receiver
+// get the current connection for each ping
+type socket struct {
+	open   func() (*icmp.PacketConn, error)
+	mu     sync.RWMutex
+	conn   *icmp.PacketConn
+	closed bool
+}
+
+// newSocket opens a connection that is reopened with open when it fails
+func newSocket(open func() (*icmp.PacketConn, error)) (*socket, error) {
+	conn, err := open()
+	if err != nil {
+		return nil, err
+	}
+	return &socket{open: open, conn: conn}, nil
+}
+
+// Conn returns the current connection
+func (s *socket) Conn() *icmp.PacketConn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conn
+}
+
+// reopen closes a connection that failed and opens a new one in its place,
+// unless it has already been replaced. If the new connection can't be opened
+// the failed one is kept, so reads keep failing until it is reopened
+func (s *socket) reopen(failed *icmp.PacketConn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.conn != failed {
+		return nil
+	}
+	failed.Close()
+	conn, err := s.open()
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// fail closes a connection a send found dead, if it is still the current
+// one, so the receiver's next read fails and it reopens the connection
+func (s *socket) fail(failed *icmp.PacketConn) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.conn == failed {
+		failed.Close()
+	}
+}
+
+// Close closes the connection for good, it isn't reopened afterwards
+func (s *socket) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return s.conn.Close()
+}
+
+// deadConn returns whether an error means the connection itself no longer
+// works, rather than a single send failing
+func deadConn(err error) bool {
+	// Errors of raw sockets are wrapped more than once
+	for unwrapped := false; !unwrapped; {
+		switch e := err.(type) {
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		default:
+			unwrapped = true
+		}
+	}
+	switch err {
+	case net.ErrClosed, syscall.EBADF, syscall.ENODEV, syscall.ENETDOWN:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+// +build !integration
+
+package beater
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+func TestDeadConn(t *testing.T) {
+	tests := []struct {
+		err  error
+		dead bool
+	}{
+		{&net.OpError{Op: "read", Err: net.ErrClosed}, true},
+		{&net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.ENETDOWN)}, true},
+		{&net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.EBADF)}, true},
+		{&net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.ENOBUFS)}, false},
+		{&net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.EHOSTUNREACH)}, false},
+	}
+	for _, test := range tests {
+		if dead := deadConn(test.err); dead != test.dead {
+			t.Errorf("%v: expected dead %v, got %v", test.err, test.dead, dead)
+		}
+	}
+}
+
+func TestRecvPingsReopen(t *testing.T) {
+	var mu sync.Mutex
+	var opens int
+	opened := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return opens
+	}
+	sock, err := newSocket(func() (*icmp.PacketConn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		conn, err := createConn("ip4:icmp", "127.0.0.1")
+		if err != nil {
+			return nil, err
+		}
+		// The first connection is dead from the start, so every read on it
+		// fails straight away
+		if opens++; opens == 1 {
+			conn.Close()
+		}
+		return conn, nil
+	})
+	if err != nil {
+		t.Skipf("cannot open raw ICMP socket: %v", err)
+	}
+	defer sock.Close()
+
+	bt, client := newTestBeat("127.0.0.1")
+	state := NewPingState()
+	go RecvPings(0xbeef, bt, state, sock)
+	defer close(bt.drained)
+
+	waitOpens := func(n int) {
+		deadline := time.Now().Add(2 * time.Second)
+		for opened() < n && time.Now().Before(deadline) {
+			time.Sleep(drainPollInterval)
+		}
+		if opens := opened(); opens != n {
+			t.Fatalf("expected the connection opened %d times, got %d", n, opens)
+		}
+	}
+	echo, err := NewEchoPacket(ipv4.ICMPTypeEcho, 0xbeef, defaultPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping := bt.pingFunc(state, 0xbeef, sock, echo, nil, nil)
+	send := func() error {
+		wu := pool.New().Queue(ping("127.0.0.1", bt.targets["127.0.0.1"]))
+		wu.Wait()
+		return wu.Error()
+	}
+
+	// Failing reads back off rather than spin reopening the connection
+	time.Sleep(minReopenBackoff / 2)
+	if opens := opened(); opens != 1 {
+		t.Errorf("expected no reopening before backing off, got %d opens", opens)
+	}
+	waitOpens(2)
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	if event := client.next(t); event["rtt"] == nil {
+		t.Errorf("expected a reply over the reopened connection, got %v", event)
+	}
+
+	// A send finding the connection dead has it reopened too
+	sock.Conn().Close()
+	if err := send(); err == nil {
+		t.Error("expected send on the dead connection to fail")
+	}
+	waitOpens(3)
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	if event := client.next(t); event["rtt"] == nil {
+		t.Errorf("expected a reply over the reopened connection, got %v", event)
+	}
+}
@@ -0,0 +1,65 @@
+// +build linux
+
+package beater
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/icmp"
+)
+
+// setSockopt sets an integer socket option on the connection
+func setSockopt(conn *icmp.PacketConn, level int, opt int, value int) error {
+	return sockControl(conn, func(fd int) error {
+		return syscall.SetsockoptInt(fd, level, opt, value)
+	})
+}
+
+// sockControl runs f on the socket of the connection
+func sockControl(conn *icmp.PacketConn, f func(fd int) error) error {
+	var c net.PacketConn
+	switch {
+	case conn.IPv4PacketConn() != nil:
+		c = conn.IPv4PacketConn().PacketConn
+	case conn.IPv6PacketConn() != nil:
+		c = conn.IPv6PacketConn().PacketConn
+	}
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = f(int(fd))
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// setDontFragment sets the Don't Fragment bit on IPv4 packets sent through the
+// connection, and stops IPv6 packets being fragmented by the kernel. Packets
+// larger than the path MTU are refused rather than fragmented
+func setDontFragment(conn *icmp.PacketConn) error {
+	if conn.IPv6PacketConn() != nil {
+		return setSockopt(conn, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+	}
+	return setSockopt(conn, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+}
+
+// setRecordRoute sets the Record Route option on IPv4 packets sent through the
+// connection
+func setRecordRoute(conn *icmp.PacketConn) error {
+	if conn.IPv4PacketConn() == nil {
+		return errors.New("recordroute is only supported over IPv4")
+	}
+	return sockControl(conn, func(fd int) error {
+		return syscall.SetsockoptString(fd, syscall.IPPROTO_IP, syscall.IP_OPTIONS, string(recordRouteOption()))
+	})
+}
@@ -0,0 +1,79 @@
+// +build linux,!integration
+
+package beater
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+func TestOpenConnDontFragment(t *testing.T) {
+	bt, _ := newTestBeat()
+	bt.config.DontFragment = true
+	conn, err := bt.openConn("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		t.Skipf("cannot open raw ICMP socket: %v", err)
+	}
+	defer conn.Close()
+
+	// Outgoing echo requests to loopback are also seen by raw sockets,
+	// including their IP header
+	c, err := net.ListenPacket("ip4:icmp", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sniffer, err := ipv4.NewRawConn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	echo, err := NewEchoPacket(ipv4.ICMPTypeEcho, 0xd0f7, defaultPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wu := pool.New().Queue(SendPing(conn, time.Second, echo, 1, 0, &net.IPAddr{IP: net.ParseIP("127.0.0.1")}, NewPingState()))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	sniffer.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, minRecvBufferSize)
+	for {
+		header, payload, _, err := sniffer.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("echo request not seen: %v", err)
+		}
+		message, err := icmp.ParseMessage(1, payload)
+		if err != nil || message.Type != ipv4.ICMPTypeEcho {
+			continue
+		}
+		if body, ok := message.Body.(*icmp.Echo); !ok || body.ID != 0xd0f7 {
+			continue
+		}
+		if header.Flags&ipv4.DontFragment == 0 {
+			t.Errorf("expected Don't Fragment to be set, got flags %v", header.Flags)
+		}
+		break
+	}
+
+	// The kernel must refuse to fragment rather than only preferring not to
+	sc, err := conn.IPv4PacketConn().PacketConn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mode int
+	sc.Control(func(fd uintptr) {
+		mode, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER)
+	})
+	if err != nil || mode != syscall.IP_PMTUDISC_DO {
+		t.Errorf("expected path MTU discovery mode %d, got %d (%v)", syscall.IP_PMTUDISC_DO, mode, err)
+	}
+}
@@ -0,0 +1,19 @@
+// +build !linux
+
+package beater
+
+import (
+	"errors"
+
+	"golang.org/x/net/icmp"
+)
+
+// setDontFragment is only supported on Linux
+func setDontFragment(conn *icmp.PacketConn) error {
+	return errors.New("dontfragment is only supported on Linux")
+}
+
+// setRecordRoute is only supported on Linux
+func setRecordRoute(conn *icmp.PacketConn) error {
+	return errors.New("recordroute is only supported on Linux")
+}
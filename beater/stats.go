@@ -0,0 +1,92 @@
+package beater
+
+import (
+	"expvar"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Runtime counters published at /debug/vars when the HTTP server for
+// profiling is enabled, e.g. with -httpprof
+var (
+	expvarSent     = expvar.NewInt("pingbeat.sent")
+	expvarReceived = expvar.NewInt("pingbeat.received")
+	expvarLoss     = expvar.NewInt("pingbeat.loss")
+	expvarTargets  = expvar.NewInt("pingbeat.targets")
+	expvarPending  = expvar.NewInt("pingbeat.pending")
+)
+
+// probeCounters counts the pings sent and their results since Pingbeat
+// started
+type probeCounters struct {
+	mu       sync.Mutex
+	sent     int64
+	received int64
+	lost     int64
+}
+
+// addSent counts a ping sent
+func (c *probeCounters) addSent() {
+	c.mu.Lock()
+	c.sent++
+	c.mu.Unlock()
+	expvarSent.Add(1)
+}
+
+// addResult counts a reply or lost ping
+func (c *probeCounters) addResult(loss bool) {
+	c.mu.Lock()
+	if loss {
+		c.lost++
+	} else {
+		c.received++
+	}
+	c.mu.Unlock()
+	if loss {
+		expvarLoss.Add(1)
+	} else {
+		expvarReceived.Add(1)
+	}
+}
+
+// get returns the counts of pings sent, replied to and lost
+func (c *probeCounters) get() (int64, int64, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sent, c.received, c.lost
+}
+
+// publishStats publishes an event about Pingbeat itself every StatsPeriod
+// until Pingbeat is stopped
+func (bt *Pingbeat) publishStats() {
+	ticker := time.NewTicker(bt.config.StatsPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bt.done:
+			return
+		case <-ticker.C:
+			bt.publish(bt.statsEvent())
+		}
+	}
+}
+
+// statsEvent builds the event showing Pingbeat is alive, with the number of
+// targets and pings sent, replied to and lost since it started
+func (bt *Pingbeat) statsEvent() common.MapStr {
+	sent, received, lost := bt.counters.get()
+	return common.MapStr{
+		"@timestamp": common.Time(time.Now().UTC()),
+		"type":       bt.config.EventType + "_stats",
+		"stats": common.MapStr{
+			"targets":    len(bt.getTargets()),
+			"sent":       sent,
+			"received":   received,
+			"lost":       lost,
+			"goroutines": runtime.NumGoroutine(),
+		},
+	}
+}
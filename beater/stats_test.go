@@ -0,0 +1,93 @@
+// +build !integration
+
+package beater
+
+import (
+	"expvar"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+func TestPublishStats(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1", "192.0.2.2")
+	bt.config.StatsPeriod = 20 * time.Millisecond
+
+	for seq := 0; seq < 4; seq++ {
+		bt.counters.addSent()
+	}
+	for seq := 0; seq < 3; seq++ {
+		bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: seq, RTT: time.Millisecond})
+		client.next(t)
+	}
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 0, RTT: time.Millisecond, Duplicate: true})
+	client.next(t)
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.2", Seq: 3, Loss: true, LossReason: "Timeout"})
+	client.next(t)
+
+	go bt.publishStats()
+	defer close(bt.done)
+	for i := 0; i < 3; i++ {
+		event := client.next(t)
+		if event["type"] != "pingbeat_stats" {
+			t.Fatalf("expected a stats event, got %v", event)
+		}
+		stats := event["stats"].(common.MapStr)
+		if stats["targets"] != 2 || stats["sent"] != int64(4) || stats["received"] != int64(3) || stats["lost"] != int64(1) {
+			t.Errorf("unexpected counters %v", stats)
+		}
+		if stats["goroutines"].(int) < 1 {
+			t.Errorf("expected goroutines to be counted, got %v", stats["goroutines"])
+		}
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	sent, received, loss, pending := expvarSent.Value(), expvarReceived.Value(), expvarLoss.Value(), expvarPending.Value()
+
+	bt, client := newTestBeat()
+	bt.setTargets(map[string]Target{
+		"192.0.2.1": {Addr: &net.IPAddr{IP: net.ParseIP("192.0.2.1")}, Name: "192.0.2.1", Protocol: "icmp"},
+		"192.0.2.2": {Addr: &net.IPAddr{IP: net.ParseIP("192.0.2.2")}, Name: "192.0.2.2", Protocol: "icmp"},
+	})
+	if n := expvarTargets.Value(); n != 2 {
+		t.Errorf("expected 2 targets, got %v", n)
+	}
+
+	state := NewPingState()
+	now := time.Now()
+	for seq := 0; seq < 3; seq++ {
+		state.AddPing("192.0.2.1", seq, now, 0)
+		bt.counters.addSent()
+	}
+	state.AddPing("192.0.2.1", 2, now, 0)
+	if n := expvarPending.Value() - pending; n != 3 {
+		t.Errorf("expected 3 more pending, got %v", n)
+	}
+	state.DelPing("192.0.2.1", 0)
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 0, RTT: time.Millisecond})
+	client.next(t)
+	for _, ping := range state.CleanPings(0) {
+		bt.ProcessPing(ping)
+		client.next(t)
+	}
+
+	if n := expvarSent.Value() - sent; n != 3 {
+		t.Errorf("expected 3 more sent, got %v", n)
+	}
+	if n := expvarReceived.Value() - received; n != 1 {
+		t.Errorf("expected 1 more received, got %v", n)
+	}
+	if n := expvarLoss.Value() - loss; n != 2 {
+		t.Errorf("expected 2 more lost, got %v", n)
+	}
+	if n := expvarPending.Value(); n != pending {
+		t.Errorf("expected pending back at %v, got %v", pending, n)
+	}
+	if v := expvar.Get("pingbeat.sent"); v == nil || v.String() != strconv.FormatInt(expvarSent.Value(), 10) {
+		t.Errorf("pingbeat.sent not published, got %v", v)
+	}
+}
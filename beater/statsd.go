@@ -0,0 +1,108 @@
+package beater
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const (
+	// statsdFlushInterval is how often buffered StatsD metrics are sent
+	statsdFlushInterval = time.Second
+	// statsdMaxPacketSize keeps StatsD packets within a typical MTU
+	statsdMaxPacketSize = 1432
+)
+
+// StatsD sends the results of processed pings to a StatsD server. Metrics are
+// buffered and sent in batches over UDP
+type StatsD struct {
+	conn   net.Conn
+	prefix string
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	done   chan struct{}
+}
+
+// NewStatsD creates a StatsD client sending metrics prefixed with prefix to
+// the server at addr
+func NewStatsD(addr string, prefix string) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsD{
+		conn:   conn,
+		prefix: prefix,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Start flushes the buffered metrics every interval until stopped
+func (s *StatsD) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.Flush()
+			}
+		}
+	}()
+}
+
+// Stop flushes any buffered metrics and closes the connection
+func (s *StatsD) Stop() {
+	close(s.done)
+	s.Flush()
+	s.conn.Close()
+}
+
+// Observe records a timing for a successful ping to the named target, or a
+// count for a lost one. Duplicate replies are not recorded
+func (s *StatsD) Observe(name string, ping *PingInfo) {
+	switch {
+	case ping.Loss:
+		s.add(fmt.Sprintf("%s.loss:1|c|#target:%s", s.prefix, name))
+	case !ping.Duplicate:
+		s.add(fmt.Sprintf("%s.rtt:%.3f|ms|#target:%s", s.prefix, milliSeconds(ping.RTT), name))
+	}
+}
+
+// add buffers a metric, sending the buffer first if the metric would not fit
+// in the same packet
+func (s *StatsD) add(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf.Len() > 0 && s.buf.Len()+1+len(line) > statsdMaxPacketSize {
+		s.flush()
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(line)
+}
+
+// Flush sends the buffered metrics
+func (s *StatsD) Flush() {
+	s.mu.Lock()
+	s.flush()
+	s.mu.Unlock()
+}
+
+// flush sends the buffered metrics, the caller must hold the lock
+func (s *StatsD) flush() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	if _, err := s.conn.Write(s.buf.Bytes()); err != nil {
+		logp.Debug("statsd", "Error sending metrics: %v", err)
+	}
+	s.buf.Reset()
+}
@@ -0,0 +1,47 @@
+// +build !integration
+
+package beater
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsD(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	bt, _ := newTestBeat("192.0.2.1")
+	if bt.statsd, err = NewStatsD(listener.LocalAddr().String(), "pingbeat"); err != nil {
+		t.Fatal(err)
+	}
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: 1500 * time.Microsecond})
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Loss: true, LossReason: "Timeout"})
+	bt.statsd.Stop()
+
+	// Both metrics are sent in a single packet
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, statsdMaxPacketSize)
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no statsd packet received: %v", err)
+	}
+	lines := strings.Split(string(buf[:n]), "\n")
+	expected := []string{
+		"pingbeat.rtt:1.500|ms|#target:192.0.2.1",
+		"pingbeat.loss:1|c|#target:192.0.2.1",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, lines)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], lines[i])
+		}
+	}
+}
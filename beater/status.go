@@ -0,0 +1,66 @@
+package beater
+
+import (
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// statusEvent builds the event published at the time of the ping a target
+// went down or came back up with
+func statusEvent(at time.Time, eventType string, target common.MapStr, protocol string, status string, downFor time.Duration, reason string) common.MapStr {
+	event := common.MapStr{
+		"@timestamp": common.Time(at),
+		"type":       eventType,
+		"target":     target,
+		"protocol":   protocol,
+		"state":      status,
+	}
+	if status == "up" {
+		event["duration_down_ms"] = milliSeconds(downFor)
+	} else {
+		event["reason"] = reason
+	}
+	return event
+}
+
+// flapEvent builds the event published at the time of the ping a target
+// started or stopped flapping with, with the status it is in at the time
+func flapEvent(at time.Time, eventType string, target common.MapStr, protocol string, status string, flapping bool) common.MapStr {
+	return common.MapStr{
+		"@timestamp": common.Time(at),
+		"type":       eventType,
+		"target":     target,
+		"protocol":   protocol,
+		"state":      status,
+		"flapping":   flapping,
+	}
+}
+
+// publishStatus tracks whether the target of a ping is up or down and
+// publishes an event when that changes. While a target is flapping its
+// status changes are suppressed, with a single event when flapping starts and
+// another when it stops. Events are stamped like the event of the ping
+// causing them
+func (bt *Pingbeat) publishStatus(ping *PingInfo, details Target) {
+	if bt.state == nil || bt.config.DownAfter < 1 || ping.Duplicate {
+		return
+	}
+	at := ping.Received
+	if ping.Loss || at.IsZero() {
+		at = time.Now().UTC()
+	}
+	status, downFor, changed := bt.state.UpdateStatus(ping.Target, ping.Loss, bt.config.DownAfter, at)
+	if bt.config.FlapThreshold > 0 {
+		flapping, flapChanged := bt.state.UpdateFlapping(ping.Target, changed, at, bt.config.FlapWindow, bt.config.FlapThreshold)
+		if flapChanged {
+			bt.publish(flapEvent(bt.eventTime(ping), bt.config.EventType, details.fields(ping.Target), details.Protocol, status, flapping))
+		}
+		if flapping || flapChanged {
+			return
+		}
+	}
+	if changed {
+		bt.publish(statusEvent(bt.eventTime(ping), bt.config.EventType, details.fields(ping.Target), details.Protocol, status, downFor, ping.LossReason))
+	}
+}
@@ -0,0 +1,132 @@
+// +build !integration
+
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+func TestUpdateStatus(t *testing.T) {
+	state := NewPingState()
+	start := time.Now()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+
+	// Each result and the status change it should cause, if any
+	tests := []struct {
+		loss    bool
+		status  string
+		downFor time.Duration
+	}{
+		{true, "", 0},
+		{false, "", 0},
+		{true, "", 0},
+		{true, "", 0},
+		{true, "down", 0},
+		{true, "", 0},
+		{false, "up", 4 * time.Second},
+		{false, "", 0},
+	}
+	for i, test := range tests {
+		status, downFor, changed := state.UpdateStatus("192.0.2.1", test.loss, 3, at(i+1))
+		if changed != (test.status != "") || (changed && (status != test.status || downFor != test.downFor)) {
+			t.Errorf("result %d: expected change to %q after %v, got %q after %v (changed %v)", i, test.status, test.downFor, status, downFor, changed)
+		}
+	}
+}
+
+func TestStatusEvents(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.state = NewPingState()
+	bt.config.DownAfter = 2
+	bt.config.StateOnly = true
+
+	lost := &PingInfo{Target: "192.0.2.1", Loss: true, LossReason: "Timeout"}
+	bt.ProcessPing(lost)
+	bt.ProcessPing(lost)
+	event := client.next(t)
+	if event["state"] != "down" || event["reason"] != "Timeout" {
+		t.Errorf("expected down event after a loss streak, got %v", event)
+	}
+	bt.ProcessPing(lost)
+
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: time.Millisecond, Received: time.Now().UTC()})
+	event = client.next(t)
+	if event["state"] != "up" {
+		t.Errorf("expected up event on recovery, got %v", event)
+	}
+	if down, ok := event["duration_down_ms"].(float64); !ok || down <= 0 {
+		t.Errorf("expected the time down, got %v", event["duration_down_ms"])
+	}
+
+	// Only state changes are published
+	select {
+	case event := <-client.events:
+		t.Errorf("unexpected event %v", event)
+	default:
+	}
+
+	// Changes are stamped like the event of the ping causing them
+	bt.config.TimestampSource = "sent"
+	sent := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Sent: sent, Loss: true, LossReason: "Timeout"})
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Sent: sent.Add(time.Second), Loss: true, LossReason: "Timeout"})
+	if event := client.next(t); event["@timestamp"] != common.Time(sent.Add(time.Second)) {
+		t.Errorf("expected the down event stamped %v, got %v", sent.Add(time.Second), event["@timestamp"])
+	}
+}
+
+func TestFlapping(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.state = NewPingState()
+	bt.config.DownAfter = 1
+	bt.config.StateOnly = true
+	bt.config.FlapWindow = time.Minute
+	bt.config.FlapThreshold = 3
+
+	lost := &PingInfo{Target: "192.0.2.1", Loss: true, LossReason: "Timeout"}
+	reply := func(at time.Time) *PingInfo {
+		return &PingInfo{Target: "192.0.2.1", RTT: time.Millisecond, Received: at.UTC()}
+	}
+	// The first changes are published as usual
+	for _, status := range []string{"down", "up", "down"} {
+		if status == "down" {
+			bt.ProcessPing(lost)
+		} else {
+			bt.ProcessPing(reply(time.Now()))
+		}
+		if event := client.next(t); event["state"] != status || event["flapping"] != nil {
+			t.Errorf("expected %s event, got %v", status, event)
+		}
+	}
+
+	// One change too many within the window makes the target flap, with
+	// further changes suppressed
+	bt.ProcessPing(reply(time.Now()))
+	event := client.next(t)
+	if event["flapping"] != true || event["state"] != "up" {
+		t.Errorf("expected flapping event, got %v", event)
+	}
+	for i := 0; i < 5; i++ {
+		bt.ProcessPing(lost)
+		bt.ProcessPing(reply(time.Now()))
+	}
+	select {
+	case event := <-client.events:
+		t.Errorf("unexpected event while flapping %v", event)
+	default:
+	}
+
+	// A window without changes ends the flapping
+	bt.ProcessPing(reply(time.Now().Add(2 * time.Minute)))
+	event = client.next(t)
+	if event["flapping"] != false || event["state"] != "up" {
+		t.Errorf("expected flapping to stop, got %v", event)
+	}
+	bt.ProcessPing(lost)
+	if event := client.next(t); event["state"] != "down" || event["flapping"] != nil {
+		t.Errorf("expected down event once stable, got %v", event)
+	}
+}
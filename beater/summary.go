@@ -0,0 +1,102 @@
+package beater
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// publishSummaries publishes a summary of the recent results of each target
+// every SummaryPeriod until Pingbeat is stopped
+func (bt *Pingbeat) publishSummaries(state *PingState) {
+	ticker := time.NewTicker(bt.config.SummaryPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bt.done:
+			return
+		case <-ticker.C:
+			for addr, target := range bt.getTargets() {
+				bt.PublishSummary(state, addr, target)
+			}
+		}
+	}
+}
+
+// PublishSummary publishes the loss percentage and RTT statistics over the
+// recent results of a target, along with its RTT statistics since pingbeat
+// started or the last summary
+func (bt *Pingbeat) PublishSummary(state *PingState, addr string, target Target) {
+	sent, received := state.GetWindow(addr)
+	if sent == 0 {
+		return
+	}
+	stats := state.GetWindowStats(addr)
+	total := state.GetStats(addr, bt.config.SummaryReset)
+	event := common.MapStr{
+		"@timestamp": common.Time(time.Now().UTC()),
+		"type":       bt.config.EventType + "_summary",
+		"target":     target.fields(addr),
+		"protocol":   target.Protocol,
+		"sent":       sent,
+		"received":   received,
+		"loss_pct":   lossPercent(sent, received),
+	}
+	if stats.Count > 0 {
+		event["rtt_min_ms"] = milliSeconds(stats.Min)
+		event["rtt_max_ms"] = milliSeconds(stats.Max)
+		event["rtt_avg_ms"] = milliSeconds(stats.Avg())
+		event["rtt_stddev_ms"] = milliSeconds(stats.StdDev())
+	}
+	if total.Count > 0 {
+		event["rtt_total_min_ms"] = milliSeconds(total.Min)
+		event["rtt_total_max_ms"] = milliSeconds(total.Max)
+		event["rtt_total_avg_ms"] = milliSeconds(total.Avg())
+		event["rtt_total_stddev_ms"] = milliSeconds(total.StdDev())
+	}
+	bt.publish(event)
+	logp.Debug("PublishSummary", "Published summary for %v (%v): %v/%v received", target.Name, addr, received, sent)
+}
+
+// lossPercent returns the percentage of sent pings that were not received
+func lossPercent(sent int, received int) float64 {
+	if sent == 0 {
+		return 0
+	}
+	return float64(sent-received) / float64(sent) * 100
+}
+
+// finishCount publishes a final summary for each target once count rounds of
+// pings are done, printing it too if configured. An error is returned if any
+// pings were lost
+func (bt *Pingbeat) finishCount(state *PingState) error {
+	var sent, received int
+	for addr, target := range bt.getTargets() {
+		s, r := state.GetWindow(addr)
+		sent += s
+		received += r
+		if bt.config.PrintSummary {
+			bt.printSummary(state, addr, target)
+		}
+		bt.PublishSummary(state, addr, target)
+	}
+	if received < sent {
+		return fmt.Errorf("%d of %d pings lost", sent-received, sent)
+	}
+	return nil
+}
+
+// printSummary prints the results of a target in the style of ping
+func (bt *Pingbeat) printSummary(state *PingState, addr string, target Target) {
+	sent, received := state.GetWindow(addr)
+	stats := state.GetWindowStats(addr)
+	fmt.Fprintf(bt.out, "--- %s (%s) ping statistics ---\n", target.Name, addr)
+	fmt.Fprintf(bt.out, "%d packets transmitted, %d received, %.1f%% packet loss\n",
+		sent, received, lossPercent(sent, received))
+	if stats.Count > 0 {
+		fmt.Fprintf(bt.out, "rtt min/avg/max = %.3f/%.3f/%.3f ms\n",
+			milliSeconds(stats.Min), milliSeconds(stats.Avg()), milliSeconds(stats.Max))
+	}
+}
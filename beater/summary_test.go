@@ -0,0 +1,211 @@
+// +build !integration
+
+package beater
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/publisher"
+)
+
+func TestPublishSummary(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	state := NewPingState()
+	state.WindowSize = 4
+
+	// Only the last 4 results are kept: loss, 20ms, loss, 30ms
+	state.AddResult("192.0.2.1", 10*time.Millisecond, false)
+	state.AddResult("192.0.2.1", 0, true)
+	state.AddResult("192.0.2.1", 20*time.Millisecond, false)
+	state.AddResult("192.0.2.1", 0, true)
+	state.AddResult("192.0.2.1", 30*time.Millisecond, false)
+
+	bt.PublishSummary(state, "192.0.2.1", bt.targets["192.0.2.1"])
+	event := client.next(t)
+	if event["type"] != "pingbeat_summary" {
+		t.Errorf("expected a summary event, got %v", event["type"])
+	}
+	if event["sent"] != 4 || event["received"] != 2 {
+		t.Errorf("expected 2 of 4 received, got %v of %v", event["received"], event["sent"])
+	}
+	if event["loss_pct"] != 50.0 {
+		t.Errorf("expected 50%% loss, got %v", event["loss_pct"])
+	}
+	// RTT statistics cover the same window as the loss percentage
+	if event["rtt_min_ms"] != 20.0 || event["rtt_max_ms"] != 30.0 || event["rtt_avg_ms"] != 25.0 ||
+		event["rtt_stddev_ms"] != 5.0 {
+		t.Errorf("expected 20/30/25/5ms min/max/avg/stddev RTT, got %v/%v/%v/%v",
+			event["rtt_min_ms"], event["rtt_max_ms"], event["rtt_avg_ms"], event["rtt_stddev_ms"])
+	}
+	// while the total statistics cover every reply
+	if event["rtt_total_min_ms"] != 10.0 || event["rtt_total_max_ms"] != 30.0 || event["rtt_total_avg_ms"] != 20.0 {
+		t.Errorf("expected 10/30/20ms total min/max/avg RTT, got %v/%v/%v",
+			event["rtt_total_min_ms"], event["rtt_total_max_ms"], event["rtt_total_avg_ms"])
+	}
+
+	// Losses push replies out of the window without resetting the totals
+	for i := 0; i < 4; i++ {
+		state.AddResult("192.0.2.1", 0, true)
+	}
+	bt.PublishSummary(state, "192.0.2.1", bt.targets["192.0.2.1"])
+	event = client.next(t)
+	if _, found := event["rtt_avg_ms"]; found {
+		t.Errorf("expected no RTT statistics without replies in the window, got %v", event["rtt_avg_ms"])
+	}
+	if event["rtt_total_avg_ms"] != 20.0 {
+		t.Errorf("expected 20ms total average RTT, got %v", event["rtt_total_avg_ms"])
+	}
+}
+
+func TestRTTStats(t *testing.T) {
+	state := NewPingState()
+	state.WindowSize = 10
+	for _, ms := range []int{2, 4, 4, 4, 5, 5, 7, 9} {
+		state.AddResult("192.0.2.1", time.Duration(ms)*time.Millisecond, false)
+	}
+	state.AddResult("192.0.2.1", 0, true)
+
+	stats := state.GetStats("192.0.2.1", true)
+	if stats.Count != 8 {
+		t.Errorf("expected 8 replies, got %v", stats.Count)
+	}
+	if stats.Min != 2*time.Millisecond || stats.Max != 9*time.Millisecond {
+		t.Errorf("expected 2ms/9ms min/max, got %v/%v", stats.Min, stats.Max)
+	}
+	if stats.Avg() != 5*time.Millisecond {
+		t.Errorf("expected 5ms average, got %v", stats.Avg())
+	}
+	if stats.StdDev() != 2*time.Millisecond {
+		t.Errorf("expected 2ms standard deviation, got %v", stats.StdDev())
+	}
+
+	state.AddResult("192.0.2.1", 20*time.Millisecond, false)
+	stats = state.GetStats("192.0.2.1", false)
+	if stats.Count != 1 || stats.Min != 20*time.Millisecond || stats.StdDev() != 0 {
+		t.Errorf("expected statistics to restart after reset, got %+v", stats)
+	}
+	if state.GetStats("192.0.2.1", false).Count != 1 {
+		t.Error("statistics reset without being asked to")
+	}
+}
+
+func TestPingStateWindowBookkeeping(t *testing.T) {
+	state := NewPingState()
+	state.WindowSize = 10
+	now := time.Now()
+
+	state.AddPing("192.0.2.1", 1, now.Add(-5*time.Millisecond), 0)
+	state.CalcPingRTT("192.0.2.1", 1, now)
+	state.DelPing("192.0.2.1", 1)
+	state.AddPing("192.0.2.1", 2, now.Add(-time.Minute), 0)
+	state.CleanPings(time.Second)
+
+	sent, received := state.GetWindow("192.0.2.1")
+	rttAvg := state.GetStats("192.0.2.1", false).Avg()
+	if sent != 2 || received != 1 || rttAvg != 5*time.Millisecond {
+		t.Errorf("expected 1 of 2 received with 5ms RTT, got %v of %v with %v", received, sent, rttAvg)
+	}
+}
+
+// testPublisher hands out a testClient to Run
+type testPublisher struct {
+	client *testClient
+}
+
+func (p testPublisher) Connect() publisher.Client { return p.client }
+
+func TestCountMode(t *testing.T) {
+	if conn, err := createConn("ip4:icmp", "127.0.0.1"); err != nil {
+		t.Skipf("cannot open raw ICMP socket: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"privileged":   true,
+		"useipv6":      false,
+		"period":       "100ms",
+		"timeout":      "1s",
+		"count":        2,
+		"printsummary": true,
+		"targets":      []map[string]interface{}{{"name": "127.0.0.1"}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt := b.(*Pingbeat)
+	var out bytes.Buffer
+	bt.out = &out
+	client := newTestClient()
+
+	done := make(chan error)
+	go func() {
+		done <- bt.Run(&beat.Beat{Publisher: testPublisher{client}})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected no loss on loopback, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("count mode did not finish")
+	}
+
+	var pings, summaries int
+	for len(client.events) > 0 {
+		event := <-client.events
+		switch event["type"] {
+		case "pingbeat":
+			if event["duplicate"] != true {
+				pings++
+			}
+		case "pingbeat_summary":
+			summaries++
+			if event["sent"] != 2 || event["received"] != 2 {
+				t.Errorf("expected 2 of 2 received in summary, got %v of %v", event["received"], event["sent"])
+			}
+		}
+	}
+	if pings != 2 || summaries != 1 {
+		t.Errorf("expected 2 ping events and a summary, got %v and %v", pings, summaries)
+	}
+	if !strings.Contains(out.String(), "2 packets transmitted, 2 received, 0.0% packet loss") {
+		t.Errorf("unexpected summary output:\n%s", out.String())
+	}
+}
+
+func TestSummaryOnly(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.config.SummaryOnly = true
+	state := NewPingState()
+	state.WindowSize = 10
+
+	// Pings are tracked but not published on their own
+	state.AddResult("192.0.2.1", 10*time.Millisecond, false)
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 1, RTT: 10 * time.Millisecond})
+	state.AddResult("192.0.2.1", 0, true)
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Seq: 2, Loss: true, LossReason: "Timeout"})
+
+	bt.PublishSummary(state, "192.0.2.1", bt.targets["192.0.2.1"])
+	event := client.next(t)
+	if event["type"] != "pingbeat_summary" {
+		t.Fatalf("expected only a summary event, got %v", event)
+	}
+	if event["sent"] != 2 || event["received"] != 1 {
+		t.Errorf("expected 1 of 2 received, got %v of %v", event["received"], event["sent"])
+	}
+	select {
+	case event := <-client.events:
+		t.Errorf("expected no other events, got %v", event)
+	default:
+	}
+
+	_, err := New(nil, newTestConfig(t, map[string]interface{}{"summaryonly": true}))
+	if err == nil {
+		t.Error("expected summaryonly without summaryperiod to be rejected")
+	}
+}
@@ -1,105 +1,885 @@
 package beater
 
 import (
-	"errors"
+	"bufio"
+	"fmt"
 	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/elastic/beats/libbeat/common"
 	"github.com/elastic/beats/libbeat/logp"
+	"golang.org/x/net/dns/dnsmessage"
 	"gopkg.in/go-playground/pool.v3"
 )
 
 type Target struct {
-	Addr net.Addr
-	Name string
-	Tags []string
-	Desc string
+	Addr     net.Addr
+	Host     string
+	Name     string
+	Tags     []string
+	Desc     string
+	Protocol string
+	Port     int
+	URL      string
+	// TLS is set for gRPC targets served over TLS
+	TLS bool
+	// Query and QueryType are the name and type DNS targets look up
+	Query     dnsmessage.Name
+	QueryType dnsmessage.Type
+	// Headers are sent with the requests of HTTP and gRPC targets, including
+	// any credentials
+	Headers map[string]string
+	// Fields holds custom metadata published with every event of the target
+	Fields map[string]interface{}
+	// IPv6 is set for targets with an IPv6 address, so pings are routed to
+	// the right connection without parsing the address
+	IPv6 bool
+	// Zone is the scope of a link-local IPv6 address, e.g. eth0
+	Zone string
+	// Family limits a hostname target to its "ipv4" or "ipv6" addresses,
+	// both are pinged if unset
+	Family string
+	// RTTWarn and RTTCrit override the global RTT thresholds if set
+	RTTWarn time.Duration
+	RTTCrit time.Duration
+	// BaselineRTT is the normal RTT of the target, learned from its replies
+	// if zero
+	BaselineRTT time.Duration
+	// Interval is how often the target is pinged, every period if zero
+	Interval time.Duration
+	// Timeout is how long pings to the target wait for a reply before
+	// counting as lost, the global timeout if zero
+	Timeout time.Duration
+	// MaxInFlight caps the number of unanswered pings to the target, no cap
+	// if zero
+	MaxInFlight int
+	// Priority orders the targets pinged each tick, highest first
+	Priority int
+	// Unresolved is set when a hostname target could not be re-resolved and
+	// is still using its last known address
+	Unresolved bool
+	// Dynamic is set for targets added through the API, which are kept when
+	// the configured targets are reloaded
+	Dynamic bool
 }
 
 type targetConfig struct {
-	Name string   `config:"name"`
-	Tags []string `config:"tags"`
-	Desc string   `config:"desc"`
+	// Addr is the IP address, hostname or network to ping, defaulting to
+	// Name if unset
+	Addr        string                 `config:"addr"`
+	Name        string                 `config:"name"`
+	Tags        []string               `config:"tags"`
+	Desc        string                 `config:"desc"`
+	Protocol    string                 `config:"protocol"`
+	Port        int                    `config:"port"`
+	URL         string                 `config:"url"`
+	TLS         bool                   `config:"tls"`
+	Query       string                 `config:"query"`
+	QueryType   string                 `config:"querytype"`
+	Fields      map[string]interface{} `config:"fields"`
+	Family      string                 `config:"family"`
+	RTTWarn     time.Duration          `config:"rttwarn"`
+	RTTCrit     time.Duration          `config:"rttcrit"`
+	BaselineRTT time.Duration          `config:"baselinertt"`
+	MaxInFlight int                    `config:"maxinflight"`
+	Priority    int                    `config:"priority"`
+	Interval    time.Duration          `config:"interval"`
+	Timeout     time.Duration          `config:"timeout"`
+	// Headers and credentials are sent by HTTP and gRPC targets. Secrets
+	// can be read from files instead of being set in the config
+	Headers         map[string]string `config:"headers"`
+	Username        string            `config:"username"`
+	Password        string            `config:"password"`
+	PasswordFile    string            `config:"passwordfile"`
+	BearerToken     string            `config:"bearertoken"`
+	BearerTokenFile string            `config:"bearertokenfile"`
 }
 
-func NewTargets(cfg []*common.Config, privileged bool, ipv4 bool, ipv6 bool) map[string]Target {
-	targets := make(map[string]Target)
-	t := pool.New()
-	defer t.Close()
+// fields returns the details of the target to publish in events
+func (t *Target) fields(addr string) common.MapStr {
+	target := common.MapStr{
+		"name": t.Name,
+		"addr": addr,
+		"tags": t.Tags,
+	}
+	if t.Unresolved {
+		target["unresolved"] = true
+	}
+	for key, value := range t.Fields {
+		target[key] = value
+	}
+	switch addr := t.Addr.(type) {
+	case *net.TCPAddr:
+		target["addr"] = addr.IP.String()
+		target["port"] = addr.Port
+	case *net.UDPAddr:
+		if t.Protocol == "udp" || t.Protocol == "dns" {
+			target["addr"] = addr.IP.String()
+			target["port"] = addr.Port
+		}
+	case urlAddr:
+		delete(target, "addr")
+		target["url"] = addr.String()
+	}
+	return target
+}
+
+// reservedTargetFields are the keys of the target block of events, which
+// custom fields can't override
+var reservedTargetFields = []string{"name", "addr", "tags", "port", "url", "unresolved"}
+
+// urlAddr is the address of a target that is probed by URL
+type urlAddr string
+
+func (u urlAddr) Network() string { return "http" }
+func (u urlAddr) String() string  { return string(u) }
+
+// lookupIP is used to resolve hostname targets
+var lookupIP = net.LookupIP
+
+// loadTargets builds the targets configured inline and in the targets file.
+// Targets that fail to resolve replace the pending targets
+func (bt *Pingbeat) loadTargets() (map[string]Target, error) {
+	configs := unpackTargets(bt.config.Targets)
+	if bt.config.TargetsFile != "" {
+		fileConfigs, err := readTargetsFile(bt.config.TargetsFile)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, fileConfigs...)
+	}
+	if bt.config.Consul.Service != "" {
+		consulConfigs, err := consulTargets(bt.config.Consul)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, consulConfigs...)
+	}
+	if bt.config.Kubernetes.Service != "" {
+		podConfigs, err := kubernetesTargets(bt.config.Kubernetes)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, podConfigs...)
+	}
+	targets, pending := NewTargets(configs, bt.privileges(), bt.config.UseIPv4, bt.config.UseIPv6, bt.config.MaxCIDRHosts)
+	bt.setPending(pending)
+	if len(pending) > 0 {
+		logp.Warn("Could not resolve targets %v, retrying until they resolve", pendingNames(pending))
+	}
+	return targets, nil
+}
+
+// unpackTargets reads the inline target configs
+func unpackTargets(cfg []*common.Config) []*targetConfig {
+	var configs []*targetConfig
 	for _, c := range cfg {
 		target := &targetConfig{}
-		err := c.Unpack(target)
-		if err != nil {
+		if err := c.Unpack(target); err != nil {
 			logp.Critical("Error reading target config: %v", err)
-		} else {
-			work := t.Queue(AddTarget(target, privileged, ipv4, ipv6))
-			work.Wait()
-			if err := work.Error(); err != nil {
-				logp.Err("Failed to add target %v: %v", work.Value().(*Target).Name, work.Error())
-			} else {
-				thisTarget := work.Value().(*Target)
-				if thisTarget.Addr != nil {
-					targets[thisTarget.Addr.String()] = *thisTarget
+			continue
+		}
+		configs = append(configs, target)
+	}
+	return configs
+}
+
+// readTargetsFile reads target configs from a file with one target per line,
+// in the form addr[,name[,tag1;tag2...]]. Blank lines and lines starting with
+// # are ignored
+func readTargetsFile(path string) ([]*targetConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var configs []*targetConfig
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("%s line %d: expected addr[,name[,tags]] but got %d fields", path, line, len(fields))
+		}
+		target := &targetConfig{Addr: strings.TrimSpace(fields[0])}
+		if target.Addr == "" {
+			return nil, fmt.Errorf("%s line %d: missing address", path, line)
+		}
+		if len(fields) > 1 {
+			target.Name = strings.TrimSpace(fields[1])
+		}
+		if target.Name == "" {
+			target.Name = target.Addr
+		}
+		if len(fields) > 2 {
+			for _, tag := range strings.Split(fields[2], ";") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					target.Tags = append(target.Tags, tag)
 				}
 			}
 		}
+		configs = append(configs, target)
 	}
-	return targets
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// NewTargets builds the targets for the given configs. Configs of hostnames
+// that failed to resolve are returned as pending, to be tried again later
+func NewTargets(configs []*targetConfig, privileged privileges, ipv4 bool, ipv6 bool, maxCIDRHosts int) (map[string]Target, []*targetConfig) {
+	targets := make(map[string]Target)
+	var pending []*targetConfig
+	t := pool.New()
+	defer t.Close()
+	for _, target := range configs {
+		work := t.Queue(AddTarget(target, privileged, ipv4, ipv6, maxCIDRHosts))
+		work.Wait()
+		if err, ok := work.Error().(*resolveError); ok {
+			logp.Warn("Target %v is pending: %v", target.Name, err)
+			pending = append(pending, target)
+		} else if err := work.Error(); err != nil {
+			logp.Err("Failed to add target %v: %v", target.Name, work.Error())
+		} else {
+			// Hostnames may resolve to several addresses, each of which
+			// is pinged as a separate target
+			for _, thisTarget := range work.Value().([]*Target) {
+				logp.Debug("targets", "Resolved target %v to %v", thisTarget.Name, thisTarget.Addr)
+				targets[addrKey(thisTarget.Addr)] = *thisTarget
+			}
+		}
+	}
+	return targets, pending
 }
 
 // AddTarget takes a target name and tag, fetches the IP addresses associated
-// with it and adds them to the Pingbeat struct
-func AddTarget(target *targetConfig, privileged bool, ipv4 bool, ipv6 bool) pool.WorkFunc {
+// with it and returns a target for each address. A name in CIDR notation is
+// expanded into a target for each host address in the network, up to
+// maxCIDRHosts
+func AddTarget(target *targetConfig, privileged privileges, ipv4 bool, ipv6 bool, maxCIDRHosts int) pool.WorkFunc {
 	return func(wu pool.WorkUnit) (interface{}, error) {
 		if wu.IsCancelled() {
 			// return values not used
 			return nil, nil
 		}
 		t := &Target{
-			Name: target.Name,
-			Tags: target.Tags,
-			Desc: target.Desc,
-		}
-		if net.ParseIP(t.Name) != nil {
-			// Input is already an IP address, add it directly
-			logp.Debug("pingbeat", "Adding target %s\n", t.Name)
-			if privileged {
-				t.Addr = &net.IPAddr{IP: net.ParseIP(t.Name)}
-			} else {
-				t.Addr = &net.UDPAddr{IP: net.ParseIP(t.Name)}
+			Host:     target.Addr,
+			Name:     target.Name,
+			Tags:     target.Tags,
+			Desc:     target.Desc,
+			Protocol: target.Protocol,
+			Port:     target.Port,
+			URL:      target.URL,
+			TLS:      target.TLS,
+			RTTWarn:  target.RTTWarn,
+			RTTCrit:  target.RTTCrit,
+			Fields:   target.Fields,
+
+			BaselineRTT: target.BaselineRTT,
+			MaxInFlight: target.MaxInFlight,
+			Priority:    target.Priority,
+			Interval:    target.Interval,
+			Timeout:     target.Timeout,
+		}
+		switch target.Family {
+		case "", "both":
+		case "ipv4", "ipv6":
+			if (target.Family == "ipv4" && !ipv4) || (target.Family == "ipv6" && !ipv6) {
+				return nil, fmt.Errorf("family %s is not enabled", target.Family)
 			}
-		} else {
-			// Input is a hostname, look up IP addrs and add
-			addrs, err := net.LookupIP(t.Name)
+			t.Family = target.Family
+		default:
+			return nil, fmt.Errorf("unknown family %s", target.Family)
+		}
+		ipv4, ipv6 = t.families(ipv4, ipv6)
+		for _, key := range reservedTargetFields {
+			if _, found := t.Fields[key]; found {
+				return nil, fmt.Errorf("custom field %s is reserved", key)
+			}
+		}
+		if t.RTTWarn < 0 || t.RTTCrit < 0 {
+			return nil, fmt.Errorf("rttwarn and rttcrit must not be negative")
+		}
+		if t.BaselineRTT < 0 {
+			return nil, fmt.Errorf("baselinertt must not be negative")
+		}
+		if t.MaxInFlight < 0 {
+			return nil, fmt.Errorf("maxinflight must not be negative")
+		}
+		if t.Interval != 0 && t.Interval < minPeriod {
+			return nil, fmt.Errorf("interval must be at least %v", minPeriod)
+		}
+		if t.Timeout < 0 {
+			return nil, fmt.Errorf("timeout must not be negative")
+		}
+		var err error
+		if t.Headers, err = probeHeaders(target); err != nil {
+			return nil, err
+		}
+		if t.Host == "" {
+			t.Host = t.Name
+		}
+		switch t.Protocol {
+		case "":
+			t.Protocol = "icmp"
+		case "icmp":
+		case "timestamp":
+			// Timestamp requests are only defined for ICMPv4 and can't be
+			// sent over unprivileged ping sockets
+			if !privileged.ipv4 || !ipv4 {
+				return nil, fmt.Errorf("timestamp targets need privileged mode and IPv4")
+			}
+			if ip, _ := parseIP(t.Host); ip != nil && ip.To4() == nil {
+				return nil, fmt.Errorf("timestamp targets must be IPv4")
+			}
+		case "tcp", "udp", "grpc":
+			if t.Port < 1 || t.Port > 65535 {
+				return nil, fmt.Errorf("invalid port %d for %s target", t.Port, t.Protocol)
+			}
+		case "dns":
+			if t.Port == 0 {
+				t.Port = defaultDNSPort
+			}
+			if t.Port < 1 || t.Port > 65535 {
+				return nil, fmt.Errorf("invalid port %d for %s target", t.Port, t.Protocol)
+			}
+			if t.Query, t.QueryType, err = parseDNSQuery(target.Query, target.QueryType); err != nil {
+				return nil, err
+			}
+		case "http":
+			// The URL is resolved and connected to by the HTTP client, so
+			// there are no addresses to look up
+			u, err := url.Parse(t.URL)
 			if err != nil {
-				err := errors.New(t.Name)
-				return t, err
-			}
-			for j := 0; j < len(addrs); j++ {
-				// If we have an IPv4 address and we aren't using IPv4, ignore
-				if addrs[j].To4() != nil && !ipv4 {
-					logp.Debug("pingbeat", "Ignoring IPv4 address %s for target %s as not using IPv4\n", addrs[j].String(), t.Name)
-					break
-				}
-				// If we have an IPv6 address and we aren't using IPv6, ignore
-				if addrs[j].To4() == nil && !ipv6 {
-					logp.Debug("pingbeat", "Ignoring IPv6 address %s for target %s as not using IPv6\n", addrs[j].String(), t.Name)
-					break
-				}
-				// If we get a loopback address, ignore it
-				if addrs[j].IsLoopback() {
-					logp.Warn("Target %s resolves to a loopback address? Not adding as target.\n", t.Name)
-					break
-				}
-				addrString := addrs[j].String()
-				logp.Debug("pingbeat", "Target %s has an address %s\n", t.Name, addrString)
-				if privileged {
-					t.Addr = &net.IPAddr{IP: net.ParseIP(addrString)}
-				} else {
-					t.Addr = &net.UDPAddr{IP: net.ParseIP(addrString)}
-				}
+				return nil, err
+			}
+			if u.Scheme != "http" && u.Scheme != "https" {
+				return nil, fmt.Errorf("invalid url %s for http target", t.URL)
+			}
+			if t.Name == "" {
+				t.Name = u.Host
+			}
+			t.Addr = urlAddr(t.URL)
+			return []*Target{t}, nil
+		default:
+			return nil, fmt.Errorf("unknown protocol %s", t.Protocol)
+		}
+		if ip, zone := parseIP(t.Host); ip != nil {
+			// Input is already an IP address, add it directly. Link-local
+			// IPv6 addresses keep their zone to route pings out of the
+			// right interface
+			if (ip.To4() != nil && !ipv4) || (ip.To4() == nil && !ipv6) {
+				return nil, fmt.Errorf("address family of %s is not enabled", t.Host)
+			}
+			logp.Debug("pingbeat", "Adding target %s\n", t.Host)
+			t.Zone = zone
+			t.setAddr(ip, privileged.of(ip))
+			return []*Target{t}, nil
+		}
+		if _, network, err := net.ParseCIDR(t.Host); err == nil {
+			// Input is a network, add each of its hosts
+			if (network.IP.To4() != nil && !ipv4) || (network.IP.To4() == nil && !ipv6) {
+				return nil, fmt.Errorf("address family of %s is not enabled", t.Host)
+			}
+			ips, err := cidrHosts(network, maxCIDRHosts)
+			if err != nil {
+				return nil, err
+			}
+			logp.Debug("pingbeat", "Adding %d targets for network %s\n", len(ips), t.Host)
+			return t.expand(ips, privileged), nil
+		}
+		// Input is a hostname, look up IP addrs and add
+		ips, err := resolveTarget(t.Host, ipv4, ipv6)
+		if err != nil {
+			return nil, err
+		}
+		return t.expand(ips, privileged), nil
+	}
+}
+
+// resolveError is returned for a hostname target that failed to resolve,
+// which may only be for now, e.g. while its DNS server is down
+type resolveError struct {
+	name string
+	err  error
+}
+
+func (e *resolveError) Error() string {
+	return fmt.Sprintf("failed to resolve %s: %v", e.name, e.err)
+}
+
+// resolveTarget looks up the IP addresses of a hostname target and returns
+// those to ping
+func resolveTarget(name string, ipv4 bool, ipv6 bool) ([]net.IP, error) {
+	addrs, err := lookupIP(name)
+	if err != nil {
+		return nil, &resolveError{name, err}
+	}
+	var ips []net.IP
+	for j := 0; j < len(addrs); j++ {
+		// If we have an IPv4 address and we aren't using IPv4, ignore
+		if addrs[j].To4() != nil && !ipv4 {
+			logp.Debug("pingbeat", "Ignoring IPv4 address %s for target %s as not using IPv4\n", addrs[j].String(), name)
+			continue
+		}
+		// If we have an IPv6 address and we aren't using IPv6, ignore
+		if addrs[j].To4() == nil && !ipv6 {
+			logp.Debug("pingbeat", "Ignoring IPv6 address %s for target %s as not using IPv6\n", addrs[j].String(), name)
+			continue
+		}
+		// If we get a loopback address, ignore it
+		if addrs[j].IsLoopback() {
+			logp.Warn("Target %s resolves to a loopback address? Not adding as target.\n", name)
+			continue
+		}
+		logp.Debug("pingbeat", "Target %s has an address %s\n", name, addrs[j].String())
+		ips = append(ips, addrs[j])
+	}
+	if len(ips) == 0 && len(addrs) > 0 {
+		logp.Warn("Target %s has no addresses to ping in the enabled address families", name)
+	}
+	return ips, nil
+}
+
+// cidrHosts returns the usable host addresses in a network, refusing to expand
+// networks with more than max hosts
+func cidrHosts(network *net.IPNet, max int) ([]net.IP, error) {
+	if max < 1 {
+		return nil, fmt.Errorf("maxcidrhosts must be at least 1")
+	}
+	ones, bits := network.Mask.Size()
+	hostBits := uint(bits - ones)
+	// The network (and for IPv4 the broadcast) address is not a host, unless
+	// the network is too small to have them
+	var reserved uint64
+	if hostBits >= 2 {
+		reserved = 1
+		if bits == 32 {
+			reserved = 2
+		}
+	}
+	if hostBits >= 63 || (uint64(1)<<hostBits)-reserved > uint64(max) {
+		return nil, fmt.Errorf("network %s has more than %d hosts", network, max)
+	}
+	count := (uint64(1) << hostBits) - reserved
+
+	ip := make(net.IP, len(network.IP))
+	copy(ip, network.IP.Mask(network.Mask))
+	if reserved > 0 {
+		incIP(ip)
+	}
+	ips := make([]net.IP, 0, count)
+	for i := uint64(0); i < count; i++ {
+		host := make(net.IP, len(ip))
+		copy(host, ip)
+		ips = append(ips, host)
+		incIP(ip)
+	}
+	return ips, nil
+}
+
+// incIP increments an IP address in place
+func incIP(ip net.IP) {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			return
+		}
+	}
+}
+
+// parseIP parses an IP address, which for IPv6 may be scoped with a zone,
+// e.g. fe80::1%eth0. The IP is nil if the string isn't an IP address
+func parseIP(s string) (net.IP, string) {
+	host, zone := s, ""
+	if i := strings.LastIndex(s, "%"); i >= 0 {
+		host, zone = s[:i], s[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || (zone != "" && ip.To4() != nil) {
+		return nil, ""
+	}
+	return ip, zone
+}
+
+// isLiteral reports whether a target name is an IP address or network rather
+// than a hostname
+func isLiteral(name string) bool {
+	if ip, _ := parseIP(name); ip != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(name)
+	return err == nil
+}
+
+// expand returns a copy of the target for each of the given addresses
+func (t *Target) expand(ips []net.IP, privileged privileges) []*Target {
+	targets := make([]*Target, 0, len(ips))
+	for _, ip := range ips {
+		thisTarget := *t
+		thisTarget.setAddr(ip, privileged.of(ip))
+		targets = append(targets, &thisTarget)
+	}
+	return targets
+}
+
+// setAddr sets the address pings are sent to, based on the target protocol
+// and whether raw sockets are used for ICMP
+func (t *Target) setAddr(ip net.IP, privileged bool) {
+	t.IPv6 = ip.To4() == nil
+	switch {
+	case t.Protocol == "tcp" || t.Protocol == "grpc":
+		t.Addr = &net.TCPAddr{IP: ip, Port: t.Port, Zone: t.Zone}
+	case t.Protocol == "udp" || t.Protocol == "dns":
+		t.Addr = &net.UDPAddr{IP: ip, Port: t.Port, Zone: t.Zone}
+	case privileged:
+		t.Addr = &net.IPAddr{IP: ip, Zone: t.Zone}
+	default:
+		t.Addr = &net.UDPAddr{IP: ip, Zone: t.Zone}
+	}
+}
+
+// addrKey returns the key of a target address in the targets map, in the same
+// form as the Target of its pings. Unprivileged ICMP uses UDP addresses
+// without a port, which are keyed by IP like raw ICMP addresses
+func addrKey(addr net.Addr) string {
+	if udp, ok := addr.(*net.UDPAddr); ok && udp.Port == 0 {
+		return (&net.IPAddr{IP: udp.IP, Zone: udp.Zone}).String()
+	}
+	return addr.String()
+}
+
+// lookupTarget returns the target a ping was sent to. Addresses without a
+// zone, like those quoted in ICMP errors, match a link-local target with the
+// same IP
+func (bt *Pingbeat) lookupTarget(addr string) (Target, bool) {
+	targets := bt.getTargets()
+	if target, found := targets[addr]; found {
+		return target, true
+	}
+	ip, zone := parseIP(addr)
+	if ip == nil {
+		return Target{}, false
+	}
+	for key, target := range targets {
+		keyIP, keyZone := parseIP(key)
+		if ip.Equal(keyIP) && (zone == "" || keyZone == "") {
+			return target, true
+		}
+	}
+	return Target{}, false
+}
+
+// getTargets returns the current set of targets. The map is replaced rather
+// than modified when targets change, so it is safe to range over
+func (bt *Pingbeat) getTargets() map[string]Target {
+	bt.targetsMU.RLock()
+	defer bt.targetsMU.RUnlock()
+	return bt.targets
+}
+
+// families narrows the enabled address families to those the target is
+// pinged over. Timestamp requests are only defined for ICMPv4
+func (t *Target) families(ipv4 bool, ipv6 bool) (bool, bool) {
+	if t.Protocol == "timestamp" {
+		ipv6 = false
+	}
+	switch t.Family {
+	case "ipv4":
+		return ipv4, false
+	case "ipv6":
+		return false, ipv6
+	}
+	return ipv4, ipv6
+}
+
+// setTargets replaces the current set of targets
+func (bt *Pingbeat) setTargets(targets map[string]Target) {
+	bt.targetsMU.Lock()
+	bt.targets = targets
+	bt.targetsMU.Unlock()
+	expvarTargets.Set(int64(len(targets)))
+}
+
+// setPending replaces the targets waiting to be resolved
+func (bt *Pingbeat) setPending(pending []*targetConfig) {
+	bt.targetsMU.Lock()
+	bt.pending = pending
+	bt.targetsMU.Unlock()
+}
+
+// getPending returns the targets waiting to be resolved
+func (bt *Pingbeat) getPending() []*targetConfig {
+	bt.targetsMU.RLock()
+	defer bt.targetsMU.RUnlock()
+	return bt.pending
+}
+
+// pendingNames returns the names of pending targets
+func pendingNames(pending []*targetConfig) []string {
+	names := make([]string, len(pending))
+	for i, target := range pending {
+		names[i] = target.Name
+	}
+	return names
+}
+
+// addTargets adds targets to the current set, replacing any with the same
+// address
+func (bt *Pingbeat) addTargets(added []*Target) {
+	bt.updateMU.Lock()
+	defer bt.updateMU.Unlock()
+	bt.mergeTargets(added)
+}
+
+// mergeTargets adds targets to the current set, the caller must hold updateMU
+func (bt *Pingbeat) mergeTargets(added []*Target) {
+	bt.targetsMU.Lock()
+	targets := make(map[string]Target, len(bt.targets)+len(added))
+	for addr, target := range bt.targets {
+		targets[addr] = target
+	}
+	for _, target := range added {
+		addr := addrKey(target.Addr)
+		if _, found := targets[addr]; !found {
+			logp.Info("Adding target %v (%v)", target.Name, addr)
+		}
+		targets[addr] = *target
+	}
+	bt.targets = targets
+	bt.targetsMU.Unlock()
+	expvarTargets.Set(int64(len(targets)))
+}
+
+// removeTargets removes the targets matching an address from the current set
+// and their requests from state, returning how many were removed. Targets
+// probed on a port match both their address and port and the address alone
+func (bt *Pingbeat) removeTargets(addr string, state *PingState) int {
+	bt.updateMU.Lock()
+	defer bt.updateMU.Unlock()
+	bt.targetsMU.Lock()
+	targets := make(map[string]Target, len(bt.targets))
+	var removed []string
+	for key, target := range bt.targets {
+		if host, _, err := net.SplitHostPort(key); key == addr || (err == nil && host == addr) {
+			logp.Info("Removing target %v (%v)", target.Name, key)
+			removed = append(removed, key)
+			continue
+		}
+		targets[key] = target
+	}
+	bt.targets = targets
+	bt.targetsMU.Unlock()
+	expvarTargets.Set(int64(len(targets)))
+	for _, key := range removed {
+		state.DelTarget(key)
+	}
+	return len(removed)
+}
+
+// ResolveTargets looks up the addresses of hostname targets again and swaps in
+// any that have changed. Targets that no longer resolve keep their last known
+// address but are flagged as unresolved. Pending targets are tried again too
+func (bt *Pingbeat) ResolveTargets() {
+	bt.resolveCurrent()
+	bt.ResolvePending()
+}
+
+// resolveCurrent re-resolves the hostnames of the current targets. Other
+// changes to the targets wait until it is done, so none are lost
+func (bt *Pingbeat) resolveCurrent() {
+	bt.updateMU.Lock()
+	defer bt.updateMU.Unlock()
+	current := bt.getTargets()
+	targets := make(map[string]Target, len(current))
+	resolved := make(map[string][]net.IP)
+	for addr, target := range current {
+		if target.Protocol == "http" || isLiteral(target.Host) {
+			targets[addr] = target
+			continue
+		}
+		// Each hostname only needs resolving once per family, however many
+		// addresses it has
+		key := target.Host + "/" + target.Family
+		ips, found := resolved[key]
+		if !found {
+			var err error
+			ipv4, ipv6 := target.families(bt.config.UseIPv4, bt.config.UseIPv6)
+			if ips, err = resolveTarget(target.Host, ipv4, ipv6); err != nil {
+				ips = nil
+			}
+			resolved[key] = ips
+		}
+		if len(ips) == 0 {
+			logp.Warn("Failed to resolve target %v, keeping last known address %v", target.Host, addr)
+			target.Unresolved = true
+			targets[addr] = target
+			continue
+		}
+		target.Unresolved = false
+		for _, thisTarget := range target.expand(ips, bt.privileges()) {
+			if _, found := current[addrKey(thisTarget.Addr)]; !found {
+				logp.Info("Target %v has a new address %v", thisTarget.Name, thisTarget.Addr)
+			}
+			targets[addrKey(thisTarget.Addr)] = *thisTarget
+		}
+	}
+	bt.setTargets(targets)
+}
+
+// pendingRetryInterval is how often targets that failed to resolve are tried
+// again when hostname targets aren't re-resolved with resolvettl
+const pendingRetryInterval = 30 * time.Second
+
+// ResolvePending tries again to resolve the targets that failed to, adding
+// those that now resolve. A loss event is published for each target that
+// still doesn't. Other changes to the targets wait until it is done, so a
+// reload can't be undone by pending targets it no longer has
+func (bt *Pingbeat) ResolvePending() {
+	bt.updateMU.Lock()
+	pending := bt.getPending()
+	if len(pending) == 0 {
+		bt.updateMU.Unlock()
+		return
+	}
+	resolved, stillPending := NewTargets(pending, bt.privileges(), bt.config.UseIPv4, bt.config.UseIPv6, bt.config.MaxCIDRHosts)
+	bt.setPending(stillPending)
+	if len(resolved) > 0 {
+		added := make([]*Target, 0, len(resolved))
+		for _, target := range resolved {
+			target := target
+			logp.Info("Pending target %v resolved to %v", target.Name, target.Addr)
+			added = append(added, &target)
+		}
+		bt.mergeTargets(added)
+	}
+	bt.updateMU.Unlock()
+	for _, target := range stillPending {
+		bt.publishUnresolvable(target)
+	}
+}
+
+// publishUnresolvable publishes a loss event for a target that has no
+// addresses to ping yet
+func (bt *Pingbeat) publishUnresolvable(config *targetConfig) {
+	if !bt.config.EmitLoss || bt.config.StateOnly || bt.config.SummaryOnly {
+		return
+	}
+	target := Target{
+		Name:       config.Name,
+		Host:       config.Addr,
+		Tags:       config.Tags,
+		Fields:     config.Fields,
+		Protocol:   config.Protocol,
+		Unresolved: true,
+	}
+	if target.Host == "" {
+		target.Host = target.Name
+	}
+	if target.Protocol == "" {
+		target.Protocol = "icmp"
+	}
+	fields := target.fields("")
+	delete(fields, "addr")
+	ping := &PingInfo{Loss: true, LossReason: "Unresolvable"}
+	event := common.MapStr{
+		"@timestamp": common.Time(time.Now().UTC()),
+		"type":       bt.config.EventType,
+		"target":     fields,
+		"protocol":   target.Protocol,
+		"loss":       true,
+		"reason":     ping.LossReason,
+	}
+	if bt.config.ECS {
+		event = ecsEvent(event, ping, target)
+	}
+	bt.publish(event)
+}
+
+// resolveTargets periodically calls resolve, to re-resolve hostname targets
+// or those pending, until Pingbeat is stopped
+func (bt *Pingbeat) resolveTargets(interval time.Duration, resolve func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bt.done:
+			return
+		case <-ticker.C:
+			resolve()
+		}
+	}
+}
+
+// ReloadTargets reloads the configured targets, including the targets file,
+// adding new targets and removing those no longer configured. Targets added
+// through the API are kept. Requests to removed targets are cleared from the
+// PingState
+func (bt *Pingbeat) ReloadTargets(state *PingState) error {
+	bt.updateMU.Lock()
+	defer bt.updateMU.Unlock()
+	targets, err := bt.loadTargets()
+	if err != nil {
+		return err
+	}
+	current := bt.getTargets()
+	for addr, target := range current {
+		if _, found := targets[addr]; !found && target.Dynamic {
+			targets[addr] = target
+		}
+	}
+	for addr, target := range targets {
+		if _, found := current[addr]; !found {
+			logp.Info("Adding target %v (%v)", target.Name, addr)
+		}
+	}
+	for addr, target := range current {
+		if _, found := targets[addr]; !found {
+			logp.Info("Removing target %v (%v)", target.Name, addr)
+			state.DelTarget(addr)
+		}
+	}
+	bt.setTargets(targets)
+	return nil
+}
+
+// refreshTargets reloads the targets every interval until Pingbeat is
+// stopped, to follow targets discovered from a service registry
+func (bt *Pingbeat) refreshTargets(interval time.Duration, source string, state *PingState) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bt.done:
+			return
+		case <-ticker.C:
+			if err := bt.ReloadTargets(state); err != nil {
+				logp.Err("Error refreshing targets from %s: %v", source, err)
+			}
+		}
+	}
+}
+
+// reloadTargets reloads the targets each time a signal is received on reload,
+// until Pingbeat is stopped
+func (bt *Pingbeat) reloadTargets(reload <-chan os.Signal, state *PingState) {
+	for {
+		select {
+		case <-bt.done:
+			return
+		case <-reload:
+			logp.Info("Reloading targets")
+			if err := bt.ReloadTargets(state); err != nil {
+				logp.Err("Error reloading targets: %v", err)
 			}
 		}
-		return t, nil
 	}
 }
@@ -0,0 +1,730 @@
+// +build !integration
+
+package beater
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"golang.org/x/net/ipv6"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+// addTarget runs AddTarget for the given config and returns the targets
+func addTarget(t *testing.T, target *targetConfig) []*Target {
+	targets, err := addTargetErr(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return targets
+}
+
+// addTargetErr runs AddTarget for the given config and returns the targets or
+// the error
+func addTargetErr(target *targetConfig) ([]*Target, error) {
+	wu := pool.New().Queue(AddTarget(target, privileges{true, true}, true, true, 1024))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		return nil, err
+	}
+	return wu.Value().([]*Target), nil
+}
+
+// fakeLookup replaces lookupIP, returning a func that restores it
+func fakeLookup(lookup func(string) ([]net.IP, error)) func() {
+	orig := lookupIP
+	lookupIP = lookup
+	return func() { lookupIP = orig }
+}
+
+func TestResolveTargetsAddressChange(t *testing.T) {
+	addr := "192.0.2.1"
+	fail := false
+	defer fakeLookup(func(name string) ([]net.IP, error) {
+		if fail {
+			return nil, errors.New("no such host")
+		}
+		return []net.IP{net.ParseIP(addr)}, nil
+	})()
+
+	bt, _ := newTestBeat()
+	c := newTestConfig(t, map[string]interface{}{
+		"targets": []interface{}{
+			map[string]interface{}{"name": "pingbeat.test"},
+			map[string]interface{}{"name": "198.51.100.1"},
+		},
+	})
+	if err := c.Unpack(&bt.config); err != nil {
+		t.Fatal(err)
+	}
+	bt.config.Privileged = true
+	targets, err := bt.loadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt.setTargets(targets)
+	if _, found := bt.getTargets()["192.0.2.1"]; !found {
+		t.Fatalf("expected target 192.0.2.1, got %v", bt.getTargets())
+	}
+
+	addr = "192.0.2.2"
+	bt.ResolveTargets()
+	targets = bt.getTargets()
+	if _, found := targets["192.0.2.1"]; found {
+		t.Error("old address still present after re-resolving")
+	}
+	if target, found := targets["192.0.2.2"]; !found || target.Name != "pingbeat.test" {
+		t.Errorf("expected pingbeat.test at 192.0.2.2, got %v", targets)
+	}
+	if _, found := targets["198.51.100.1"]; !found {
+		t.Error("IP address target dropped while re-resolving")
+	}
+
+	fail = true
+	bt.ResolveTargets()
+	target, found := bt.getTargets()["192.0.2.2"]
+	if !found {
+		t.Fatal("unresolvable target should keep its last known address")
+	}
+	if !target.Unresolved {
+		t.Error("unresolvable target not flagged")
+	}
+}
+
+func TestResolveTargetsTimestampIPv4(t *testing.T) {
+	defer fakeLookup(func(name string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, nil
+	})()
+
+	bt, _ := newTestBeat()
+	c := newTestConfig(t, map[string]interface{}{
+		"targets": []interface{}{
+			map[string]interface{}{"name": "pingbeat.test", "protocol": "timestamp"},
+		},
+	})
+	if err := c.Unpack(&bt.config); err != nil {
+		t.Fatal(err)
+	}
+	bt.config.Privileged = true
+	targets, err := bt.loadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt.setTargets(targets)
+	// Re-resolving must keep timestamp targets to IPv4, like adding them
+	bt.ResolveTargets()
+	targets = bt.getTargets()
+	if _, found := targets["2001:db8::1"]; found || len(targets) != 1 {
+		t.Errorf("expected only the IPv4 address of the timestamp target, got %v", targets)
+	}
+}
+
+func TestPendingTargets(t *testing.T) {
+	fail := true
+	defer fakeLookup(func(name string) ([]net.IP, error) {
+		if fail {
+			return nil, errors.New("no such host")
+		}
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	})()
+
+	bt, client := newTestBeat()
+	c := newTestConfig(t, map[string]interface{}{
+		"targets": []interface{}{
+			map[string]interface{}{"name": "pingbeat.test", "tags": []string{"web"}},
+			map[string]interface{}{"name": "198.51.100.1"},
+		},
+	})
+	if err := c.Unpack(&bt.config); err != nil {
+		t.Fatal(err)
+	}
+	bt.config.Privileged = true
+	targets, err := bt.loadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt.setTargets(targets)
+	if len(targets) != 1 {
+		t.Fatalf("expected only the IP address target, got %v", targets)
+	}
+	if names := pendingNames(bt.getPending()); len(names) != 1 || names[0] != "pingbeat.test" {
+		t.Fatalf("expected pingbeat.test pending, got %v", names)
+	}
+
+	bt.ResolvePending()
+	event := client.next(t)
+	if event["reason"] != "Unresolvable" || event["loss"] != true {
+		t.Errorf("expected an unresolvable loss event, got %v", event)
+	}
+	target := event["target"].(common.MapStr)
+	if target["name"] != "pingbeat.test" || target["unresolved"] != true {
+		t.Errorf("expected the pending target's details, got %v", target)
+	}
+	if _, found := target["addr"]; found {
+		t.Errorf("unresolvable target has no address, got %v", target["addr"])
+	}
+	if len(bt.getPending()) != 1 {
+		t.Error("target dropped while it still fails to resolve")
+	}
+
+	fail = false
+	bt.ResolvePending()
+	if len(bt.getPending()) != 0 {
+		t.Errorf("expected no pending targets, got %v", pendingNames(bt.getPending()))
+	}
+	targets = bt.getTargets()
+	if target, found := targets["192.0.2.1"]; !found || target.Name != "pingbeat.test" {
+		t.Errorf("expected pingbeat.test added at 192.0.2.1, got %v", targets)
+	}
+	if _, found := targets["198.51.100.1"]; !found {
+		t.Error("IP address target dropped while resolving pending targets")
+	}
+	select {
+	case event := <-client.events:
+		t.Errorf("unexpected event once resolved: %v", event)
+	default:
+	}
+}
+
+func TestPendingTargetsReload(t *testing.T) {
+	lookup := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	defer fakeLookup(func(name string) ([]net.IP, error) {
+		once.Do(func() { close(lookup) })
+		<-release
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	})()
+
+	bt, _ := newTestBeat()
+	bt.pending = []*targetConfig{{Name: "pingbeat.test"}}
+	c := newTestConfig(t, map[string]interface{}{
+		"targets": []interface{}{map[string]interface{}{"name": "198.51.100.1"}},
+	})
+	if err := c.Unpack(&bt.config); err != nil {
+		t.Fatal(err)
+	}
+	bt.config.Privileged = true
+
+	// The pending target is removed from the config while being retried
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		bt.ResolvePending()
+	}()
+	<-lookup
+	go func() {
+		defer wg.Done()
+		if err := bt.ReloadTargets(NewPingState()); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if names := pendingNames(bt.getPending()); len(names) != 0 {
+		t.Errorf("expected no pending targets after the reload, got %v", names)
+	}
+	targets := bt.getTargets()
+	if _, found := targets["192.0.2.1"]; found {
+		t.Errorf("expected the removed pending target not added, got %v", targets)
+	}
+	if _, found := targets["198.51.100.1"]; !found {
+		t.Errorf("expected the configured target, got %v", targets)
+	}
+}
+
+func TestPendingTargetsNoFamily(t *testing.T) {
+	// A name that resolves, but only to addresses of a disabled family, is
+	// a config problem rather than one to keep retrying
+	defer fakeLookup(func(name string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("2001:db8::1")}, nil
+	})()
+	targets, pending := NewTargets([]*targetConfig{{Name: "pingbeat.test"}}, privileges{true, true}, true, false, 1024)
+	if len(targets) != 0 || len(pending) != 0 {
+		t.Errorf("expected the target skipped, got %v and pending %v", targets, pendingNames(pending))
+	}
+}
+
+func TestNewTargetsMultipleAddresses(t *testing.T) {
+	defer fakeLookup(func(name string) ([]net.IP, error) {
+		return []net.IP{
+			net.ParseIP("192.0.2.1"),
+			net.ParseIP("192.0.2.2"),
+			net.ParseIP("2001:db8::1"),
+		}, nil
+	})()
+
+	c := &targetConfig{Name: "anycast.test", Tags: []string{"anycast"}}
+	targets, _ := NewTargets([]*targetConfig{c}, privileges{true, true}, true, false, 1024)
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets, got %v", targets)
+	}
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2"} {
+		target, found := targets[addr]
+		if !found {
+			t.Errorf("missing target for %v", addr)
+			continue
+		}
+		if target.Name != "anycast.test" || len(target.Tags) != 1 || target.Tags[0] != "anycast" {
+			t.Errorf("target %v doesn't share the configured name and tags: %+v", addr, target)
+		}
+	}
+}
+
+func TestAddTargetCIDR(t *testing.T) {
+	targets := addTarget(t, &targetConfig{Name: "192.0.2.0/30", Tags: []string{"sweep"}})
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 host targets, got %d", len(targets))
+	}
+	for i, addr := range []string{"192.0.2.1", "192.0.2.2"} {
+		if targets[i].Addr.String() != addr {
+			t.Errorf("expected target %v, got %v", addr, targets[i].Addr)
+		}
+		if targets[i].Name != "192.0.2.0/30" || targets[i].Tags[0] != "sweep" {
+			t.Errorf("target doesn't inherit the network's name and tags: %+v", targets[i])
+		}
+	}
+}
+
+func TestAddTargetDisabledFamily(t *testing.T) {
+	for _, c := range []struct {
+		addr       string
+		ipv4, ipv6 bool
+	}{
+		{"192.0.2.1", false, true},
+		{"2001:db8::1", true, false},
+	} {
+		wu := pool.New().Queue(AddTarget(&targetConfig{Name: c.addr}, privileges{true, true}, c.ipv4, c.ipv6, 1024))
+		wu.Wait()
+		if wu.Error() == nil {
+			t.Errorf("expected %v to be rejected with IPv4 %v and IPv6 %v", c.addr, c.ipv4, c.ipv6)
+		}
+	}
+}
+
+func TestCIDRHosts(t *testing.T) {
+	tests := []struct {
+		cidr  string
+		max   int
+		hosts int
+	}{
+		{"192.0.2.7/32", 1024, 1},
+		{"192.0.2.0/31", 1024, 2},
+		{"192.0.2.0/24", 1024, 254},
+		{"2001:db8::/126", 1024, 3},
+		{"10.0.0.0/20", 1024, -1},
+		{"192.0.2.0/24", 100, -1},
+		{"2001:db8::/64", 1024, -1},
+		// A negative limit must not wrap around to a huge one
+		{"10.0.0.0/8", -1, -1},
+		{"192.0.2.7/32", 0, -1},
+	}
+	for _, test := range tests {
+		_, network, _ := net.ParseCIDR(test.cidr)
+		ips, err := cidrHosts(network, test.max)
+		if test.hosts < 0 {
+			if err == nil {
+				t.Errorf("%s: expected expansion to be refused", test.cidr)
+			}
+			continue
+		}
+		if err != nil || len(ips) != test.hosts {
+			t.Errorf("%s: expected %d hosts, got %d (%v)", test.cidr, test.hosts, len(ips), err)
+		}
+	}
+}
+
+func TestNewMaxCIDRHosts(t *testing.T) {
+	for _, max := range []int{0, -1} {
+		if _, err := New(nil, newTestConfig(t, map[string]interface{}{"maxcidrhosts": max})); err == nil {
+			t.Errorf("expected maxcidrhosts %d to be rejected", max)
+		}
+	}
+}
+
+func TestNewTargetsFile(t *testing.T) {
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"targetsfile": "testdata/targets.txt",
+		"targets": []interface{}{
+			map[string]interface{}{"name": "198.51.100.1"},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := b.(*Pingbeat).getTargets()
+	if len(targets) != 5 {
+		t.Errorf("expected 5 targets, got %v", targets)
+	}
+	expected := map[string]struct {
+		name string
+		tags []string
+	}{
+		"198.51.100.1": {"198.51.100.1", nil},
+		"192.0.2.1":    {"192.0.2.1", nil},
+		"192.0.2.2":    {"router1", nil},
+		"192.0.2.3":    {"router2", []string{"core", "edge"}},
+		"2001:db8::1":  {"v6host", []string{"v6"}},
+	}
+	for addr, want := range expected {
+		target, found := targets[addr]
+		if !found {
+			t.Errorf("missing target %v", addr)
+			continue
+		}
+		if target.Name != want.name || len(target.Tags) != len(want.tags) {
+			t.Errorf("%v: expected name %v and tags %v, got %+v", addr, want.name, want.tags, target)
+			continue
+		}
+		for i := range want.tags {
+			if target.Tags[i] != want.tags[i] {
+				t.Errorf("%v: expected tags %v, got %v", addr, want.tags, target.Tags)
+			}
+		}
+	}
+}
+
+func TestReadTargetsFileErrors(t *testing.T) {
+	_, err := readTargetsFile("testdata/targets_bad.txt")
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("expected an error naming line 3, got %v", err)
+	}
+}
+
+func TestReloadTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pingbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets.txt")
+	if err := ioutil.WriteFile(path, []byte("192.0.2.1\n192.0.2.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"privileged":  true,
+		"targetsfile": path,
+	}))
+	if err != nil {
+		t.Skipf("cannot create privileged pingbeat: %v", err)
+	}
+	bt := b.(*Pingbeat)
+	state := NewPingState()
+	state.AddPing("192.0.2.1", 1, time.Now(), 0)
+	state.AddPing("192.0.2.2", 2, time.Now(), 0)
+
+	reload := make(chan os.Signal)
+	go bt.reloadTargets(reload, state)
+	defer close(bt.done)
+
+	if err := ioutil.WriteFile(path, []byte("192.0.2.1\n192.0.2.3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reload <- syscall.SIGHUP
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		targets := bt.getTargets()
+		_, added := targets["192.0.2.3"]
+		_, removed := targets["192.0.2.2"]
+		if added && !removed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("targets not reloaded: %v", targets)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, found := bt.getTargets()["192.0.2.1"]; !found {
+		t.Error("unchanged target removed by reload")
+	}
+
+	state.MU.RLock()
+	defer state.MU.RUnlock()
+	if _, found := state.Pings[PingKey{"192.0.2.2", 2}]; found {
+		t.Error("state for removed target not cleaned")
+	}
+	if _, found := state.Pings[PingKey{"192.0.2.1", 1}]; !found {
+		t.Error("state for unchanged target lost")
+	}
+}
+
+func TestTargetFamily(t *testing.T) {
+	tests := []struct {
+		addr       string
+		privileged bool
+		ipv6       bool
+	}{
+		{"192.0.2.1", true, false},
+		{"192.0.2.1", false, false},
+		{"2001:db8::1", true, true},
+		{"2001:db8::1", false, true},
+	}
+	for _, test := range tests {
+		target := &Target{Protocol: "icmp"}
+		target.setAddr(net.ParseIP(test.addr), test.privileged)
+		if target.IPv6 != test.ipv6 {
+			t.Errorf("%v (privileged %v): expected IPv6 %v, got %v", test.addr, test.privileged, test.ipv6, target.IPv6)
+		}
+	}
+}
+
+// benchmarkFamilyTargets builds IPv4 and IPv6 targets keyed by address, as
+// pings are routed each period
+func benchmarkFamilyTargets() map[string]Target {
+	targets := make(map[string]Target, benchmarkTargets)
+	for i := 0; i < benchmarkTargets; i++ {
+		ip := net.IPv4(10, 0, byte(i>>8), byte(i))
+		if i%2 == 1 {
+			ip = net.ParseIP(fmt.Sprintf("2001:db8::%x", i))
+		}
+		target := Target{Protocol: "icmp"}
+		target.setAddr(ip, true)
+		targets[target.Addr.String()] = target
+	}
+	return targets
+}
+
+func BenchmarkTargetFamilyParse(b *testing.B) {
+	targets := benchmarkFamilyTargets()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v6 := 0
+		for ip := range targets {
+			if net.ParseIP(ip).To4() == nil {
+				v6++
+			}
+		}
+	}
+}
+
+func BenchmarkTargetFamilyCached(b *testing.B) {
+	targets := benchmarkFamilyTargets()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v6 := 0
+		for _, target := range targets {
+			if target.IPv6 {
+				v6++
+			}
+		}
+	}
+}
+
+func TestZonedTarget(t *testing.T) {
+	if _, err := addTargetErr(&targetConfig{Name: "192.0.2.1%lo"}); err == nil {
+		t.Error("expected a zoned IPv4 address to be rejected")
+	}
+
+	targets, _ := NewTargets([]*targetConfig{{Name: "fe80::1%lo"}}, privileges{true, true}, true, true, 1024)
+	target, found := targets["fe80::1%lo"]
+	if !found {
+		t.Fatalf("expected a target keyed by fe80::1%%lo, got %v", targets)
+	}
+	if addr, ok := target.Addr.(*net.IPAddr); !ok || addr.Zone != "lo" || !target.IPv6 {
+		t.Fatalf("expected an IPv6 address in zone lo, got %#v", target.Addr)
+	}
+
+	// The zone must survive SendPing so replies are matched to the target
+	conn, err := createConn("ip6:ipv6-icmp", "::")
+	if err != nil {
+		t.Skipf("cannot open raw ICMPv6 socket: %v", err)
+	}
+	defer conn.Close()
+	echo, err := NewEchoPacket(ipv6.ICMPTypeEchoRequest, 0xbeef, defaultPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewPingState()
+	wu := pool.New().Queue(SendPing(conn, time.Second, echo, 1, 0, target.Addr, state))
+	wu.Wait()
+	if ping := wu.Value().(*PingInfo); ping.Target != "fe80::1%lo" {
+		t.Errorf("expected request to fe80::1%%lo, got %v", ping.Target)
+	}
+	if _, found := state.Pings[PingKey{"fe80::1%lo", 1}]; wu.Error() == nil && !found {
+		t.Errorf("expected request to fe80::1%%lo in state, got %v", state.Pings)
+	}
+
+	unprivileged, _ := NewTargets([]*targetConfig{{Name: "fe80::1%lo"}}, privileges{}, true, true, 1024)
+	for _, target := range unprivileged {
+		if addr, ok := target.Addr.(*net.UDPAddr); !ok || addr.Zone != "lo" {
+			t.Errorf("expected a UDP address in zone lo, got %#v", target.Addr)
+		}
+	}
+	if !isLiteral("fe80::1%lo") {
+		t.Error("zoned address not recognised as a literal")
+	}
+}
+
+func TestUnmatchedReplyAddress(t *testing.T) {
+	bt, client := newTestBeat()
+	// Unprivileged targets have UDP addresses, but are keyed like the
+	// replies to them
+	for _, config := range []*targetConfig{{Name: "192.0.2.1"}, {Name: "fe80::1%lo"}} {
+		targets, _ := NewTargets([]*targetConfig{config}, privileges{}, true, true, 1024)
+		for addr, target := range targets {
+			bt.targets[addr] = target
+		}
+	}
+
+	tests := []struct {
+		addr string
+		name string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"fe80::1%lo", "fe80::1%lo"},
+		// ICMP errors quote the destination without its zone
+		{"fe80::1", "fe80::1%lo"},
+		// Unknown addresses are still published, under the address
+		{"198.51.100.1", "198.51.100.1"},
+	}
+	for _, test := range tests {
+		bt.ProcessPing(&PingInfo{Target: test.addr, RTT: time.Millisecond})
+		event := client.next(t)
+		target := event["target"].(common.MapStr)
+		if target["name"] != test.name || target["addr"] != test.addr {
+			t.Errorf("%v: expected target %v, got %v", test.addr, test.name, target)
+		}
+		if event["protocol"] != "icmp" {
+			t.Errorf("%v: expected icmp protocol, got %v", test.addr, event["protocol"])
+		}
+	}
+}
+
+func TestTargetCustomFields(t *testing.T) {
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"targets": []map[string]interface{}{{
+			"name":   "192.0.2.1",
+			"fields": map[string]interface{}{"datacenter": "ams1", "team": "netops"},
+		}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt := b.(*Pingbeat)
+	client := newTestClient()
+	bt.client = client
+	addr := "192.0.2.1"
+	if _, found := bt.targets[addr]; !found {
+		t.Fatalf("expected target %v, got %v", addr, bt.targets)
+	}
+
+	bt.ProcessPing(&PingInfo{Target: addr, RTT: time.Millisecond})
+	bt.ProcessPing(&PingInfo{Target: addr, Loss: true, LossReason: "Timeout"})
+	for _, kind := range []string{"success", "loss"} {
+		target := client.next(t)["target"].(common.MapStr)
+		if target["datacenter"] != "ams1" || target["team"] != "netops" {
+			t.Errorf("expected custom fields on %v event, got %v", kind, target)
+		}
+		if target["name"] != "192.0.2.1" {
+			t.Errorf("custom fields replaced the target name: %v", target)
+		}
+	}
+
+	for _, key := range []string{"addr", "name"} {
+		target := &targetConfig{Name: "192.0.2.1", Fields: map[string]interface{}{key: "x"}}
+		if _, err := addTargetErr(target); err == nil {
+			t.Errorf("expected reserved custom field %v to be rejected", key)
+		}
+	}
+}
+
+func TestTargetFamilyOption(t *testing.T) {
+	defer fakeLookup(func(name string) ([]net.IP, error) {
+		switch name {
+		case "v4only.test":
+			return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, nil
+		case "v6only.test":
+			return []net.IP{net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::2")}, nil
+		}
+		return []net.IP{net.ParseIP("192.0.2.3"), net.ParseIP("2001:db8::3")}, nil
+	})()
+
+	configs := []*targetConfig{
+		{Name: "v4only.test", Family: "ipv4"},
+		{Name: "v6only.test", Family: "ipv6"},
+		{Name: "dual.test", Family: "both"},
+	}
+	targets, _ := NewTargets(configs, privileges{true, true}, true, true, 1024)
+	if len(targets) != 4 {
+		t.Fatalf("expected 4 targets, got %v", targets)
+	}
+	for _, addr := range []string{"192.0.2.1", "2001:db8::2", "192.0.2.3", "2001:db8::3"} {
+		if _, found := targets[addr]; !found {
+			t.Errorf("missing target for %v", addr)
+		}
+	}
+
+	// Re-resolving keeps each target to its family
+	bt, _ := newTestBeat()
+	bt.config.UseIPv4, bt.config.UseIPv6 = true, true
+	bt.targets = targets
+	bt.ResolveTargets()
+	if got := bt.getTargets(); len(got) != 4 {
+		t.Errorf("expected families to be kept when re-resolving, got %v", got)
+	}
+
+	for _, c := range []struct {
+		family     string
+		ipv4, ipv6 bool
+	}{
+		{"ipv4", false, true},
+		{"ipv6", true, false},
+		{"ipx", true, true},
+	} {
+		wu := pool.New().Queue(AddTarget(&targetConfig{Name: "dual.test", Family: c.family}, privileges{true, true}, c.ipv4, c.ipv6, 1024))
+		wu.Wait()
+		if wu.Error() == nil {
+			t.Errorf("expected family %v to be rejected with IPv4 %v and IPv6 %v", c.family, c.ipv4, c.ipv6)
+		}
+	}
+	if _, err := addTargetErr(&targetConfig{Name: "2001:db8::1", Family: "ipv4"}); err == nil {
+		t.Error("expected an IPv6 address to be rejected for an IPv4 target")
+	}
+}
+
+func TestResolver(t *testing.T) {
+	resolver := newStubResolver(t)
+	defer resolver.Close()
+	defer fakeLookup(lookupIP)()
+
+	for _, addr := range []string{"resolver.example.com", "192.0.2.53:domain", "192.0.2.53:0", "not an address"} {
+		if _, err := New(nil, newTestConfig(t, map[string]interface{}{"resolver": addr})); err == nil {
+			t.Errorf("expected resolver %v to be rejected", addr)
+		}
+	}
+	if addr, err := resolverAddr("192.0.2.53"); err != nil || addr != "192.0.2.53:53" {
+		t.Errorf("expected port 53 by default, got %v (%v)", addr, err)
+	}
+
+	// The stub answers every lookup with 192.0.2.10, which the system
+	// resolver would never return for this name
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"resolver": resolver.udp.LocalAddr().String(),
+		"useipv6":  false,
+		"targets":  []map[string]interface{}{{"name": "pingbeat-test.example"}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt := b.(*Pingbeat)
+	if target, found := bt.getTargets()["192.0.2.10"]; !found || target.Name != "pingbeat-test.example" {
+		t.Errorf("expected the target resolved by the configured resolver, got %v", bt.getTargets())
+	}
+}
@@ -0,0 +1,55 @@
+package beater
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+// SendTCPPing opens a TCP connection to the provided target and records the
+// time taken to connect as the RTT. Failed or timed out connections are
+// recorded as lost pings
+func SendTCPPing(timeout time.Duration, seq int, addr net.Addr) pool.WorkFunc {
+	return func(wu pool.WorkUnit) (interface{}, error) {
+		if wu.IsCancelled() {
+			logp.Debug("SendPings", "SendTCPPing: workunit cancelled")
+			return nil, nil
+		}
+		ping := &PingInfo{
+			Seq:      seq,
+			Target:   addr.String(),
+			Protocol: "tcp",
+			Sent:     time.Now().UTC(),
+		}
+		conn, err := net.DialTimeout("tcp", addr.String(), timeout)
+		if err != nil {
+			ping.Loss = true
+			ping.LossReason = tcpLossReason(err)
+			return ping, nil
+		}
+		ping.Received = time.Now().UTC()
+		ping.RTT = ping.Received.Sub(ping.Sent)
+		if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			ping.Source = local.IP
+		}
+		conn.Close()
+		return ping, nil
+	}
+}
+
+// tcpLossReason describes why a TCP connection attempt failed
+func tcpLossReason(err error) string {
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return "Connect timeout"
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok && sysErr.Err == syscall.ECONNREFUSED {
+			return "Connection refused"
+		}
+	}
+	return "Connect failed"
+}
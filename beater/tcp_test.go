@@ -0,0 +1,72 @@
+// +build !integration
+
+package beater
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+func runTCPPing(t *testing.T, addr net.Addr) *PingInfo {
+	wu := pool.New().Queue(SendTCPPing(time.Second, 1, addr))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return wu.Value().(*PingInfo)
+}
+
+func TestSendTCPPing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr()
+
+	ping := runTCPPing(t, addr)
+	if ping.Loss {
+		t.Fatalf("unexpected loss: %v", ping.LossReason)
+	}
+	if ping.Protocol != "tcp" || ping.RTT <= 0 {
+		t.Errorf("unexpected ping %+v", ping)
+	}
+	if !ping.Source.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("expected source 127.0.0.1, got %v", ping.Source)
+	}
+
+	l.Close()
+	ping = runTCPPing(t, addr)
+	if !ping.Loss || ping.LossReason != "Connection refused" {
+		t.Errorf("expected connection refused loss, got %+v", ping)
+	}
+}
+
+func TestTCPTargetEvent(t *testing.T) {
+	bt, client := newTestBeat()
+	target := &targetConfig{Name: "127.0.0.1", Protocol: "tcp", Port: 8080}
+	for _, thisTarget := range addTarget(t, target) {
+		bt.targets[thisTarget.Addr.String()] = *thisTarget
+	}
+
+	bt.ProcessPing(&PingInfo{Target: "127.0.0.1:8080", Protocol: "tcp", RTT: time.Millisecond})
+	event := client.next(t)
+	if event["protocol"] != "tcp" {
+		t.Errorf("expected tcp protocol, got %v", event["protocol"])
+	}
+	if event["target"].(common.MapStr)["port"] != 8080 {
+		t.Errorf("expected port 8080 in %v", event["target"])
+	}
+}
+
+func TestAddTargetInvalidTCPPort(t *testing.T) {
+	target := &targetConfig{Name: "127.0.0.1", Protocol: "tcp"}
+	wu := pool.New().Queue(AddTarget(target, privileges{true, true}, true, true, 1024))
+	wu.Wait()
+	if wu.Error() == nil {
+		t.Error("expected tcp target without a port to be rejected")
+	}
+}
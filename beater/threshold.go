@@ -0,0 +1,104 @@
+package beater
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// severity returns the severity of an RTT to a target, using the thresholds of
+// the target if set and the global thresholds otherwise. The severity is empty
+// if the RTT is within the thresholds
+func (bt *Pingbeat) severity(target Target, rtt time.Duration) string {
+	warn, crit := bt.config.RTTWarn, bt.config.RTTCrit
+	if target.RTTWarn > 0 {
+		warn = target.RTTWarn
+	}
+	if target.RTTCrit > 0 {
+		crit = target.RTTCrit
+	}
+	switch {
+	case crit > 0 && rtt > crit:
+		return "critical"
+	case warn > 0 && rtt > warn:
+		return "warning"
+	}
+	return ""
+}
+
+// minBaselineSamples is the number of replies a target's baseline RTT is
+// learned from before replies are compared against it
+const minBaselineSamples = 10
+
+// baseline returns the normal RTT of a target to compare a reply against, set
+// for the target or learned from its earlier replies
+func (bt *Pingbeat) baseline(target Target, ping *PingInfo) (time.Duration, bool) {
+	if target.BaselineRTT > 0 {
+		return target.BaselineRTT, true
+	}
+	if bt.state == nil {
+		return 0, false
+	}
+	return bt.state.UpdateBaseline(ping.Target, ping.RTT)
+}
+
+// rttBucket returns the label of the bucket an RTT falls in, given the
+// increasing bucket boundaries, e.g. "<1ms", "1-10ms" or ">200ms". An RTT on a
+// boundary falls in the bucket above it
+func rttBucket(rtt time.Duration, bounds []time.Duration) string {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(milliSeconds(d), 'f', -1, 64)
+	}
+	if rtt < bounds[0] {
+		return "<" + ms(bounds[0]) + "ms"
+	}
+	for i := 1; i < len(bounds); i++ {
+		if rtt < bounds[i] {
+			return ms(bounds[i-1]) + "-" + ms(bounds[i]) + "ms"
+		}
+	}
+	return ">" + ms(bounds[len(bounds)-1]) + "ms"
+}
+
+// severityChanged records the severity of the latest ping to a target and
+// returns the previous severity if it has changed
+func (bt *Pingbeat) severityChanged(addr string, severity string) (string, bool) {
+	bt.severitiesMU.Lock()
+	defer bt.severitiesMU.Unlock()
+	if bt.severities == nil {
+		bt.severities = make(map[string]string)
+	}
+	previous := bt.severities[addr]
+	if severity == previous {
+		return "", false
+	}
+	if severity == "" {
+		delete(bt.severities, addr)
+	} else {
+		bt.severities[addr] = severity
+	}
+	return previous, true
+}
+
+// transitionEvent builds the event published when the RTT of a target crosses
+// a threshold in either direction
+func transitionEvent(eventType string, target common.MapStr, protocol string, ping *PingInfo, severity string, previous string) common.MapStr {
+	if severity == "" {
+		severity = "ok"
+	}
+	if previous == "" {
+		previous = "ok"
+	}
+	return common.MapStr{
+		"@timestamp":        common.Time(time.Now().UTC()),
+		"type":              eventType,
+		"target":            target,
+		"protocol":          protocol,
+		"seq":               ping.Seq,
+		"rtt":               milliSeconds(ping.RTT),
+		"transition":        true,
+		"severity":          severity,
+		"previous_severity": previous,
+	}
+}
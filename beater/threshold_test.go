@@ -0,0 +1,186 @@
+// +build !integration
+
+package beater
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeverity(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.config.RTTWarn = 100 * time.Millisecond
+	bt.config.RTTCrit = 500 * time.Millisecond
+
+	tests := []struct {
+		rtt      time.Duration
+		severity interface{}
+	}{
+		{50 * time.Millisecond, nil},
+		{100 * time.Millisecond, nil},
+		{200 * time.Millisecond, "warning"},
+		{600 * time.Millisecond, "critical"},
+	}
+	for _, test := range tests {
+		bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: test.rtt})
+		event := client.next(t)
+		if event["severity"] != test.severity {
+			t.Errorf("expected severity %v for %v, got %v", test.severity, test.rtt, event["severity"])
+		}
+	}
+}
+
+func TestTargetSeverity(t *testing.T) {
+	bt, _ := newTestBeat("192.0.2.1")
+	bt.config.RTTWarn = 100 * time.Millisecond
+	bt.config.RTTCrit = 500 * time.Millisecond
+	target := bt.targets["192.0.2.1"]
+	target.RTTWarn = 10 * time.Millisecond
+	target.RTTCrit = time.Second
+
+	if severity := bt.severity(target, 50*time.Millisecond); severity != "warning" {
+		t.Errorf("expected warning from target threshold, got %q", severity)
+	}
+	if severity := bt.severity(target, 600*time.Millisecond); severity != "warning" {
+		t.Errorf("expected warning from target threshold, got %q", severity)
+	}
+}
+
+func TestThresholdTransitions(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.config.RTTWarn = 100 * time.Millisecond
+	bt.config.RTTCrit = 500 * time.Millisecond
+	bt.config.ThresholdEvents = true
+
+	// Each RTT and the transition it should produce, if any
+	tests := []struct {
+		rtt      time.Duration
+		from, to string
+	}{
+		{50 * time.Millisecond, "", ""},
+		{200 * time.Millisecond, "ok", "warning"},
+		{300 * time.Millisecond, "", ""},
+		{600 * time.Millisecond, "warning", "critical"},
+		{50 * time.Millisecond, "critical", "ok"},
+		{50 * time.Millisecond, "", ""},
+	}
+	for _, test := range tests {
+		bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: test.rtt})
+		if event := client.next(t); event["transition"] != nil {
+			t.Fatalf("expected ping event first for %v, got %v", test.rtt, event)
+		}
+		if test.to == "" {
+			continue
+		}
+		event := client.next(t)
+		if event["transition"] != true || event["previous_severity"] != test.from || event["severity"] != test.to {
+			t.Errorf("expected transition from %v to %v, got %v", test.from, test.to, event)
+		}
+	}
+	select {
+	case event := <-client.events:
+		t.Errorf("unexpected event %v", event)
+	default:
+	}
+}
+
+func TestRTTBucket(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.config.RTTBuckets = []time.Duration{500 * time.Microsecond, 5 * time.Millisecond, time.Second}
+
+	tests := []struct {
+		rtt    time.Duration
+		bucket string
+	}{
+		{100 * time.Microsecond, "<0.5ms"},
+		{500 * time.Microsecond, "0.5-5ms"},
+		{2 * time.Millisecond, "0.5-5ms"},
+		{5 * time.Millisecond, "5-1000ms"},
+		{999 * time.Millisecond, "5-1000ms"},
+		{3 * time.Second, ">1000ms"},
+	}
+	for _, test := range tests {
+		bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: test.rtt})
+		if event := client.next(t); event["rtt_bucket"] != test.bucket {
+			t.Errorf("expected bucket %v for %v, got %v", test.bucket, test.rtt, event["rtt_bucket"])
+		}
+	}
+
+	// Lost pings have no RTT to bucket
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", Loss: true, LossReason: "Timeout"})
+	if event := client.next(t); event["rtt_bucket"] != nil {
+		t.Errorf("expected no bucket for a lost ping, got %v", event["rtt_bucket"])
+	}
+
+	_, err := New(nil, newTestConfig(t, map[string]interface{}{
+		"rttbuckets": []string{"10ms", "1ms"},
+	}))
+	if err == nil {
+		t.Error("expected decreasing rttbuckets to be rejected")
+	}
+}
+
+func TestBaselineStatic(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.state = NewPingState()
+	bt.config.BaselineFactor = 2
+	target := bt.targets["192.0.2.1"]
+	target.BaselineRTT = 10 * time.Millisecond
+	bt.targets["192.0.2.1"] = target
+
+	tests := []struct {
+		rtt       time.Duration
+		deviation float64
+		anomaly   bool
+	}{
+		{8 * time.Millisecond, -2, false},
+		{20 * time.Millisecond, 10, false},
+		{25 * time.Millisecond, 15, true},
+	}
+	for _, test := range tests {
+		bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: test.rtt})
+		event := client.next(t)
+		if event["rtt_deviation_ms"] != test.deviation || (event["anomaly"] == true) != test.anomaly {
+			t.Errorf("%v: expected deviation %v and anomaly %v, got %v and %v", test.rtt, test.deviation, test.anomaly, event["rtt_deviation_ms"], event["anomaly"])
+		}
+	}
+}
+
+func TestBaselineLearned(t *testing.T) {
+	bt, client := newTestBeat("192.0.2.1")
+	bt.state = NewPingState()
+	bt.config.BaselineFactor = 3
+
+	// Nothing is compared until the baseline is learned
+	for i := 0; i < minBaselineSamples; i++ {
+		bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: 10 * time.Millisecond})
+		if event := client.next(t); event["rtt_deviation_ms"] != nil || event["anomaly"] != nil {
+			t.Fatalf("reply %d: unexpected baseline comparison %v", i, event)
+		}
+	}
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: 12 * time.Millisecond})
+	if event := client.next(t); event["rtt_deviation_ms"] != 2.0 || event["anomaly"] != nil {
+		t.Errorf("expected a 2ms deviation, got %v", event)
+	}
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: 40 * time.Millisecond})
+	if event := client.next(t); event["anomaly"] != true {
+		t.Errorf("expected an anomaly, got %v", event)
+	}
+
+	// The baseline follows a lasting change in RTT
+	for i := 0; i < 50; i++ {
+		bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: 40 * time.Millisecond})
+		client.next(t)
+	}
+	bt.ProcessPing(&PingInfo{Target: "192.0.2.1", RTT: 40 * time.Millisecond})
+	if event := client.next(t); event["anomaly"] != nil || event["rtt_deviation_ms"].(float64) > 1 {
+		t.Errorf("expected the baseline to have learned the new RTT, got %v", event)
+	}
+
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"baselinefactor": 0.5})); err == nil {
+		t.Error("expected a baseline factor of at most 1 to be rejected")
+	}
+	if _, err := addTargetErr(&targetConfig{Name: "192.0.2.1", BaselineRTT: -time.Second}); err == nil {
+		t.Error("expected a negative baseline to be rejected")
+	}
+}
@@ -0,0 +1,34 @@
+// +build linux
+
+package beater
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/icmp"
+)
+
+// enableTimestamps asks the kernel to timestamp packets received on the
+// connection
+func enableTimestamps(conn *icmp.PacketConn) error {
+	return setSockopt(conn, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+}
+
+// rxTimestamp returns the kernel receive timestamp from the control messages
+// of a packet
+func rxTimestamp(oob []byte) (time.Time, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SCM_TIMESTAMPNS &&
+			len(m.Data) >= int(unsafe.Sizeof(syscall.Timespec{})) {
+			ts := (*syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+			return time.Unix(ts.Unix()).UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
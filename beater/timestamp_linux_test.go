@@ -0,0 +1,51 @@
+// +build linux,!integration
+
+package beater
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+func TestReadFromKernelTimestamp(t *testing.T) {
+	conn, err := createConn("ip4:icmp", "127.0.0.1")
+	if err != nil {
+		t.Skipf("cannot open raw ICMP socket: %v", err)
+	}
+	defer conn.Close()
+	// The kernel enables receive timestamping asynchronously, so give it a
+	// moment when no other socket has it enabled
+	time.Sleep(100 * time.Millisecond)
+
+	echo, err := NewEchoPacket(ipv4.ICMPTypeEcho, 0xbeef, defaultPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wu := pool.New().Queue(SendPing(conn, time.Second, echo, 4545, 0, &net.IPAddr{IP: net.ParseIP("127.0.0.1")}, NewPingState()))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		t.Fatal(err)
+	}
+	sent := wu.Value().(*PingInfo).Sent
+
+	// The reply waits in the socket buffer, a userspace timestamp would be
+	// taken after the delay
+	delay := 200 * time.Millisecond
+	time.Sleep(delay)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, minRecvBufferSize)
+	n, _, received, _, _, _, err := readFrom(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("nothing read")
+	}
+	if received.Sub(sent) >= delay/2 {
+		t.Errorf("expected kernel timestamp close to %v, got %v", sent, received)
+	}
+}
@@ -0,0 +1,20 @@
+// +build !linux
+
+package beater
+
+import (
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// enableTimestamps does nothing, kernel receive timestamps are only used on
+// Linux
+func enableTimestamps(conn *icmp.PacketConn) error {
+	return nil
+}
+
+// rxTimestamp never finds a kernel receive timestamp
+func rxTimestamp(oob []byte) (time.Time, bool) {
+	return time.Time{}, false
+}
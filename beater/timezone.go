@@ -0,0 +1,36 @@
+package beater
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// zonedTimeLayout is the layout libbeat writes timestamps with, but with the
+// offset of the timezone rather than always Z
+const zonedTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// zonedTime is an event timestamp written in its own timezone
+type zonedTime time.Time
+
+func (t zonedTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Time(t).Format(zonedTimeLayout))
+}
+
+// zoned returns the event with its @timestamp in the configured timezone, for
+// the outputs pingbeat writes itself. The event is copied rather than changed,
+// as libbeat needs the timestamp as a common.Time. In UTC the event is
+// returned unchanged
+func (bt *Pingbeat) zoned(event common.MapStr) common.MapStr {
+	ts, ok := event["@timestamp"].(common.Time)
+	if !ok || bt.location == nil || bt.location == time.UTC {
+		return event
+	}
+	zoned := make(common.MapStr, len(event))
+	for key, value := range event {
+		zoned[key] = value
+	}
+	zoned["@timestamp"] = zonedTime(time.Time(ts).In(bt.location))
+	return zoned
+}
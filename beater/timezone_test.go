@@ -0,0 +1,114 @@
+// +build !integration
+
+package beater
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/joshuar/pingbeat/config"
+)
+
+// writtenTimestamp returns the @timestamp of the first JSON event in b
+func writtenTimestamp(t *testing.T, b []byte) string {
+	line, err := bufio.NewReader(bytes.NewReader(b)).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("no event written: %v", err)
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(line, &event); err != nil {
+		t.Fatal(err)
+	}
+	ts, _ := event["@timestamp"].(string)
+	return ts
+}
+
+func TestTimezone(t *testing.T) {
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"timezone": "Nowhere/Special"})); err == nil {
+		t.Error("expected an unknown timezone to be rejected")
+	}
+	b, err := New(nil, newTestConfig(t, map[string]interface{}{"timezone": "Local"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt := b.(*Pingbeat); bt.location != time.Local {
+		t.Errorf("expected the local timezone, got %v", bt.location)
+	}
+
+	sent := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	ping := func() *PingInfo {
+		return &PingInfo{Target: "192.0.2.1", Seq: 1, Sent: sent, Received: sent.Add(20 * time.Millisecond), RTT: 20 * time.Millisecond}
+	}
+	tests := []struct {
+		location *time.Location
+		expected string
+	}{
+		// UTC unless configured otherwise
+		{nil, "2024-01-02T03:04:05.000Z"},
+		{time.UTC, "2024-01-02T03:04:05.000Z"},
+		{time.FixedZone("UTC+2", 2*60*60), "2024-01-02T05:04:05.000+02:00"},
+		{time.FixedZone("UTC-5", -5*60*60), "2024-01-01T22:04:05.000-05:00"},
+	}
+	for _, test := range tests {
+		bt, _ := newTestBeat("192.0.2.1")
+		bt.config.DryRun = true
+		bt.config.TimestampSource = "sent"
+		bt.location = test.location
+		var out bytes.Buffer
+		bt.out = &out
+		bt.ProcessPing(ping())
+		if ts := writtenTimestamp(t, out.Bytes()); ts != test.expected {
+			t.Errorf("expected @timestamp %v, got %v", test.expected, ts)
+		}
+	}
+
+	// Events written to a file are stamped in the timezone, those published
+	// through libbeat stay in UTC
+	dir, err := ioutil.TempDir("", "pingbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pingbeat.ndjson")
+	bt, client := newTestBeat("192.0.2.1")
+	bt.config.TimestampSource = "sent"
+	bt.location = time.FixedZone("UTC+2", 2*60*60)
+	bt.config.FileOutput = config.FileOutputConfig{Path: path, RotateBytes: 1024, Keep: 1, Publish: true}
+	if bt.file, err = NewFileOutput(bt.config.FileOutput); err != nil {
+		t.Fatal(err)
+	}
+	bt.ProcessPing(ping())
+	bt.file.Close()
+	written, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := writtenTimestamp(t, written); ts != "2024-01-02T05:04:05.000+02:00" {
+		t.Errorf("expected the file event stamped in UTC+2, got %v", ts)
+	}
+	published, err := json.Marshal(client.next(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := writtenTimestamp(t, append(published, '\n')); ts != "2024-01-02T03:04:05.000Z" {
+		t.Errorf("expected the published event stamped in UTC, got %v", ts)
+	}
+
+	// Other event types are stamped in the timezone too
+	bt, _ = newTestBeat()
+	bt.config.DryRun = true
+	bt.location = time.FixedZone("UTC+2", 2*60*60)
+	var out bytes.Buffer
+	bt.out = &out
+	bt.publish(common.MapStr{"@timestamp": common.Time(sent), "type": "pingbeat_summary"})
+	if ts := writtenTimestamp(t, out.Bytes()); ts != "2024-01-02T05:04:05.000+02:00" {
+		t.Errorf("expected the summary stamped in UTC+2, got %v", ts)
+	}
+}
@@ -0,0 +1,231 @@
+package beater
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// tracerouteIDBit is flipped in the ICMP ID of traceroute probes, so the
+// errors and replies they cause are ignored by the ping receivers
+const tracerouteIDBit = 0x8000
+
+// Hop is the result of a traceroute probe sent with a given TTL
+type Hop struct {
+	Hop int
+	IP  string
+	RTT time.Duration
+	// Loss is set if nothing answered the probe within the timeout
+	Loss bool
+	// Reached is set if the target, or a router reporting it unreachable,
+	// answered the probe, which ends the traceroute
+	Reached bool
+}
+
+// traceroutes traces the route to every ICMP target each traceroute period,
+// until stop is closed
+func (bt *Pingbeat) traceroutes(pingID int, stop <-chan struct{}) {
+	ticker := time.NewTicker(bt.config.Traceroute.Period)
+	defer ticker.Stop()
+	for {
+		bt.TraceTargets(pingID^tracerouteIDBit, stop)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// TraceTargets traces the route to each ICMP target in turn and publishes an
+// event for every hop, giving up early if stop is closed
+func (bt *Pingbeat) TraceTargets(id int, stop <-chan struct{}) {
+	var ipv4conn, ipv6conn *icmp.PacketConn
+	var ipv4echo, ipv6echo *EchoPacket
+	defer func() {
+		if ipv4conn != nil {
+			ipv4conn.Close()
+		}
+		if ipv6conn != nil {
+			ipv6conn.Close()
+		}
+	}()
+	for addr, target := range bt.getTargets() {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if target.Protocol != "icmp" {
+			continue
+		}
+		var err error
+		conn, echo := ipv4conn, ipv4echo
+		if target.IPv6 {
+			conn, echo = ipv6conn, ipv6echo
+		}
+		if conn == nil {
+			// Each family gets its own connection, so changing the TTL
+			// doesn't affect pings
+			network, address, pingType := bt.ipv4network, bt.ipv4addr, icmp.Type(ipv4.ICMPTypeEcho)
+			if target.IPv6 {
+				network, address, pingType = bt.ipv6network, bt.ipv6addr, ipv6.ICMPTypeEchoRequest
+			}
+			if conn, err = bt.openConn(network, address); err != nil {
+				logp.Err("Error creating %s connection for traceroute: %v", network, err)
+				continue
+			}
+			if echo, err = NewEchoPacket(pingType, id, bt.payload); err != nil {
+				conn.Close()
+				logp.Err("Error creating echo request: %v", err)
+				continue
+			}
+			if target.IPv6 {
+				ipv6conn, ipv6echo = conn, echo
+			} else {
+				ipv4conn, ipv4echo = conn, echo
+			}
+		}
+		hops, err := Traceroute(conn, echo, target.Addr, bt.config.Traceroute.MaxHops, bt.config.Timeout, stop)
+		if err != nil {
+			logp.Err("Error tracing route to %v (%v): %v", target.Name, addr, err)
+		}
+		for _, hop := range hops {
+			bt.publish(hopEvent(bt.config.EventType, target.fields(addr), hop))
+		}
+	}
+}
+
+// hopEvent builds the event published for a traceroute hop
+func hopEvent(eventType string, target common.MapStr, hop Hop) common.MapStr {
+	event := common.MapStr{
+		"@timestamp": common.Time(time.Now().UTC()),
+		"type":       eventType,
+		"target":     target,
+		"protocol":   "icmp",
+		"hop":        hop.Hop,
+	}
+	if hop.Loss {
+		event["loss"] = true
+	} else {
+		event["hop_ip"] = hop.IP
+		event["rtt_ms"] = milliSeconds(hop.RTT)
+	}
+	if hop.Reached {
+		event["reached"] = true
+	}
+	return event
+}
+
+// Traceroute probes the route to addr with echo requests of increasing TTL
+// until the target replies or maxHops is reached. The routers along the route
+// are found from the Time Exceeded errors they send. Each probe waits up to
+// timeout for an answer before moving on to the next hop
+func Traceroute(conn *icmp.PacketConn, echo *EchoPacket, addr net.Addr, maxHops int, timeout time.Duration, done <-chan struct{}) ([]Hop, error) {
+	ipAddr, ok := addr.(*net.IPAddr)
+	if !ok {
+		return nil, errors.New("traceroute needs a raw socket")
+	}
+	var pingType icmp.Type = ipv4.ICMPTypeEcho
+	if conn.IPv6PacketConn() != nil {
+		pingType = ipv6.ICMPTypeEchoRequest
+	}
+	b := make([]byte, minRecvBufferSize)
+	var hops []Hop
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		select {
+		case <-done:
+			return hops, nil
+		default:
+		}
+		if err := setTTL(conn, ttl); err != nil {
+			return hops, err
+		}
+		sent := time.Now().UTC()
+		if _, err := conn.WriteTo(echo.Packet(ttl), addr); err != nil {
+			return hops, err
+		}
+		if err := conn.SetReadDeadline(sent.Add(timeout)); err != nil {
+			return hops, err
+		}
+		hop := Hop{Hop: ttl, Loss: true}
+		for hop.Loss {
+			n, _, received, _, peer, _, err := readFrom(conn, b)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return hops, err
+			}
+			message, err := icmp.ParseMessage(pingType.Protocol(), b[:n])
+			if err != nil {
+				continue
+			}
+			if reached, ok := matchHop(pingType, message, echo.ID, ttl, ipAddr.IP); ok {
+				hop.IP = peerIP(peer)
+				hop.RTT = received.Sub(sent)
+				hop.Loss = false
+				hop.Reached = reached
+			}
+		}
+		hops = append(hops, hop)
+		if hop.Reached {
+			break
+		}
+	}
+	return hops, nil
+}
+
+// matchHop checks whether a message answers the traceroute probe with the
+// given ID and sequence number sent to target, and if so whether it ends the
+// traceroute
+func matchHop(pingType icmp.Type, message *icmp.Message, id int, seq int, target net.IP) (bool, bool) {
+	var data []byte
+	switch body := message.Body.(type) {
+	case *icmp.Echo:
+		reply := message.Type == ipv4.ICMPTypeEchoReply || message.Type == ipv6.ICMPTypeEchoReply
+		return true, reply && body.ID == id && body.Seq == seq
+	case *icmp.TimeExceeded:
+		data = body.Data
+	case *icmp.DstUnreach:
+		data = body.Data
+	default:
+		return false, false
+	}
+	errID, errSeq, dst, err := parseICMPError(pingType, data)
+	if err != nil || errID != id || errSeq != seq || !target.Equal(net.ParseIP(dst)) {
+		return false, false
+	}
+	_, unreachable := message.Body.(*icmp.DstUnreach)
+	return unreachable, true
+}
+
+// peerIP returns the IP address of the sender of a message
+func peerIP(peer net.Addr) string {
+	switch addr := peer.(type) {
+	case *net.IPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	return peer.String()
+}
+
+// setTTL sets the TTL (IPv4) or hop limit (IPv6) of packets sent through the
+// connection
+func setTTL(conn *icmp.PacketConn, ttl int) error {
+	switch {
+	case conn.IPv4PacketConn() != nil:
+		return conn.IPv4PacketConn().SetTTL(ttl)
+	case conn.IPv6PacketConn() != nil:
+		return conn.IPv6PacketConn().SetHopLimit(ttl)
+	default:
+		return errors.New("Unknown connection type")
+	}
+}
@@ -0,0 +1,121 @@
+// +build !integration
+
+package beater
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// quotedEcho returns the IPv4 packet of an echo request as quoted in ICMP
+// errors, i.e. the IP header and the first 8 bytes of the echo
+func quotedEcho(t *testing.T, dst string, id int, seq int) []byte {
+	header := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + icmpHeaderLen,
+		TTL:      1,
+		Protocol: 1,
+		Src:      net.ParseIP("192.0.2.100"),
+		Dst:      net.ParseIP(dst),
+	}
+	b, err := header.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo, err := marshalEcho(ipv4.ICMPTypeEcho, id, seq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(b, echo[:icmpHeaderLen]...)
+}
+
+func TestMatchHop(t *testing.T) {
+	target := net.ParseIP("192.0.2.1")
+	tests := []struct {
+		name    string
+		message *icmp.Message
+		ok      bool
+		reached bool
+	}{
+		{"intermediate hop", &icmp.Message{
+			Type: ipv4.ICMPTypeTimeExceeded,
+			Body: &icmp.TimeExceeded{Data: quotedEcho(t, "192.0.2.1", 0xbeef, 3)},
+		}, true, false},
+		{"unreachable", &icmp.Message{
+			Type: ipv4.ICMPTypeDestinationUnreachable,
+			Body: &icmp.DstUnreach{Data: quotedEcho(t, "192.0.2.1", 0xbeef, 3)},
+		}, true, true},
+		{"target reply", &icmp.Message{
+			Type: ipv4.ICMPTypeEchoReply,
+			Body: &icmp.Echo{ID: 0xbeef, Seq: 3},
+		}, true, true},
+		{"own request", &icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: 0xbeef, Seq: 3},
+		}, false, false},
+		{"other probe", &icmp.Message{
+			Type: ipv4.ICMPTypeTimeExceeded,
+			Body: &icmp.TimeExceeded{Data: quotedEcho(t, "192.0.2.1", 0xbeef, 2)},
+		}, false, false},
+		{"other target", &icmp.Message{
+			Type: ipv4.ICMPTypeTimeExceeded,
+			Body: &icmp.TimeExceeded{Data: quotedEcho(t, "192.0.2.2", 0xbeef, 3)},
+		}, false, false},
+		{"other ID", &icmp.Message{
+			Type: ipv4.ICMPTypeTimeExceeded,
+			Body: &icmp.TimeExceeded{Data: quotedEcho(t, "192.0.2.1", 0xcafe, 3)},
+		}, false, false},
+	}
+	for _, test := range tests {
+		reached, ok := matchHop(ipv4.ICMPTypeEcho, test.message, 0xbeef, 3, target)
+		if ok != test.ok || (ok && reached != test.reached) {
+			t.Errorf("%s: expected match %v reached %v, got %v %v", test.name, test.ok, test.reached, ok, reached)
+		}
+	}
+}
+
+func TestTraceTargetsLoopback(t *testing.T) {
+	bt, client := newTestBeat("127.0.0.1")
+	bt.ipv4network, bt.ipv4addr = "ip4:icmp", "0.0.0.0"
+	bt.config.Timeout = time.Second
+	if conn, err := createConn(bt.ipv4network, bt.ipv4addr); err != nil {
+		t.Skipf("cannot open raw ICMP socket: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	bt.TraceTargets(0xbeef, make(chan struct{}))
+	event := client.next(t)
+	if event["hop"] != 1 || event["hop_ip"] != "127.0.0.1" || event["reached"] != true {
+		t.Errorf("expected loopback to be reached at hop 1, got %v", event)
+	}
+	if _, found := event["rtt_ms"]; !found {
+		t.Error("hop has no rtt_ms")
+	}
+	select {
+	case event := <-client.events:
+		t.Errorf("unexpected hop after reaching target: %v", event)
+	default:
+	}
+}
+
+func TestNewTraceroute(t *testing.T) {
+	tests := []map[string]interface{}{
+		{"traceroute.period": "1m", "traceroute.maxhops": 0},
+		{"traceroute.period": "1m", "traceroute.maxhops": 256},
+	}
+	for _, settings := range tests {
+		settings["privileged"] = true
+		if _, err := New(nil, newTestConfig(t, settings)); err == nil {
+			t.Errorf("expected %v to be rejected", settings)
+		}
+	}
+	if _, err := New(nil, newTestConfig(t, map[string]interface{}{"traceroute.period": "1m"})); err == nil {
+		t.Error("expected traceroute to need privileged mode")
+	}
+}
@@ -0,0 +1,82 @@
+package beater
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+// SendUDPPing sends a datagram carrying the sequence number and payload to a
+// UDP echo service at the provided target and records the time until it is
+// echoed back as the RTT. Pings that aren't echoed within the timeout are
+// recorded as lost
+func SendUDPPing(timeout time.Duration, seq int, addr net.Addr, payload []byte) pool.WorkFunc {
+	return func(wu pool.WorkUnit) (interface{}, error) {
+		if wu.IsCancelled() {
+			logp.Debug("SendPings", "SendUDPPing: workunit cancelled")
+			return nil, nil
+		}
+		ping := &PingInfo{
+			Seq:      seq,
+			Target:   addr.String(),
+			Protocol: "udp",
+			Sent:     time.Now().UTC(),
+		}
+		conn, err := net.Dial("udp", addr.String())
+		if err != nil {
+			ping.Loss = true
+			ping.LossReason = udpLossReason(err)
+			return ping, nil
+		}
+		defer conn.Close()
+		conn.SetDeadline(ping.Sent.Add(timeout))
+
+		request := make([]byte, 2+len(payload))
+		binary.BigEndian.PutUint16(request, uint16(seq))
+		copy(request[2:], payload)
+		if _, err := conn.Write(request); err != nil {
+			ping.Loss = true
+			ping.LossReason = udpLossReason(err)
+			return ping, nil
+		}
+		// Skip anything that isn't the echo of this request, e.g. a late
+		// reply to an earlier one
+		reply := make([]byte, len(request)+1)
+		for {
+			n, err := conn.Read(reply)
+			if err != nil {
+				ping.Loss = true
+				ping.LossReason = udpLossReason(err)
+				return ping, nil
+			}
+			if bytes.Equal(reply[:n], request) {
+				break
+			}
+		}
+		ping.Received = time.Now().UTC()
+		ping.RTT = ping.Received.Sub(ping.Sent)
+		if local, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			ping.Source = local.IP
+		}
+		return ping, nil
+	}
+}
+
+// udpLossReason describes why a UDP ping wasn't echoed
+func udpLossReason(err error) string {
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return "Timeout"
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok && sysErr.Err == syscall.ECONNREFUSED {
+			return "Port unreachable"
+		}
+	}
+	return "Send failed"
+}
@@ -0,0 +1,94 @@
+// +build !integration
+
+package beater
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"gopkg.in/go-playground/pool.v3"
+)
+
+// udpEchoServer echoes datagrams back to their sender until closed
+func udpEchoServer(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(b[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func runUDPPing(t *testing.T, addr net.Addr, timeout time.Duration) *PingInfo {
+	wu := pool.New().Queue(SendUDPPing(timeout, 1, addr, defaultPayload))
+	wu.Wait()
+	if err := wu.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return wu.Value().(*PingInfo)
+}
+
+func TestSendUDPPing(t *testing.T) {
+	server := udpEchoServer(t)
+	addr := server.LocalAddr()
+
+	ping := runUDPPing(t, addr, time.Second)
+	if ping.Loss {
+		t.Fatalf("unexpected loss: %v", ping.LossReason)
+	}
+	if ping.Protocol != "udp" || ping.RTT <= 0 || ping.Target != addr.String() {
+		t.Errorf("unexpected ping %+v", ping)
+	}
+
+	server.Close()
+	ping = runUDPPing(t, addr, time.Second)
+	if !ping.Loss || ping.LossReason != "Port unreachable" {
+		t.Errorf("expected port unreachable loss, got %+v", ping)
+	}
+}
+
+func TestSendUDPPingTimeout(t *testing.T) {
+	// A server that never replies
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ping := runUDPPing(t, conn.LocalAddr(), 100*time.Millisecond)
+	if !ping.Loss || ping.LossReason != "Timeout" {
+		t.Errorf("expected timeout loss, got %+v", ping)
+	}
+}
+
+func TestUDPTargetEvent(t *testing.T) {
+	bt, client := newTestBeat()
+	target := &targetConfig{Name: "127.0.0.1", Protocol: "udp", Port: 7}
+	for _, thisTarget := range addTarget(t, target) {
+		bt.targets[thisTarget.Addr.String()] = *thisTarget
+	}
+
+	bt.ProcessPing(&PingInfo{Target: "127.0.0.1:7", Protocol: "udp", RTT: time.Millisecond})
+	event := client.next(t)
+	if event["protocol"] != "udp" {
+		t.Errorf("expected udp protocol, got %v", event["protocol"])
+	}
+	if event["target"].(common.MapStr)["port"] != 7 {
+		t.Errorf("expected port 7 in %v", event["target"])
+	}
+
+	if _, err := addTargetErr(&targetConfig{Name: "127.0.0.1", Protocol: "udp"}); err == nil {
+		t.Error("expected udp target without a port to be rejected")
+	}
+}
@@ -7,16 +7,177 @@ import (
 )
 
 type Config struct {
-	Period     time.Duration    `config:"period"`
-	Privileged bool             `config:"privileged"`
-	UseIPv4    bool             `config:"useipv4"`
-	UseIPv6    bool             `config:"useipv6"`
-	Targets    []*common.Config `config:"targets"`
+	Period          time.Duration    `config:"period"`
+	Timeout         time.Duration    `config:"timeout"`
+	PingsPerPeriod  int              `config:"pingsperperiod"`
+	SendJitter      time.Duration    `config:"sendjitter"`
+	PacketSize      int              `config:"packetsize"`
+	Payload         string           `config:"payload"`
+	PayloadPattern  string           `config:"payloadpattern"`
+	MaxCIDRHosts    int              `config:"maxcidrhosts"`
+	Privileged      bool             `config:"privileged"`
+	PrivilegedIPv4  *bool            `config:"privilegedipv4"`
+	PrivilegedIPv6  *bool            `config:"privilegedipv6"`
+	ResolveTTL      time.Duration    `config:"resolvettl"`
+	Resolver        string           `config:"resolver"`
+	SummaryPeriod   time.Duration    `config:"summaryperiod"`
+	SummaryOnly     bool             `config:"summaryonly"`
+	SummaryWindow   int              `config:"summarywindow"`
+	SummaryReset    bool             `config:"summaryreset"`
+	StatsPeriod     time.Duration    `config:"statsperiod"`
+	UseIPv4         bool             `config:"useipv4"`
+	UseIPv6         bool             `config:"useipv6"`
+	Targets         []*common.Config `config:"targets"`
+	TargetsFile     string           `config:"targetsfile"`
+	TOS             int              `config:"tos"`
+	TTL             int              `config:"ttl"`
+	DontFragment    bool             `config:"dontfragment"`
+	RecordRoute     bool             `config:"recordroute"`
+	ICMPID          int              `config:"icmpid"`
+	Workers         int              `config:"workers"`
+	MaxWorkers      int              `config:"maxworkers"`
+	SendRetries     int              `config:"sendretries"`
+	RateLimit       int              `config:"ratelimit"`
+	Count           int              `config:"count"`
+	PrintSummary    bool             `config:"printsummary"`
+	ECS             bool             `config:"ecs"`
+	DryRun          bool             `config:"dryrun"`
+	EventType       string           `config:"eventtype"`
+	TimestampSource string           `config:"timestampsource"`
+	Timezone        string           `config:"timezone"`
+	BatchSize       int              `config:"batchsize"`
+	FlushInterval   time.Duration    `config:"flushinterval"`
+	RTTWarn         time.Duration    `config:"rttwarn"`
+	RTTCrit         time.Duration    `config:"rttcrit"`
+	BaselineFactor  float64          `config:"baselinefactor"`
+	RTTBuckets      []time.Duration  `config:"rttbuckets"`
+	ThresholdEvents bool             `config:"thresholdevents"`
+	DownAfter       int              `config:"downafter"`
+	FlapWindow      time.Duration    `config:"flapwindow"`
+	FlapThreshold   int              `config:"flapthreshold"`
+	StateOnly       bool             `config:"stateonly"`
+	EmitLoss        bool             `config:"emitloss"`
+	LossThreshold   int              `config:"lossthreshold"`
+	Interface       string           `config:"interface"`
+	NetNS           string           `config:"netns"`
+	SourceIPv4      string           `config:"sourceipv4"`
+	SourceIPv6      string           `config:"sourceipv6"`
+	MetricsAddr     string           `config:"metricsaddr"`
+	APIAddr         string           `config:"apiaddr"`
+	StatsD          StatsDConfig     `config:"statsd"`
+	InfluxDB        InfluxDBConfig   `config:"influxdb"`
+	FileOutput      FileOutputConfig `config:"fileoutput"`
+	OTel            OTelConfig       `config:"otel"`
+	Traceroute      TracerouteConfig `config:"traceroute"`
+	Consul          ConsulConfig     `config:"consul"`
+	Kubernetes      KubernetesConfig `config:"kubernetes"`
+	GeoIP           GeoIPConfig      `config:"geoip"`
+	Kafka           KafkaConfig      `config:"kafka"`
+}
+
+type StatsDConfig struct {
+	Addr   string `config:"addr"`
+	Prefix string `config:"prefix"`
+}
+
+type InfluxDBConfig struct {
+	URL      string `config:"url"`
+	Database string `config:"database"`
+	Username string `config:"username"`
+	Password string `config:"password"`
+}
+
+type KafkaConfig struct {
+	Brokers     []string `config:"brokers"`
+	Topic       string   `config:"topic"`
+	KeyByTarget bool     `config:"keybytarget"`
+}
+
+type OTelConfig struct {
+	Endpoint string        `config:"endpoint"`
+	Insecure bool          `config:"insecure"`
+	Interval time.Duration `config:"interval"`
+}
+
+type FileOutputConfig struct {
+	Path        string `config:"path"`
+	RotateBytes int64  `config:"rotatebytes"`
+	Keep        int    `config:"keep"`
+	Publish     bool   `config:"publish"`
+}
+
+type ConsulConfig struct {
+	Addr    string        `config:"addr"`
+	Service string        `config:"service"`
+	Tag     string        `config:"tag"`
+	Refresh time.Duration `config:"refresh"`
+}
+
+type KubernetesConfig struct {
+	Host      string        `config:"host"`
+	Namespace string        `config:"namespace"`
+	Service   string        `config:"service"`
+	TokenFile string        `config:"tokenfile"`
+	CAFile    string        `config:"cafile"`
+	Refresh   time.Duration `config:"refresh"`
+}
+
+type GeoIPConfig struct {
+	CountryDB string `config:"countrydb"`
+	ASNDB     string `config:"asndb"`
+}
+
+type TracerouteConfig struct {
+	Period  time.Duration `config:"period"`
+	MaxHops int           `config:"maxhops"`
 }
 
 var DefaultConfig = Config{
-	Period:     1 * time.Second,
-	Privileged: true,
-	UseIPv4:    true,
-	UseIPv6:    true,
+	Period:          1 * time.Second,
+	Timeout:         4 * time.Second,
+	PingsPerPeriod:  1,
+	MaxCIDRHosts:    1024,
+	SummaryWindow:   100,
+	EventType:       "pingbeat",
+	TimestampSource: "publish",
+	Timezone:        "UTC",
+	SendRetries:     2,
+	MaxWorkers:      1024,
+	BatchSize:       50,
+	FlushInterval:   1 * time.Second,
+	Privileged:      true,
+	UseIPv4:         true,
+	UseIPv6:         true,
+	EmitLoss:        true,
+	LossThreshold:   1,
+	RTTBuckets: []time.Duration{
+		1 * time.Millisecond,
+		10 * time.Millisecond,
+		50 * time.Millisecond,
+		200 * time.Millisecond,
+	},
+	StatsD: StatsDConfig{
+		Prefix: "pingbeat",
+	},
+	OTel: OTelConfig{
+		Interval: 10 * time.Second,
+	},
+	FileOutput: FileOutputConfig{
+		RotateBytes: 10 * 1024 * 1024,
+		Keep:        7,
+		Publish:     true,
+	},
+	Traceroute: TracerouteConfig{
+		MaxHops: 30,
+	},
+	Consul: ConsulConfig{
+		Addr:    "http://127.0.0.1:8500",
+		Refresh: 30 * time.Second,
+	},
+	Kubernetes: KubernetesConfig{
+		Namespace: "default",
+		TokenFile: "/var/run/secrets/kubernetes.io/serviceaccount/token",
+		CAFile:    "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt",
+		Refresh:   10 * time.Second,
+	},
 }
@@ -1,3 +1,14 @@
 // +build !integration
 
 package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDefaultTimeout(t *testing.T) {
+	if DefaultConfig.Timeout != 4*time.Second {
+		t.Errorf("expected default timeout of 4s, got %v", DefaultConfig.Timeout)
+	}
+}